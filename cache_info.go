@@ -2,8 +2,13 @@ package nix
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
 	"strconv"
+	"strings"
 )
 
 // CacheInfoName is the name of the binary cache resource
@@ -26,6 +31,26 @@ type CacheInfo struct {
 	WantMassQuery bool
 }
 
+// NewCacheInfo returns the [CacheInfo] for a new binary cache
+// with the given settings.
+// An empty storeDir is treated as [DefaultStoreDirectory].
+// storeDir is cleaned as if by [CleanStoreDirectory],
+// and NewCacheInfo returns an error if it is not an absolute path.
+func NewCacheInfo(storeDir StoreDirectory, priority int, massQuery bool) (*CacheInfo, error) {
+	if storeDir == "" {
+		storeDir = DefaultStoreDirectory
+	}
+	cleaned, err := CleanStoreDirectory(string(storeDir))
+	if err != nil {
+		return nil, fmt.Errorf("new %s: %v", CacheInfoName, err)
+	}
+	return &CacheInfo{
+		StoreDirectory: cleaned,
+		Priority:       priority,
+		WantMassQuery:  massQuery,
+	}, nil
+}
+
 // MarshalText formats the binary cache information in the format of a nix-cache-info file.
 func (info *CacheInfo) MarshalText() ([]byte, error) {
 	storeDir := info.StoreDirectory
@@ -75,3 +100,85 @@ func (info *CacheInfo) UnmarshalText(data []byte) error {
 	}
 	return nil
 }
+
+// HTTPHandler returns an [http.Handler] that serves info
+// in the format of a nix-cache-info file with the [CacheInfoMIMEType] content type.
+// The handler responds to GET and HEAD requests
+// and responds to other methods with 405 Method Not Allowed.
+// info is marshaled on every request,
+// so changes to info are reflected in subsequent responses.
+func (info *CacheInfo) HTTPHandler() http.Handler {
+	return cacheInfoHandler{info}
+}
+
+type cacheInfoHandler struct {
+	info *CacheInfo
+}
+
+func (h cacheInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := h.info.MarshalText()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", CacheInfoMIMEType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(data)
+}
+
+// maxCacheInfoSize is the maximum number of bytes
+// [FetchCacheInfo] will read from a response body.
+const maxCacheInfoSize = 64 << 10
+
+// FetchCacheInfo retrieves and parses the [CacheInfo]
+// of the binary cache at the given base URL
+// (e.g. "https://cache.nixos.org").
+// The response must have a content type of [CacheInfoMIMEType] or "text/plain".
+// If client is nil, [http.DefaultClient] is used.
+func FetchCacheInfo(ctx context.Context, client *http.Client, baseURL string) (*CacheInfo, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u := strings.TrimSuffix(baseURL, "/") + "/" + CacheInfoName
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", u, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: http %s", u, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, fmt.Errorf("fetch %s: content type: %v", u, err)
+		}
+		if mediaType != CacheInfoMIMEType && mediaType != "text/plain" {
+			return nil, fmt.Errorf("fetch %s: unexpected content type %q", u, mediaType)
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCacheInfoSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", u, err)
+	}
+	if len(data) > maxCacheInfoSize {
+		return nil, fmt.Errorf("fetch %s: response too large", u)
+	}
+	info := new(CacheInfo)
+	if err := info.UnmarshalText(data); err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", u, err)
+	}
+	return info, nil
+}
@@ -1,6 +1,10 @@
 package nix
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -40,6 +44,50 @@ func TestCacheInfoMarshalText(t *testing.T) {
 	}
 }
 
+func TestNewCacheInfo(t *testing.T) {
+	tests := []struct {
+		storeDir  StoreDirectory
+		priority  int
+		massQuery bool
+		marshaled string
+	}{
+		{
+			storeDir:  "",
+			marshaled: "StoreDir: /nix/store\n",
+		},
+		{
+			storeDir:  DefaultStoreDirectory,
+			priority:  40,
+			massQuery: true,
+			marshaled: "StoreDir: /nix/store\nPriority: 40\nWantMassQuery: 1\n",
+		},
+		{
+			storeDir:  "/foo/",
+			priority:  10,
+			marshaled: "StoreDir: /foo\nPriority: 10\n",
+		},
+	}
+	for _, test := range tests {
+		info, err := NewCacheInfo(test.storeDir, test.priority, test.massQuery)
+		if err != nil {
+			t.Errorf("NewCacheInfo(%q, %d, %t): %v", test.storeDir, test.priority, test.massQuery, err)
+			continue
+		}
+		got, err := info.MarshalText()
+		if err != nil {
+			t.Errorf("NewCacheInfo(%q, %d, %t).MarshalText(): %v", test.storeDir, test.priority, test.massQuery, err)
+			continue
+		}
+		if diff := cmp.Diff(test.marshaled, string(got)); diff != "" {
+			t.Errorf("NewCacheInfo(%q, %d, %t).MarshalText() (-want +got):\n%s", test.storeDir, test.priority, test.massQuery, diff)
+		}
+	}
+
+	if got, err := NewCacheInfo("nix/store", 0, false); err == nil {
+		t.Errorf("NewCacheInfo(\"nix/store\", 0, false) = %+v, <nil>; want _, <error>", got)
+	}
+}
+
 func TestCacheInfoUnmarshalText(t *testing.T) {
 	tests := []struct {
 		marshaled string
@@ -77,3 +125,67 @@ func TestCacheInfoUnmarshalText(t *testing.T) {
 		}
 	}
 }
+
+func TestFetchCacheInfo(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/good/"+CacheInfoName, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", CacheInfoMIMEType)
+		io.WriteString(w, "StoreDir: /nix/store\nWantMassQuery: 1\nPriority: 40\n")
+	})
+	mux.HandleFunc("/badtype/"+CacheInfoName, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html></html>")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	ctx := context.Background()
+
+	got, err := FetchCacheInfo(ctx, srv.Client(), srv.URL+"/good/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &CacheInfo{
+		StoreDirectory: "/nix/store",
+		Priority:       40,
+		WantMassQuery:  true,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("-want +got:\n%s", diff)
+	}
+
+	if got, err := FetchCacheInfo(ctx, srv.Client(), srv.URL+"/badtype"); err == nil {
+		t.Errorf("FetchCacheInfo(ctx, client, %q) = %+v, <nil>; want _, <error>", srv.URL+"/badtype", got)
+	}
+	if got, err := FetchCacheInfo(ctx, srv.Client(), srv.URL+"/missing"); err == nil {
+		t.Errorf("FetchCacheInfo(ctx, client, %q) = %+v, <nil>; want _, <error>", srv.URL+"/missing", got)
+	}
+}
+
+func TestCacheInfoHTTPHandler(t *testing.T) {
+	info := &CacheInfo{
+		StoreDirectory: "/nix/store",
+		Priority:       30,
+		WantMassQuery:  true,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/"+CacheInfoName, info.HTTPHandler())
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	got, err := FetchCacheInfo(context.Background(), srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(info, got); diff != "" {
+		t.Errorf("-want +got:\n%s", diff)
+	}
+
+	resp, err := srv.Client().Post(srv.URL+"/"+CacheInfoName, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %s; want %d", resp.Status, http.StatusMethodNotAllowed)
+	}
+}
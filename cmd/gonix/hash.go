@@ -74,18 +74,17 @@ func newHashPathCommand() *cobra.Command {
 	hashType := nix.SHA256
 	c.Flags().Var((*hashTypeFlag)(&hashType), "type", "hash `algorithm`")
 	c.RunE = func(cmd *cobra.Command, args []string) error {
-		return runHashFile(cmd.Context(), hashType, args)
+		return runHashPath(cmd.Context(), hashType, args)
 	}
 	return c
 }
 
 func runHashPath(ctx context.Context, typ nix.HashType, files []string) error {
 	for _, fname := range files {
-		h := nix.NewHasher(typ)
-		if err := nar.DumpPath(h, fname); err != nil {
+		digest, _, err := nar.DumpPathHash(typ, fname)
+		if err != nil {
 			return err
 		}
-		digest := h.SumHash()
 		fmt.Println(digest)
 	}
 	return nil
@@ -126,7 +125,7 @@ func (htf *hashTypeFlag) String() string {
 }
 
 func (htf *hashTypeFlag) Set(s string) error {
-	typ, err := nix.ParseHashType(s)
+	typ, err := nix.ParseHashTypeLenient(s)
 	if err != nil {
 		return err
 	}
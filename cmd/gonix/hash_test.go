@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestHashTypeFlag(t *testing.T) {
+	tests := []struct {
+		s    string
+		want nix.HashType
+		err  bool
+	}{
+		{s: "sha256", want: nix.SHA256},
+		{s: "SHA256", want: nix.SHA256},
+		{s: "sha-512", want: nix.SHA512},
+		{s: "sha3", err: true},
+	}
+	for _, test := range tests {
+		var got nix.HashType
+		err := (*hashTypeFlag)(&got).Set(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("Set(%q) = <nil>; want error", test.s)
+			}
+			continue
+		}
+		if got != test.want || err != nil {
+			t.Errorf("Set(%q) = %v; got %v; want %v", test.s, err, got, test.want)
+		}
+	}
+}
@@ -32,6 +32,7 @@ func main() {
 		narGroup,
 		newHashCommand(),
 		newKeyCommand(),
+		newNARInfoCommand(),
 	)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), sigterm.Signals()...)
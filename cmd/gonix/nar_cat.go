@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"zombiezen.com/go/nix/nar"
@@ -24,38 +26,58 @@ func newNARCatCommand() *cobra.Command {
 		if len(args) > 1 {
 			fileArg = args[1]
 		}
-		return runNARCat(cmd.Context(), args[0], fileArg)
+		return runNARCat(cmd.Context(), os.Stdout, args[0], fileArg)
 	}
 	return c
 }
 
-func runNARCat(ctx context.Context, archivePath string, file string) error {
+// runNARCat copies the contents of the regular file at the given path
+// inside the NAR file to dst.
+// It indexes the archive first and then reads the file's contents
+// using random access, following any symlinks along the way.
+func runNARCat(ctx context.Context, dst io.Writer, archivePath string, file string) error {
 	f, err := os.Open(archivePath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	nr := nar.NewReader(f)
-	for {
-		hdr, err := nr.Next()
-		if err != nil {
-			// io.EOF means we didn't find the requested path
-			if err == io.EOF {
-				return fmt.Errorf("requested path not found")
-			}
-			// relay other errors
-			return err
+	// Passing the file directly lets List seek past file contents.
+	ls, err := nar.List(f)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(file, "/")
+	if !ls.Root.Mode.IsDir() {
+		if name != "" {
+			return fmt.Errorf("requested path not found")
 		}
-
-		if "/"+hdr.Path == file {
-			if !hdr.Mode.IsRegular() {
-				return fmt.Errorf("unable to cat non-regular file")
-			}
-			break
+		if !ls.Root.Mode.IsRegular() {
+			return fmt.Errorf("unable to cat non-regular file")
 		}
+		_, err = io.Copy(dst, io.NewSectionReader(f, ls.Root.ContentOffset, ls.Root.Size))
+		return err
 	}
 
-	_, err = io.Copy(os.Stdout, nr)
+	fsys, err := nar.NewFS(f, ls)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = "."
+	}
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("unable to cat non-regular file")
+	}
+	content, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	_, err = io.Copy(dst, content)
 	return err
 }
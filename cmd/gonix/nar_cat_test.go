@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNARCat(t *testing.T) {
+	tests := []struct {
+		archive string
+		file    string
+		want    string
+	}{
+		{
+			archive: "mini-drv.nar",
+			file:    "/hello.txt",
+			want:    "Hello, World!\n",
+		},
+		{
+			archive: "mini-drv.nar",
+			file:    "/bin/hello.sh",
+			want:    "#!/bin/sh\n" + `cat "$(dirname "$0")/../hello.txt"` + "\n",
+		},
+		{
+			archive: "hello-world.nar",
+			file:    "/",
+			want:    "Hello, World!\n",
+		},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		archivePath := filepath.Join("..", "..", "nar", "testdata", test.archive)
+		got := new(bytes.Buffer)
+		if err := runNARCat(ctx, got, archivePath, test.file); err != nil {
+			t.Errorf("runNARCat(ctx, w, %q, %q): %v", test.archive, test.file, err)
+			continue
+		}
+		if got.String() != test.want {
+			t.Errorf("runNARCat(ctx, w, %q, %q) wrote %q; want %q", test.archive, test.file, got, test.want)
+		}
+	}
+
+	t.Run("SmokeTest", func(t *testing.T) {
+		const archive = "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"
+		archivePath := filepath.Join("..", "..", "nar", "testdata", archive)
+		data, err := os.ReadFile(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Offsets from the archive's listing.
+		const (
+			hostnameOffset = 56304
+			hostnameSize   = 17704
+		)
+		want := data[hostnameOffset : hostnameOffset+hostnameSize]
+		// bin/dnsdomainname is a symlink to hostname.
+		for _, file := range []string{"/bin/hostname", "/bin/dnsdomainname"} {
+			got := new(bytes.Buffer)
+			if err := runNARCat(ctx, got, archivePath, file); err != nil {
+				t.Errorf("runNARCat(ctx, w, %q, %q): %v", archive, file, err)
+				continue
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("runNARCat(ctx, w, %q, %q) wrote %d bytes; want the %d bytes at offset %d",
+					archive, file, got.Len(), len(want), hostnameOffset)
+			}
+		}
+	})
+
+	for _, file := range []string{"/bin", "/missing"} {
+		archivePath := filepath.Join("..", "..", "nar", "testdata", "mini-drv.nar")
+		if err := runNARCat(ctx, new(bytes.Buffer), archivePath, file); err == nil {
+			t.Errorf("runNARCat(ctx, w, %q, %q) = <nil>; want error", "mini-drv.nar", file)
+		}
+	}
+}
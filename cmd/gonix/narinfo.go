@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/nix"
+)
+
+func newNARInfoCommand() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "narinfo",
+		Short: "Convert .narinfo files",
+	}
+	c.AddCommand(
+		newNARInfoToJSONCommand(),
+		newNARInfoFromJSONCommand(),
+	)
+	return c
+}
+
+func newNARInfoToJSONCommand() *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "to-json FILE",
+		DisableFlagsInUseLine: true,
+		Short:                 "Convert a .narinfo file to JSON (use - for stdin)",
+		Args:                  cobra.ExactArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runNARInfoToJSON(cmd.Context(), os.Stdout, os.Stdin, args[0])
+	}
+	return c
+}
+
+func runNARInfoToJSON(ctx context.Context, dst io.Writer, stdin io.Reader, file string) error {
+	input, err := readFileOrStdin(stdin, file)
+	if err != nil {
+		return err
+	}
+	info := new(nix.NARInfo)
+	if err := info.UnmarshalText(input); err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	output = append(output, '\n')
+	_, err = dst.Write(output)
+	return err
+}
+
+func newNARInfoFromJSONCommand() *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "from-json FILE",
+		DisableFlagsInUseLine: true,
+		Short:                 "Convert JSON to a .narinfo file (use - for stdin)",
+		Args:                  cobra.ExactArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runNARInfoFromJSON(cmd.Context(), os.Stdout, os.Stdin, args[0])
+	}
+	return c
+}
+
+func runNARInfoFromJSON(ctx context.Context, dst io.Writer, stdin io.Reader, file string) error {
+	input, err := readFileOrStdin(stdin, file)
+	if err != nil {
+		return err
+	}
+	info := new(nix.NARInfo)
+	if err := json.Unmarshal(input, info); err != nil {
+		return err
+	}
+	output, err := info.MarshalText()
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(output)
+	return err
+}
+
+// readFileOrStdin reads the named file,
+// or stdin if the name is "-".
+func readFileOrStdin(stdin io.Reader, name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(name)
+}
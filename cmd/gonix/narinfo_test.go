@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNARInfoJSONRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	narinfoPath := filepath.Join("testdata", "hello.narinfo")
+	want, err := os.ReadFile(narinfoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("File", func(t *testing.T) {
+		jsonData := new(bytes.Buffer)
+		if err := runNARInfoToJSON(ctx, jsonData, strings.NewReader(""), narinfoPath); err != nil {
+			t.Fatal("to-json:", err)
+		}
+		jsonPath := filepath.Join(t.TempDir(), "hello.json")
+		if err := os.WriteFile(jsonPath, jsonData.Bytes(), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		got := new(bytes.Buffer)
+		if err := runNARInfoFromJSON(ctx, got, strings.NewReader(""), jsonPath); err != nil {
+			t.Fatal("from-json:", err)
+		}
+		if diff := cmp.Diff(string(want), got.String()); diff != "" {
+			t.Errorf("narinfo (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Stdin", func(t *testing.T) {
+		jsonData := new(bytes.Buffer)
+		if err := runNARInfoToJSON(ctx, jsonData, bytes.NewReader(want), "-"); err != nil {
+			t.Fatal("to-json:", err)
+		}
+		got := new(bytes.Buffer)
+		if err := runNARInfoFromJSON(ctx, got, jsonData, "-"); err != nil {
+			t.Fatal("from-json:", err)
+		}
+		if diff := cmp.Diff(string(want), got.String()); diff != "" {
+			t.Errorf("narinfo (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "missing.narinfo")
+		if err := runNARInfoToJSON(ctx, new(bytes.Buffer), strings.NewReader(""), missing); err == nil {
+			t.Error("to-json of missing file did not return an error")
+		}
+		if err := runNARInfoFromJSON(ctx, new(bytes.Buffer), strings.NewReader(""), missing); err == nil {
+			t.Error("from-json of missing file did not return an error")
+		}
+	})
+}
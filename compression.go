@@ -0,0 +1,131 @@
+package nix
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Decompressor returns a new decompressing reader, reading from r.
+// The [io.ReadCloser]'s Close method must not close r.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// A Compressor returns a new compressing writer, writing to w.
+// The [io.WriteCloser]'s Close method must be used to flush pending data to w,
+// and must not close w.
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+var (
+	compressionMu sync.RWMutex
+	decompressors = map[CompressionType]Decompressor{
+		NoCompression: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		},
+		Gzip: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		Bzip2: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	}
+	compressors = map[CompressionType]Compressor{
+		NoCompression: func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		Gzip: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	}
+)
+
+// RegisterDecompressor registers a custom decompressor for a compression type.
+// [NoCompression], [Gzip], and [Bzip2] are built in.
+// RegisterDecompressor panics if a decompressor is already registered for ct.
+// Registering a decompressor does not change the result of [CompressionType.IsKnown].
+func RegisterDecompressor(ct CompressionType, f Decompressor) {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	if _, dup := decompressors[ct]; dup {
+		panic(fmt.Sprintf("nix: decompressor for %q already registered", ct))
+	}
+	decompressors[ct] = f
+}
+
+// RegisterCompressor registers a custom compressor for a compression type.
+// [NoCompression] and [Gzip] are built in.
+// RegisterCompressor panics if a compressor is already registered for ct.
+// Registering a compressor does not change the result of [CompressionType.IsKnown].
+func RegisterCompressor(ct CompressionType, f Compressor) {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	if _, dup := compressors[ct]; dup {
+		panic(fmt.Sprintf("nix: compressor for %q already registered", ct))
+	}
+	compressors[ct] = f
+}
+
+func decompressor(ct CompressionType) Decompressor {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	return decompressors[ct]
+}
+
+func compressor(ct CompressionType) Compressor {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	return compressors[ct]
+}
+
+// DecompressReader returns a reader that decompresses the file referenced by URL,
+// whose (possibly compressed) contents are read from r,
+// according to info.Compression.
+// The returned reader yields the uncompressed .nar file.
+// [NoCompression], [Gzip], and [Bzip2] are supported by default;
+// other compression types must be registered with [RegisterDecompressor].
+// Closing the returned reader does not close r.
+func (info *NARInfo) DecompressReader(r io.Reader) (io.ReadCloser, error) {
+	ct := info.Compression
+	if ct == "" {
+		ct = Bzip2
+	}
+	f := decompressor(ct)
+	if f == nil {
+		return nil, fmt.Errorf("decompress %s: no decompressor for %q", info.StorePath, ct)
+	}
+	rc, err := f(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompress %s: %w", info.StorePath, err)
+	}
+	return rc, nil
+}
+
+// CompressWriter returns a writer that compresses an uncompressed .nar file
+// according to info.Compression,
+// writing the compressed data (i.e. the file referenced by URL) to w.
+// [NoCompression] and [Gzip] are supported by default;
+// other compression types must be registered with [RegisterCompressor].
+// The returned writer must be closed to flush any pending data to w.
+// Closing the returned writer does not close w.
+func (info *NARInfo) CompressWriter(w io.Writer) (io.WriteCloser, error) {
+	ct := info.Compression
+	if ct == "" {
+		ct = Bzip2
+	}
+	f := compressor(ct)
+	if f == nil {
+		return nil, fmt.Errorf("compress %s: no compressor for %q", info.StorePath, ct)
+	}
+	wc, err := f(w)
+	if err != nil {
+		return nil, fmt.Errorf("compress %s: %w", info.StorePath, err)
+	}
+	return wc, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
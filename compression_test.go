@@ -0,0 +1,146 @@
+package nix
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestNARInfoDecompressReader(t *testing.T) {
+	const want = "Hello, World!\n"
+	gzipData := new(bytes.Buffer)
+	zw := gzip.NewWriter(gzipData)
+	if _, err := io.WriteString(zw, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		compression CompressionType
+		data        []byte
+		err         bool
+	}{
+		{compression: NoCompression, data: []byte(want)},
+		{compression: Gzip, data: gzipData.Bytes()},
+		{compression: XZ, data: []byte(want), err: true},
+		{compression: "foo", data: []byte(want), err: true},
+	}
+	for _, test := range tests {
+		info := &NARInfo{Compression: test.compression}
+		rc, err := info.DecompressReader(bytes.NewReader(test.data))
+		if test.err {
+			if err == nil {
+				rc.Close()
+				t.Errorf("(&NARInfo{Compression: %q}).DecompressReader(...) = _, <nil>; want _, <error>", test.compression)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("(&NARInfo{Compression: %q}).DecompressReader(...): %v", test.compression, err)
+			continue
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if string(got) != want || err != nil {
+			t.Errorf("(&NARInfo{Compression: %q}).DecompressReader(...) content = %q, %v; want %q, <nil>", test.compression, got, err, want)
+		}
+	}
+}
+
+// xorCompression is a compression type registered by tests.
+// Its "compressed" form is the original data with every bit inverted.
+const xorCompression CompressionType = "test-xor"
+
+var registerXOROnce sync.Once
+
+func registerXOR() {
+	registerXOROnce.Do(func() {
+		RegisterDecompressor(xorCompression, func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(xorReader{r}), nil
+		})
+		RegisterCompressor(xorCompression, func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{xorWriter{w}}, nil
+		})
+	})
+}
+
+type xorReader struct {
+	r io.Reader
+}
+
+func (xr xorReader) Read(p []byte) (int, error) {
+	n, err := xr.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0xff
+	}
+	return n, err
+}
+
+type xorWriter struct {
+	w io.Writer
+}
+
+func (xw xorWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for i, b := range p {
+		buf[i] = b ^ 0xff
+	}
+	return xw.w.Write(buf)
+}
+
+func TestCompressionRegistry(t *testing.T) {
+	registerXOR()
+	const want = "Hello, World!\n"
+	for _, ct := range []CompressionType{NoCompression, Gzip, xorCompression} {
+		info := &NARInfo{Compression: ct}
+		buf := new(bytes.Buffer)
+		wc, err := info.CompressWriter(buf)
+		if err != nil {
+			t.Errorf("(&NARInfo{Compression: %q}).CompressWriter(...): %v", ct, err)
+			continue
+		}
+		if _, err := io.WriteString(wc, want); err != nil {
+			t.Errorf("write %q: %v", ct, err)
+		}
+		if err := wc.Close(); err != nil {
+			t.Errorf("close %q writer: %v", ct, err)
+		}
+		if ct != NoCompression && buf.String() == want {
+			t.Errorf("%q did not transform data", ct)
+		}
+
+		rc, err := info.DecompressReader(buf)
+		if err != nil {
+			t.Errorf("(&NARInfo{Compression: %q}).DecompressReader(...): %v", ct, err)
+			continue
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if string(got) != want || err != nil {
+			t.Errorf("%q round trip = %q, %v; want %q, <nil>", ct, got, err, want)
+		}
+	}
+
+	if xorCompression.IsKnown() {
+		t.Errorf("%q.IsKnown() = true after registering; want false", xorCompression)
+	}
+	if wc, err := (&NARInfo{Compression: XZ}).CompressWriter(io.Discard); err == nil {
+		wc.Close()
+		t.Errorf("(&NARInfo{Compression: %q}).CompressWriter(...) = _, <nil>; want _, <error>", XZ)
+	}
+}
+
+func TestRegisterDecompressorDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterDecompressor did not panic")
+		}
+	}()
+	RegisterDecompressor(Gzip, func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"strings"
 
 	"zombiezen.com/go/nix/nixbase32"
 )
@@ -32,6 +33,9 @@ const (
 
 // ParseHashType matches a string to its hash type,
 // returning an error if the string does not name a hash type.
+// Only the canonical lowercase names (e.g. "sha256") are accepted,
+// as in Nix's own hash parsing.
+// See [ParseHashTypeLenient] for parsing names from users.
 func ParseHashType(s string) (HashType, error) {
 	allTypes := [...]HashType{MD5, SHA1, SHA256, SHA512}
 	for _, typ := range allTypes {
@@ -42,6 +46,42 @@ func ParseHashType(s string) (HashType, error) {
 	return 0, fmt.Errorf("%q is not a hash type", s)
 }
 
+// ParseHashTypeLenient is like [ParseHashType],
+// but matching is case-insensitive,
+// and the SHA algorithms may be written with a dash (e.g. "sha-256" or "SHA-256").
+// It is intended for parsing names given by users (e.g. on the command line)
+// and should not be used for data that Nix would read.
+func ParseHashTypeLenient(s string) (HashType, error) {
+	name := strings.ToLower(s)
+	if rest, ok := cutPrefix(name, "sha-"); ok {
+		name = "sha" + rest
+	}
+	typ, err := ParseHashType(name)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a hash type", s)
+	}
+	return typ, nil
+}
+
+// HashTypeForSize returns the hash type whose digests are n bytes long.
+// ok is false if no known hash type produces n-byte digests.
+// Each known hash type has a distinct size,
+// so the result is unambiguous.
+func HashTypeForSize(n int) (_ HashType, ok bool) {
+	switch n {
+	case md5.Size:
+		return MD5, true
+	case sha1.Size:
+		return SHA1, true
+	case sha256.Size:
+		return SHA256, true
+	case sha512.Size:
+		return SHA512, true
+	default:
+		return 0, false
+	}
+}
+
 // IsValid reports whether typ is one of the known hash algorithms.
 func (typ HashType) IsValid() bool {
 	return typ == MD5 || typ == SHA1 || typ == SHA256 || typ == SHA512
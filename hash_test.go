@@ -46,6 +46,94 @@ func (test hashTest) sri(tb testing.TB) string {
 	return test.typ.String() + "-" + test.base64(tb)
 }
 
+func TestParseHashType(t *testing.T) {
+	tests := []struct {
+		s    string
+		want HashType
+		err  bool
+	}{
+		{s: "md5", want: MD5},
+		{s: "sha1", want: SHA1},
+		{s: "sha256", want: SHA256},
+		{s: "sha512", want: SHA512},
+		{s: "", err: true},
+		{s: "MD5", err: true},
+		{s: "SHA256", err: true},
+		{s: "sha-256", err: true},
+		{s: "sha3", err: true},
+	}
+	for _, test := range tests {
+		got, err := ParseHashType(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseHashType(%q) = %v, <nil>; want _, <error>", test.s, got)
+			}
+			continue
+		}
+		if got != test.want || err != nil {
+			t.Errorf("ParseHashType(%q) = %v, %v; want %v, <nil>", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestParseHashTypeLenient(t *testing.T) {
+	tests := []struct {
+		s    string
+		want HashType
+		err  bool
+	}{
+		{s: "md5", want: MD5},
+		{s: "MD5", want: MD5},
+		{s: "sha1", want: SHA1},
+		{s: "SHA-1", want: SHA1},
+		{s: "sha256", want: SHA256},
+		{s: "SHA256", want: SHA256},
+		{s: "sha-256", want: SHA256},
+		{s: "sha512", want: SHA512},
+		{s: "sha-512", want: SHA512},
+		{s: "Sha-512", want: SHA512},
+		{s: "", err: true},
+		{s: "sha3", err: true},
+		{s: "sha--256", err: true},
+		{s: "sha256-", err: true},
+		{s: "md-5", err: true},
+	}
+	for _, test := range tests {
+		got, err := ParseHashTypeLenient(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseHashTypeLenient(%q) = %v, <nil>; want _, <error>", test.s, got)
+			}
+			continue
+		}
+		if got != test.want || err != nil {
+			t.Errorf("ParseHashTypeLenient(%q) = %v, %v; want %v, <nil>", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestHashTypeForSize(t *testing.T) {
+	tests := []struct {
+		n    int
+		want HashType
+		ok   bool
+	}{
+		{n: 0},
+		{n: 16, want: MD5, ok: true},
+		{n: 20, want: SHA1, ok: true},
+		{n: 28},
+		{n: 32, want: SHA256, ok: true},
+		{n: 48},
+		{n: 64, want: SHA512, ok: true},
+		{n: -1},
+	}
+	for _, test := range tests {
+		if got, ok := HashTypeForSize(test.n); got != test.want || ok != test.ok {
+			t.Errorf("HashTypeForSize(%d) = %v, %t; want %v, %t", test.n, got, ok, test.want, test.ok)
+		}
+	}
+}
+
 func TestParseHash(t *testing.T) {
 	t.Run("Base16", func(t *testing.T) {
 		for _, test := range hashTests {
@@ -127,6 +215,22 @@ func TestParseHash(t *testing.T) {
 		}
 	})
 
+	t.Run("NonCanonicalType", func(t *testing.T) {
+		// Nix only accepts lowercase hash type names without dashes.
+		for _, test := range hashTests {
+			if test.typ != SHA256 {
+				continue
+			}
+			for _, prefix := range []string{"SHA256", "Sha256", "sha-256", "SHA-256"} {
+				s := prefix + ":" + test.base16
+				h := new(Hash)
+				if err := h.UnmarshalText([]byte(s)); err == nil {
+					t.Errorf("new(Hash).UnmarshalText(%q) = <nil>; want error", s)
+				}
+			}
+		}
+	})
+
 	t.Run("Bad", func(t *testing.T) {
 		for _, test := range badHashTests {
 			got, err := ParseHash(test)
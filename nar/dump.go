@@ -1,6 +1,7 @@
 package nar
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/fs"
@@ -8,6 +9,8 @@ import (
 	slashpath "path"
 	"path/filepath"
 	"sort"
+
+	"zombiezen.com/go/nix"
 )
 
 // SourceFilterFunc is the interface for creating source filters.
@@ -17,6 +20,17 @@ import (
 // [builtins.filterSource]: https://nixos.org/manual/nix/stable/language/builtins.html#builtins-filterSource
 type SourceFilterFunc func(path string, mode fs.FileMode) bool
 
+// SourceFilterFunc2 is like [SourceFilterFunc],
+// but it also receives the path of the file relative to the dumped root.
+// osPath is the path on the local file system,
+// as passed to a [SourceFilterFunc].
+// narPath is the slash-separated path of the file in the archive
+// (e.g. "foo/bar" for a file bar in a directory foo inside the dumped directory),
+// or the empty string for the dumped root itself.
+// If the function returns true, the file is included in the archive,
+// otherwise it is omitted.
+type SourceFilterFunc2 func(osPath, narPath string, mode fs.FileMode) bool
+
 // DumpPath will serialize a path on the local file system to NAR format,
 // and write it to the passed writer.
 func DumpPath(w io.Writer, path string) error {
@@ -27,15 +41,86 @@ func DumpPath(w io.Writer, path string) error {
 // and write it to the passed writer, filtering out any files where the filter
 // function returns false.
 func DumpPathFilter(w io.Writer, path string, filter SourceFilterFunc) error {
+	return dumpLocalPath(NewWriter(w), path, filter.toFunc2())
+}
+
+// DumpPathFilter2 is like [DumpPathFilter],
+// but the filter function also receives each file's path in the archive.
+func DumpPathFilter2(w io.Writer, path string, filter SourceFilterFunc2) error {
+	return dumpLocalPath(NewWriter(w), path, filter)
+}
+
+// toFunc2 adapts filter to a [SourceFilterFunc2] that ignores the archive path.
+// It returns nil if filter is nil.
+func (filter SourceFilterFunc) toFunc2() SourceFilterFunc2 {
+	if filter == nil {
+		return nil
+	}
+	return func(osPath, narPath string, mode fs.FileMode) bool {
+		return filter(osPath, mode)
+	}
+}
+
+// DumpPathHash serializes a path on the local file system to NAR format
+// and returns the hash of the archive using the given algorithm
+// along with the archive's size.
+// With [nix.SHA256], these are suitable for the NARHash and NARSize fields
+// of a [nix.NARInfo].
+func DumpPathHash(typ nix.HashType, path string) (nix.Hash, int64, error) {
+	return DumpPathFilterHash(typ, path, nil)
+}
+
+// DumpPathFilterHash is like [DumpPathHash],
+// but filters out any files where the filter function returns false,
+// as in [DumpPathFilter].
+func DumpPathFilterHash(typ nix.HashType, path string, filter SourceFilterFunc) (nix.Hash, int64, error) {
+	h := nix.NewHasher(typ)
+	nw := NewWriter(h)
+	if err := dumpLocalPath(nw, path, filter.toFunc2()); err != nil {
+		return nix.Hash{}, 0, err
+	}
+	return h.SumHash(), nw.Offset(), nil
+}
+
+// DumpPathToStore serializes a path on the local file system to NAR format
+// and computes the store path that the object would have
+// if it were added to the store in dir
+// with the given name using recursive SHA-256 hashing
+// (e.g. with "nix-store --add").
+// It returns the store path along with a partially populated [nix.NARInfo]
+// with the StorePath, NARHash, NARSize, and CA fields set.
+// The archive itself is discarded;
+// use [Dumper.DumpToStorePath] to also write it somewhere.
+func DumpPathToStore(dir nix.StoreDirectory, name string, path string) (nix.StorePath, *nix.NARInfo, error) {
+	narHash, narSize, err := DumpPathHash(nix.SHA256, path)
+	if err != nil {
+		return "", nil, err
+	}
+	ca := nix.RecursiveFileContentAddress(narHash)
+	storePath, err := dir.FixedOutputPath(name, ca, nix.References{})
+	if err != nil {
+		return "", nil, fmt.Errorf("dump nar: %v", err)
+	}
+	info := &nix.NARInfo{
+		StorePath: storePath,
+		NARHash:   ca.Hash(),
+		NARSize:   narSize,
+		CA:        ca,
+	}
+	return storePath, info, nil
+}
+
+// dumpLocalPath serializes a path on the local file system to nw.
+func dumpLocalPath(nw *Writer, path string, filter SourceFilterFunc2) error {
 	info, err := os.Lstat(path)
 	if err != nil {
 		return fmt.Errorf("dump nar: %w", err)
 	}
 	parent := filepath.Dir(path)
 	return dump(filepath.Base(path), fs.FileInfoToDirEntry(info), &dumpOptions{
-		nw:         NewWriter(w),
-		filterFunc: filter,
-		fsys:       os.DirFS(parent),
+		nw:          nw,
+		filterFunc2: filter,
+		fsys:        os.DirFS(parent),
 		fsPathToFilterPath: func(p string) string {
 			return filepath.Join(parent, filepath.FromSlash(p))
 		},
@@ -51,6 +136,54 @@ type Dumper struct {
 	FilterFunc SourceFilterFunc
 	// ReadLink returns the link target of the given path of the filesystem.
 	ReadLink func(string) (string, error)
+	// BeforeWrite is called (if not nil) for every file system object
+	// before its header is written to the archive,
+	// including directories and symlinks.
+	// The header's Mode is the mode reported by the filesystem,
+	// before any normalization to the NAR format.
+	// BeforeWrite may modify the permission bits of the header's Mode
+	// or its LinkTarget field to change what is written.
+	// The file's contents are always copied from the filesystem,
+	// so the dump fails if BeforeWrite changes the header's Size
+	// or the type bits of its Mode.
+	// If BeforeWrite returns an error, the dump is aborted with that error.
+	BeforeWrite func(hdr *Header) error
+	// OnFile is called (if not nil) after each regular file's header
+	// is written to the archive, with the file's path in the archive and its size.
+	// It is intended for reporting progress and does not affect the output.
+	OnFile func(path string, size int64)
+	// Executable reports whether the regular file at the given path
+	// should be marked executable in the archive.
+	// If Executable is not nil, it is consulted for every regular file
+	// instead of the file's executable permission bits.
+	// It receives the path in the same form as FilterFunc
+	// and the file's mode as reported by the filesystem.
+	// This is useful for filesystems that do not record Unix permissions
+	// or record them inconsistently.
+	// If Executable is nil, a file is executable
+	// if any of its executable permission bits are set.
+	Executable func(path string, mode fs.FileMode) bool
+	// CaseHackSuffix is the separator that Nix inserts into file names
+	// on case-insensitive filesystems
+	// to distinguish names that differ only by case
+	// (normally "~nix~case~hack~", followed by a number).
+	// If CaseHackSuffix is not empty,
+	// it and anything after it are removed from directory entry names
+	// before they are written to the archive,
+	// as Nix does when its use-case-hack setting is enabled.
+	// Directory entries are then written in the order of their stripped names,
+	// so each directory's entries are read fully before any are written.
+	// If two entries in the same directory have the same stripped name,
+	// the dump fails with an error.
+	CaseHackSuffix string
+	// Sort indicates whether each directory's entries should be read fully
+	// and sorted by name before any of them are written.
+	// By default, Dump writes entries in the order the filesystem returns them
+	// (via [fs.ReadDir]), which is only valid if they are already sorted,
+	// as they are for [os.DirFS].
+	// Sort is needed for [fs.FS] implementations
+	// that return directory entries in arbitrary order.
+	Sort bool
 }
 
 // Dump serializes an object in the given filesystem to NAR format,
@@ -60,31 +193,244 @@ func (d *Dumper) Dump(w io.Writer, fsys fs.FS, path string) error {
 	if err != nil {
 		return fmt.Errorf("dump nar: %w", err)
 	}
-	return dump(path, rootEntry, &dumpOptions{
-		nw:         NewWriter(w),
-		filterFunc: d.FilterFunc,
-		fsys:       fsys,
-		readlink:   d.ReadLink,
+	return dump(path, rootEntry, d.options(w, fsys))
+}
+
+// options returns the dumpOptions for writing the archive of an object in fsys to w
+// using the Dumper's fields.
+func (d *Dumper) options(w io.Writer, fsys fs.FS) *dumpOptions {
+	return &dumpOptions{
+		nw:          NewWriter(w),
+		filterFunc:  d.FilterFunc,
+		fsys:        fsys,
+		readlink:    d.ReadLink,
+		beforeWrite: d.BeforeWrite,
+		onFile:      d.OnFile,
+		executable:  d.Executable,
+		caseHack:    d.CaseHackSuffix,
+		sort:        d.Sort,
+	}
+}
+
+// Index builds a [Listing] for an object in the given filesystem
+// as if by calling [List] on the output of [Dumper.Dump],
+// but without reading any regular files' contents.
+// ContentOffset fields are computed as they would be in the dumped archive,
+// but HeaderOffset fields are left zero.
+func (d *Dumper) Index(fsys fs.FS, path string) (*Listing, error) {
+	rootEntry, err := lstatFS(fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("dump nar: %w", err)
+	}
+	opts := d.options(io.Discard, fsys)
+	opts.listing = new(Listing)
+	err = dump(path, rootEntry, opts)
+	if err != nil {
+		return nil, err
+	}
+	return opts.listing, nil
+}
+
+// CanonicalNAR serializes an object in the given filesystem to NAR format
+// and returns the resulting bytes,
+// which are identical to the output of "nix-store --dump" for the same object.
+// readlink is used to read symlink targets and may be nil
+// if the object does not contain any symlinks.
+// CanonicalNAR buffers the entire archive in memory,
+// so it is intended for tests and small objects.
+func CanonicalNAR(fsys fs.FS, path string, readlink func(string) (string, error)) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	d := &Dumper{ReadLink: readlink}
+	if err := d.Dump(buf, fsys, path); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DumpToStorePath serializes an object in the given filesystem to NAR format,
+// writing it to w,
+// and returns the store path that the object would have
+// if it were added to the store in dir
+// with the given name using recursive SHA-256 hashing
+// (e.g. with "nix-store --add").
+// It is equivalent to calling [Dumper.DumpToStorePath] on a zero Dumper,
+// so the object must not contain any symlinks.
+func DumpToStorePath(w io.Writer, dir nix.StoreDirectory, name string, fsys fs.FS, path string) (nix.StorePath, error) {
+	return new(Dumper).DumpToStorePath(w, dir, name, fsys, path)
+}
+
+// DumpToStorePath serializes an object in the given filesystem to NAR format
+// like [Dumper.Dump],
+// and returns the store path that the object would have
+// if it were added to the store in dir
+// with the given name using recursive SHA-256 hashing.
+// The archive is hashed as it is written, so the object is only read once.
+func (d *Dumper) DumpToStorePath(w io.Writer, dir nix.StoreDirectory, name string, fsys fs.FS, path string) (nix.StorePath, error) {
+	h := nix.NewHasher(nix.SHA256)
+	if err := d.Dump(io.MultiWriter(w, h), fsys, path); err != nil {
+		return "", err
+	}
+	storePath, err := dir.FixedOutputPath(name, nix.RecursiveFileContentAddress(h.SumHash()), nix.References{})
+	if err != nil {
+		return "", fmt.Errorf("dump nar: %v", err)
+	}
+	return storePath, nil
+}
+
+// TeeDump serializes an object in the given filesystem to NAR format once,
+// writing the archive to every one of dests
+// (for example, to restore it locally and upload it to a binary cache at the same time).
+// It returns the SHA-256 hash and size of the archive,
+// suitable for the NARHash and NARSize fields of a [nix.NARInfo].
+// readlink is used to read symlink targets and may be nil
+// if the object does not contain any symlinks.
+// If any destination returns an error, TeeDump stops and returns that error.
+func TeeDump(fsys fs.FS, path string, readlink func(string) (string, error), dests ...io.Writer) (nix.Hash, int64, error) {
+	rootEntry, err := lstatFS(fsys, path)
+	if err != nil {
+		return nix.Hash{}, 0, fmt.Errorf("dump nar: %w", err)
+	}
+	h := nix.NewHasher(nix.SHA256)
+	nw := NewWriter(io.MultiWriter(append(dests[:len(dests):len(dests)], h)...))
+	err = dump(path, rootEntry, &dumpOptions{
+		nw:       nw,
+		fsys:     fsys,
+		readlink: readlink,
 	})
+	if err != nil {
+		return nix.Hash{}, 0, err
+	}
+	return h.SumHash(), nw.Offset(), nil
+}
+
+// DumpSub serializes an object in the given filesystem to NAR format
+// like [Dumper.Dump], but places the object at the slash-separated path emitAs
+// inside the archive instead of at the archive's root.
+// The archive's root and any intermediate directories in emitAs
+// are written as empty directories.
+// If emitAs is empty, DumpSub is equivalent to Dump.
+func (d *Dumper) DumpSub(w io.Writer, fsys fs.FS, root string, emitAs string) error {
+	if err := validatePath(emitAs); err != nil {
+		return fmt.Errorf("dump nar: %v", err)
+	}
+	rootEntry, err := lstatFS(fsys, root)
+	if err != nil {
+		return fmt.Errorf("dump nar: %w", err)
+	}
+	opts := d.options(w, fsys)
+	opts.prefix = emitAs
+	return dump(root, rootEntry, opts)
 }
 
 type dumpOptions struct {
 	nw                 *Writer
 	fsys               fs.FS
 	filterFunc         SourceFilterFunc
+	filterFunc2        SourceFilterFunc2
 	readlink           func(string) (string, error)
 	fsPathToFilterPath func(string) string
+	beforeWrite        func(hdr *Header) error
+	onFile             func(path string, size int64)
+	executable         func(path string, mode fs.FileMode) bool
+	// caseHack is the case-hack suffix to remove from names (if not empty).
+	caseHack string
+	// sort is true if directory entries should be sorted before writing.
+	sort bool
+	// prefix is the archive path that the dumped object is placed at.
+	prefix string
+	// listing is the listing to add headers to (if not nil).
+	// If listing is not nil, regular files' contents are not read
+	// and nw must discard its output.
+	listing *Listing
 }
 
-func (d *dumpOptions) filter(fsPath string, mode fs.FileMode) bool {
-	if d.filterFunc == nil {
+// archivePath returns the path in the archive
+// for the given path relative to the dumped object.
+func (d *dumpOptions) archivePath(outPath string) string {
+	switch {
+	case d.prefix == "":
+		return outPath
+	case outPath == "":
+		return d.prefix
+	default:
+		return d.prefix + "/" + outPath
+	}
+}
+
+// writeHeader calls the beforeWrite hook (if present)
+// and then writes the header to the archive.
+func (d *dumpOptions) writeHeader(hdr *Header) error {
+	if d.beforeWrite != nil {
+		origType, origSize := hdr.Mode.Type(), hdr.Size
+		if err := d.beforeWrite(hdr); err != nil {
+			return err
+		}
+		if hdr.Size != origSize {
+			return fmt.Errorf("%s: BeforeWrite changed size from %d to %d", formatLastPath(hdr.Path), origSize, hdr.Size)
+		}
+		if hdr.Mode.Type() != origType {
+			return fmt.Errorf("%s: BeforeWrite changed type from %v to %v", formatLastPath(hdr.Path), origType, hdr.Mode.Type())
+		}
+	}
+	if err := d.nw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if d.listing != nil {
+		node := *hdr
+		switch {
+		case hdr.Mode.IsRegular():
+			node.ContentOffset = d.nw.Offset()
+			if hdr.Mode&0o111 != 0 {
+				node.Mode = modeExecutable
+			} else {
+				node.Mode = modeRegular
+			}
+		case hdr.Mode.IsDir():
+			node.Mode = modeDirectory
+			node.Size = 0
+		case hdr.Mode.Type() == fs.ModeSymlink:
+			node.Mode = modeSymlink
+			node.Size = 0
+		}
+		d.listing.add(&node)
+	}
+	return nil
+}
+
+// rawMode returns the mode to pass to the beforeWrite hook
+// for a non-regular file.
+// To avoid an extra stat, it only consults the filesystem
+// if there is a beforeWrite hook.
+func (d *dumpOptions) rawMode(ent fs.DirEntry, normalized fs.FileMode) (fs.FileMode, error) {
+	if d.beforeWrite == nil {
+		return normalized, nil
+	}
+	info, err := ent.Info()
+	if err != nil {
+		return 0, err
+	}
+	return info.Mode(), nil
+}
+
+// filter reports whether the file at fsPath should be included in the archive.
+// outPath is the file's path relative to the dumped object.
+func (d *dumpOptions) filter(fsPath string, outPath string, mode fs.FileMode) bool {
+	switch {
+	case d.filterFunc2 != nil:
+		return d.filterFunc2(d.filterPath(fsPath), outPath, mode)
+	case d.filterFunc != nil:
+		return d.filterFunc(d.filterPath(fsPath), mode)
+	default:
 		return true
 	}
-	filterPath := fsPath
-	if d.fsPathToFilterPath != nil {
-		filterPath = d.fsPathToFilterPath(fsPath)
+}
+
+// filterPath returns the form of fsPath passed to user-provided hooks.
+func (d *dumpOptions) filterPath(fsPath string) string {
+	if d.fsPathToFilterPath == nil {
+		return fsPath
 	}
-	return d.filterFunc(filterPath, mode)
+	return d.fsPathToFilterPath(fsPath)
 }
 
 func dump(path string, lstatEntry fs.DirEntry, opts *dumpOptions) error {
@@ -96,6 +442,10 @@ func dump(path string, lstatEntry fs.DirEntry, opts *dumpOptions) error {
 		if err != nil {
 			return fmt.Errorf("dump nar: %w", err)
 		}
+	} else if opts.sort || opts.caseHack != "" {
+		if err := dumpSorted("", path, lstatEntry, opts); err != nil {
+			return fmt.Errorf("dump nar: %w", err)
+		}
 	} else {
 		if err := dumpRecursive(path, opts); err != nil {
 			return fmt.Errorf("dump nar: %w", err)
@@ -122,7 +472,59 @@ func dumpRecursive(rootPath string, opts *dumpOptions) error {
 	})
 }
 
+// dumpSorted dumps the file system object at fsPath and its descendents
+// to outPath in the archive.
+// Unlike [dumpRecursive], it reads each directory fully
+// and writes its entries in the order of their names in the archive.
+func dumpSorted(outPath string, fsPath string, ent fs.DirEntry, opts *dumpOptions) error {
+	if err := dumpSingle(outPath, fsPath, ent, opts); err == fs.SkipDir {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !ent.IsDir() {
+		return nil
+	}
+	dirEntries, err := fs.ReadDir(opts.fsys, fsPath)
+	if err != nil {
+		return err
+	}
+	type namedEntry struct {
+		name string
+		ent  fs.DirEntry
+	}
+	entries := make([]namedEntry, 0, len(dirEntries))
+	seen := make(map[string]string, len(dirEntries))
+	for _, ent := range dirEntries {
+		name := ent.Name()
+		if opts.caseHack != "" {
+			name = stripCaseHack(name, opts.caseHack)
+		}
+		if other, dup := seen[name]; dup {
+			return fmt.Errorf("file name collision between %s and %s",
+				slashpath.Join(fsPath, other), slashpath.Join(fsPath, ent.Name()))
+		}
+		seen[name] = ent.Name()
+		entries = append(entries, namedEntry{name, ent})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	for _, e := range entries {
+		childOutPath := e.name
+		if outPath != "" {
+			childOutPath = outPath + "/" + e.name
+		}
+		if err := dumpSorted(childOutPath, slashpath.Join(fsPath, e.ent.Name()), e.ent, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func dumpSingle(outPath string, fsPath string, ent fs.DirEntry, opts *dumpOptions) error {
+	relPath := outPath
+	outPath = opts.archivePath(outPath)
 	switch ent.Type() {
 	case 0:
 		info, err := ent.Info()
@@ -133,18 +535,32 @@ func dumpSingle(outPath string, fsPath string, ent fs.DirEntry, opts *dumpOption
 		if mode.Type() != 0 {
 			return fmt.Errorf("%s changed mode from listing=%v to stat=%v", fsPath, ent.Type(), mode)
 		}
-		if !opts.filter(fsPath, mode) {
+		if opts.executable != nil {
+			if opts.executable(opts.filterPath(fsPath), mode) {
+				mode |= 0o555
+			} else {
+				mode &^= 0o111
+			}
+		}
+		if !opts.filter(fsPath, relPath, mode) {
 			return nil
 		}
 
-		err = opts.nw.WriteHeader(&Header{
+		hdr := &Header{
 			Path: outPath,
 			Mode: mode,
 			Size: info.Size(),
-		})
-		if err != nil {
+		}
+		if err := opts.writeHeader(hdr); err != nil {
 			return err
 		}
+		if opts.onFile != nil {
+			opts.onFile(hdr.Path, hdr.Size)
+		}
+		if opts.listing != nil {
+			opts.nw.skipFile()
+			return nil
+		}
 		f, err := opts.fsys.Open(fsPath)
 		if err != nil {
 			return err
@@ -155,18 +571,22 @@ func dumpSingle(outPath string, fsPath string, ent fs.DirEntry, opts *dumpOption
 			return err
 		}
 	case fs.ModeDir:
-		if !opts.filter(fsPath, fs.ModeDir|0o555) {
+		if !opts.filter(fsPath, relPath, fs.ModeDir|0o555) {
 			return fs.SkipDir
 		}
-		err := opts.nw.WriteHeader(&Header{
+		mode, err := opts.rawMode(ent, fs.ModeDir)
+		if err != nil {
+			return err
+		}
+		err = opts.writeHeader(&Header{
 			Path: outPath,
-			Mode: fs.ModeDir,
+			Mode: mode,
 		})
 		if err != nil {
 			return err
 		}
 	case fs.ModeSymlink:
-		if !opts.filter(fsPath, fs.ModeSymlink|0o777) {
+		if !opts.filter(fsPath, relPath, fs.ModeSymlink|0o777) {
 			return nil
 		}
 		if opts.readlink == nil {
@@ -176,9 +596,13 @@ func dumpSingle(outPath string, fsPath string, ent fs.DirEntry, opts *dumpOption
 		if err != nil {
 			return err
 		}
-		err = opts.nw.WriteHeader(&Header{
+		mode, err := opts.rawMode(ent, fs.ModeSymlink)
+		if err != nil {
+			return err
+		}
+		err = opts.writeHeader(&Header{
 			Path:       outPath,
-			Mode:       fs.ModeSymlink,
+			Mode:       mode,
 			LinkTarget: target,
 		})
 		if err != nil {
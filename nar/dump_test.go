@@ -2,6 +2,7 @@ package nar
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/fs"
 	"os"
@@ -12,6 +13,8 @@ import (
 	"testing/fstest"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"zombiezen.com/go/nix"
 )
 
 func TestDumper(t *testing.T) {
@@ -78,6 +81,645 @@ func TestDumper(t *testing.T) {
 	})
 }
 
+func TestDumperBeforeWrite(t *testing.T) {
+	fsys := fstest.MapFS{
+		"root":          &fstest.MapFile{Mode: fs.ModeDir | 0o750},
+		"root/a.txt":    &fstest.MapFile{Mode: 0o644, Data: []byte("AAA\n")},
+		"root/bin":      &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+		"root/bin/link": &fstest.MapFile{Mode: fs.ModeSymlink | 0o777},
+	}
+	readLink := func(path string) (string, error) {
+		return "../a.txt", nil
+	}
+
+	t.Run("Observe", func(t *testing.T) {
+		var got []Header
+		d := &Dumper{
+			ReadLink: readLink,
+			BeforeWrite: func(hdr *Header) error {
+				got = append(got, *hdr)
+				return nil
+			},
+		}
+		if err := d.Dump(io.Discard, fsys, "root"); err != nil {
+			t.Fatal(err)
+		}
+		want := []Header{
+			{Path: "", Mode: fs.ModeDir | 0o750},
+			{Path: "a.txt", Mode: 0o644, Size: 4},
+			{Path: "bin", Mode: fs.ModeDir | 0o755},
+			{Path: "bin/link", Mode: fs.ModeSymlink | 0o777, LinkTarget: "../a.txt"},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("headers (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"root":       &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+			"root/a.txt": &fstest.MapFile{Mode: 0o666, Data: []byte("AAA\n")},
+		}
+		d := &Dumper{
+			BeforeWrite: func(hdr *Header) error {
+				if hdr.Mode&0o002 != 0 {
+					return fs.ErrPermission
+				}
+				return nil
+			},
+		}
+		if err := d.Dump(io.Discard, fsys, "root"); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("d.Dump(...) = %v; want %v", err, fs.ErrPermission)
+		}
+	})
+
+	t.Run("Modify", func(t *testing.T) {
+		d := &Dumper{
+			ReadLink: readLink,
+			BeforeWrite: func(hdr *Header) error {
+				switch hdr.Path {
+				case "a.txt":
+					hdr.Mode |= 0o111
+				case "bin/link":
+					hdr.LinkTarget = "../b.txt"
+				}
+				return nil
+			},
+		}
+		ls, err := d.Index(fsys, "root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node, _ := ls.Find("a.txt"); node == nil || node.Mode&0o111 == 0 {
+			t.Errorf("a.txt = %+v; want executable", node)
+		}
+		if node, _ := ls.Find("bin/link"); node == nil || node.LinkTarget != "../b.txt" {
+			t.Errorf("bin/link = %+v; want LinkTarget = %q", node, "../b.txt")
+		}
+	})
+
+	t.Run("ChangeSize", func(t *testing.T) {
+		d := &Dumper{
+			ReadLink: readLink,
+			BeforeWrite: func(hdr *Header) error {
+				if hdr.Path == "a.txt" {
+					hdr.Size = 2
+				}
+				return nil
+			},
+		}
+		err := d.Dump(io.Discard, fsys, "root")
+		if err == nil || !strings.Contains(err.Error(), "BeforeWrite changed size") {
+			t.Errorf("d.Dump(...) = %v; want BeforeWrite changed size error", err)
+		}
+	})
+
+	t.Run("ChangeType", func(t *testing.T) {
+		d := &Dumper{
+			ReadLink: readLink,
+			BeforeWrite: func(hdr *Header) error {
+				if hdr.Path == "bin" {
+					hdr.Mode = 0o444
+				}
+				return nil
+			},
+		}
+		err := d.Dump(io.Discard, fsys, "root")
+		if err == nil || !strings.Contains(err.Error(), "BeforeWrite changed type") {
+			t.Errorf("d.Dump(...) = %v; want BeforeWrite changed type error", err)
+		}
+	})
+}
+
+func TestDumperOnFile(t *testing.T) {
+	fsys := fstest.MapFS{
+		"root":             &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+		"root/a.txt":       &fstest.MapFile{Mode: 0o644, Data: []byte("AAA\n")},
+		"root/bin":         &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+		"root/bin/hello":   &fstest.MapFile{Mode: 0o755, Data: []byte(miniDRVScriptData)},
+		"root/bin/link":    &fstest.MapFile{Mode: fs.ModeSymlink | 0o777},
+		"root/z/empty.txt": &fstest.MapFile{Mode: 0o644},
+	}
+	readLink := func(path string) (string, error) {
+		return "../a.txt", nil
+	}
+
+	type call struct {
+		path string
+		size int64
+	}
+	var got []call
+	d := &Dumper{
+		ReadLink: readLink,
+		OnFile: func(path string, size int64) {
+			got = append(got, call{path, size})
+		},
+	}
+	gotNAR := new(bytes.Buffer)
+	if err := d.Dump(gotNAR, fsys, "root"); err != nil {
+		t.Fatal(err)
+	}
+	want := []call{
+		{"a.txt", 4},
+		{"bin/hello", int64(len(miniDRVScriptData))},
+		{"z/empty.txt", 0},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(call{})); diff != "" {
+		t.Errorf("calls (-want +got):\n%s", diff)
+	}
+
+	wantNAR := new(bytes.Buffer)
+	if err := (&Dumper{ReadLink: readLink}).Dump(wantNAR, fsys, "root"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotNAR.Bytes(), wantNAR.Bytes()) {
+		t.Error("OnFile changed the archive")
+	}
+}
+
+// DumpCanonical returns the NAR serialization of the given local directory
+// or fails the test.
+func DumpCanonical(tb testing.TB, dir string) []byte {
+	tb.Helper()
+	parent, base := filepath.Split(dir)
+	data, err := CanonicalNAR(os.DirFS(parent), base, func(path string) (string, error) {
+		return os.Readlink(filepath.Join(parent, filepath.FromSlash(path)))
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestDumperExecutable(t *testing.T) {
+	// Files with inconsistent permission bits,
+	// like those from a zip file without Unix metadata.
+	fsys := fstest.MapFS{
+		"a.txt":        &fstest.MapFile{Data: []byte("AAA\n"), Mode: 0o755},
+		"bin/hello.sh": &fstest.MapFile{Data: []byte(miniDRVScriptData)},
+		"hello.txt":    &fstest.MapFile{Data: []byte(helloWorld), Mode: 0o644},
+	}
+	type call struct {
+		Path string
+		Mode fs.FileMode
+	}
+	var calls []call
+	d := &Dumper{
+		Executable: func(path string, mode fs.FileMode) bool {
+			calls = append(calls, call{path, mode})
+			matched, _ := slashpath.Match("bin/*", path)
+			return matched
+		},
+	}
+	got := new(bytes.Buffer)
+	if err := d.Dump(got, fsys, "."); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got.Bytes()); diff != "" {
+		t.Errorf("-want +got:\n%s", diff)
+	}
+	wantCalls := []call{
+		{"a.txt", 0o755},
+		{"bin/hello.sh", 0},
+		{"hello.txt", 0o644},
+	}
+	if diff := cmp.Diff(wantCalls, calls); diff != "" {
+		t.Errorf("Executable calls (-want +got):\n%s", diff)
+	}
+
+	t.Run("FilterPath", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "hello.txt")
+		if err := os.WriteFile(path, []byte(helloWorld), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var filterPaths, execPaths []string
+		d := &Dumper{
+			FilterFunc: func(path string, mode fs.FileMode) bool {
+				filterPaths = append(filterPaths, path)
+				return true
+			},
+			Executable: func(path string, mode fs.FileMode) bool {
+				execPaths = append(execPaths, path)
+				return false
+			},
+		}
+		if err := d.Dump(io.Discard, os.DirFS(dir), "hello.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(filterPaths, execPaths); diff != "" {
+			t.Errorf("Executable paths differ from FilterFunc paths (-filter +executable):\n%s", diff)
+		}
+	})
+}
+
+func TestDumperCaseHackSuffix(t *testing.T) {
+	hacked := fstest.MapFS{
+		"A":                                &fstest.MapFile{Data: []byte("upper\n"), Mode: 0o644},
+		"a~nix~case~hack~1":                &fstest.MapFile{Data: []byte("lower\n"), Mode: 0o644},
+		"a0":                               &fstest.MapFile{Data: []byte("a0\n"), Mode: 0o644},
+		"README":                           &fstest.MapFile{Data: []byte("README\n"), Mode: 0o644},
+		"readme~nix~case~hack~1/hello.txt": &fstest.MapFile{Data: []byte(helloWorld), Mode: 0o644},
+		"readme~nix~case~hack~1/Hello.TXT~nix~case~hack~3": &fstest.MapFile{Data: []byte(helloWorld), Mode: 0o755},
+	}
+	logical := fstest.MapFS{
+		"A":                &fstest.MapFile{Data: []byte("upper\n"), Mode: 0o644},
+		"a":                &fstest.MapFile{Data: []byte("lower\n"), Mode: 0o644},
+		"a0":               &fstest.MapFile{Data: []byte("a0\n"), Mode: 0o644},
+		"README":           &fstest.MapFile{Data: []byte("README\n"), Mode: 0o644},
+		"readme/hello.txt": &fstest.MapFile{Data: []byte(helloWorld), Mode: 0o644},
+		"readme/Hello.TXT": &fstest.MapFile{Data: []byte(helloWorld), Mode: 0o755},
+	}
+	want := new(bytes.Buffer)
+	if err := new(Dumper).Dump(want, logical, "."); err != nil {
+		t.Fatal(err)
+	}
+	got := new(bytes.Buffer)
+	d := &Dumper{CaseHackSuffix: caseHackSuffix}
+	if err := d.Dump(got, hacked, "."); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want.Bytes(), got.Bytes()); diff != "" {
+		t.Errorf("-want +got:\n%s", diff)
+	}
+
+	t.Run("Collision", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"dir/x~nix~case~hack~1": &fstest.MapFile{Data: []byte("1\n"), Mode: 0o644},
+			"dir/x~nix~case~hack~2": &fstest.MapFile{Data: []byte("2\n"), Mode: 0o644},
+		}
+		err := d.Dump(io.Discard, fsys, ".")
+		if err == nil {
+			t.Fatal("Dump did not return an error")
+		}
+		t.Log("Dump:", err)
+		for _, name := range []string{"dir/x~nix~case~hack~1", "dir/x~nix~case~hack~2"} {
+			if !strings.Contains(err.Error(), name) {
+				t.Errorf("error %q does not mention %s", err, name)
+			}
+		}
+	})
+}
+
+func TestDumperSort(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := shuffledFS{fstest.MapFS{
+		"a.txt":        &fstest.MapFile{Data: []byte("AAA\n"), Mode: 0o644},
+		"bin/hello.sh": &fstest.MapFile{Data: []byte(miniDRVScriptData), Mode: 0o755},
+		"hello.txt":    &fstest.MapFile{Data: []byte(helloWorld), Mode: 0o644},
+	}}
+
+	t.Run("Unsorted", func(t *testing.T) {
+		err := new(Dumper).Dump(io.Discard, fsys, ".")
+		if err == nil {
+			t.Fatal("Dump did not return an error")
+		}
+		t.Log("Dump:", err)
+	})
+
+	t.Run("Sorted", func(t *testing.T) {
+		got := new(bytes.Buffer)
+		d := &Dumper{Sort: true}
+		if err := d.Dump(got, fsys, "."); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got.Bytes()); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+}
+
+// shuffledFS is a filesystem whose ReadDir method
+// returns entries in reverse order.
+type shuffledFS struct {
+	fstest.MapFS
+}
+
+func (fsys shuffledFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fsys.MapFS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+func TestDumperIndex(t *testing.T) {
+	for _, name := range []string{
+		"nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar",
+		"mini-drv.nar",
+		"hello-world.nar",
+		"empty-directory.nar",
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := List(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := restoreTempDir(t)
+			if err := RestorePath(filepath.Join(dir, "out"), bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+
+			d := &Dumper{
+				ReadLink: func(path string) (string, error) {
+					return os.Readlink(filepath.Join(dir, filepath.FromSlash(path)))
+				},
+			}
+			got, err := d.Index(os.DirFS(dir), "out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got, ignoreHeaderOffset); diff != "" {
+				t.Errorf("Index (-List +Index):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCanonicalNAR(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mini-drv")
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("AAA\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "hello.sh"), []byte(miniDRVScriptData), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte(helloWorld), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := DumpCanonical(t, dir)
+	want, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("-want +got:\n%s", diff)
+	}
+}
+
+func TestDumpToStorePath(t *testing.T) {
+	fsys := fstest.MapFS{
+		"mini-drv":              &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+		"mini-drv/a.txt":        &fstest.MapFile{Mode: 0o644, Data: []byte("AAA\n")},
+		"mini-drv/bin":          &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+		"mini-drv/bin/hello.sh": &fstest.MapFile{Mode: 0o755, Data: []byte(miniDRVScriptData)},
+		"mini-drv/hello.txt":    &fstest.MapFile{Mode: 0o644, Data: []byte(helloWorld)},
+	}
+	buf := new(bytes.Buffer)
+	got, err := DumpToStorePath(buf, nix.DefaultStoreDirectory, "mini-drv", fsys, "mini-drv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want nix.StorePath = "/nix/store/nhy91l6b2hmv52pzz7ckmwp8z8v531np-mini-drv"
+	if got != want {
+		t.Errorf("DumpToStorePath(...) = %q; want %q", got, want)
+	}
+	wantNAR, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantNAR, buf.Bytes()); diff != "" {
+		t.Errorf("NAR (-want +got):\n%s", diff)
+	}
+
+	if got, err := DumpToStorePath(io.Discard, nix.DefaultStoreDirectory, "bad/name", fsys, "mini-drv"); err == nil {
+		t.Errorf("DumpToStorePath(..., \"bad/name\", ...) = %q, <nil>; want _, <error>", got)
+	}
+}
+
+func TestDumpPathToStore(t *testing.T) {
+	wantNAR, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(restoreTempDir(t), "mini-drv")
+	if err := RestorePath(path, bytes.NewReader(wantNAR)); err != nil {
+		t.Fatal(err)
+	}
+
+	gotPath, gotInfo, err := DumpPathToStore(nix.DefaultStoreDirectory, "mini-drv", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const wantPath nix.StorePath = "/nix/store/nhy91l6b2hmv52pzz7ckmwp8z8v531np-mini-drv"
+	if gotPath != wantPath {
+		t.Errorf("DumpPathToStore(...) = %q, ...; want %q", gotPath, wantPath)
+	}
+	narHash, err := nix.ParseHash("sha256-wylwH83f/6yIiGEkfm8NjZ0LQZhUrMdu5z1r9SGf8mg=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantInfo := &nix.NARInfo{
+		StorePath: wantPath,
+		NARHash:   narHash,
+		NARSize:   int64(len(wantNAR)),
+		CA:        nix.RecursiveFileContentAddress(narHash),
+	}
+	if diff := cmp.Diff(wantInfo, gotInfo); diff != "" {
+		t.Errorf("DumpPathToStore(...) info (-want +got):\n%s", diff)
+	}
+
+	if got, _, err := DumpPathToStore(nix.DefaultStoreDirectory, "bad/name", path); err == nil {
+		t.Errorf("DumpPathToStore(..., \"bad/name\", ...) = %q, _, <nil>; want _, _, <error>", got)
+	}
+}
+
+func TestDumpPathHash(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(restoreTempDir(t), "mini-drv")
+	if err := RestorePath(path, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []nix.HashType{nix.SHA256, nix.SHA512} {
+		h := nix.NewHasher(typ)
+		h.Write(data)
+		want := h.SumHash()
+		got, size, err := DumpPathHash(typ, path)
+		if err != nil {
+			t.Errorf("DumpPathHash(%v, path): %v", typ, err)
+			continue
+		}
+		if !got.Equal(want) || size != int64(len(data)) {
+			t.Errorf("DumpPathHash(%v, path) = %v, %d, <nil>; want %v, %d, <nil>", typ, got, size, want, len(data))
+		}
+	}
+
+	filter := func(path string, mode fs.FileMode) bool {
+		return filepath.Base(path) != "hello.txt"
+	}
+	buf := new(bytes.Buffer)
+	if err := DumpPathFilter(buf, path, filter); err != nil {
+		t.Fatal(err)
+	}
+	h := nix.NewHasher(nix.SHA256)
+	h.Write(buf.Bytes())
+	want := h.SumHash()
+	got, size, err := DumpPathFilterHash(nix.SHA256, path, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(want) || size != int64(buf.Len()) {
+		t.Errorf("DumpPathFilterHash(...) = %v, %d, <nil>; want %v, %d, <nil>", got, size, want, buf.Len())
+	}
+}
+
+func TestDumpPathHashKnownValue(t *testing.T) {
+	// Known value from "nix hash path".
+	root := filepath.Join(t.TempDir(), "mini-drv")
+	files := []struct {
+		name string
+		data string
+		mode fs.FileMode
+	}{
+		{"a.txt", "AAA\n", 0o644},
+		{"bin/hello.sh", miniDRVScriptData, 0o755},
+		{"hello.txt", helloWorld, 0o644},
+	}
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.data), f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _, err := DumpPathHash(nix.SHA256, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "sha256-wylwH83f/6yIiGEkfm8NjZ0LQZhUrMdu5z1r9SGf8mg="
+	if got.SRI() != want {
+		t.Errorf("DumpPathHash(nix.SHA256, root) = %v, _, <nil>; want %s", got, want)
+	}
+}
+
+func TestTeeDump(t *testing.T) {
+	fsys := fstest.MapFS{
+		"root":          &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+		"root/a.txt":    &fstest.MapFile{Mode: 0o644, Data: []byte("AAA\n")},
+		"root/bin":      &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+		"root/bin/link": &fstest.MapFile{Mode: fs.ModeSymlink | 0o777},
+	}
+	readLink := func(path string) (string, error) {
+		return "../a.txt", nil
+	}
+	buf1 := new(bytes.Buffer)
+	buf2 := new(bytes.Buffer)
+	gotHash, gotSize, err := TeeDump(fsys, "root", readLink, buf1, buf2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf1.Bytes(), buf2.Bytes()) {
+		t.Error("destinations received different content")
+	}
+	if gotSize != int64(buf1.Len()) {
+		t.Errorf("size = %d; want %d", gotSize, buf1.Len())
+	}
+	h := nix.NewHasher(nix.SHA256)
+	h.Write(buf1.Bytes())
+	if want := h.SumHash(); !gotHash.Equal(want) {
+		t.Errorf("hash = %v; want %v", gotHash, want)
+	}
+	if _, err := NewReader(buf1).Next(); err != nil {
+		t.Error("reading tee'd NAR:", err)
+	}
+}
+
+func TestDumperDumpSub(t *testing.T) {
+	fsys := fstest.MapFS{
+		"src":       &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+		"src/a.txt": &fstest.MapFile{Mode: 0o644, Data: []byte("AAA\n")},
+		"hello.txt": &fstest.MapFile{Mode: 0o644, Data: []byte(helloWorld)},
+	}
+
+	t.Run("Directory", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		if err := new(Dumper).DumpSub(buf, fsys, "src", "opt/src"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := List(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &Listing{Root: ListingNode{
+			Header: Header{Mode: fs.ModeDir | 0o555},
+			Entries: map[string]*ListingNode{
+				"opt": {
+					Header: Header{Path: "opt", Mode: fs.ModeDir | 0o555},
+					Entries: map[string]*ListingNode{
+						"src": {
+							Header: Header{Path: "opt/src", Mode: fs.ModeDir | 0o555},
+							Entries: map[string]*ListingNode{
+								"a.txt": {Header: Header{
+									Path:          "opt/src/a.txt",
+									Mode:          0o444,
+									Size:          4,
+									ContentOffset: 504,
+								}},
+							},
+						},
+					},
+				},
+			},
+		}}
+		if diff := cmp.Diff(want, got, cmpopts.EquateEmpty(), ignoreHeaderOffset); diff != "" {
+			t.Errorf("listing (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("File", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		if err := new(Dumper).DumpSub(buf, fsys, "hello.txt", "hello.txt"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := List(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := got.Root.Entries["hello.txt"]
+		if !got.Root.Mode.IsDir() || node == nil || node.Size != int64(len(helloWorld)) {
+			t.Errorf("listing = %+v; want directory with hello.txt", got)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		got := new(bytes.Buffer)
+		if err := new(Dumper).DumpSub(got, fsys, "hello.txt", ""); err != nil {
+			t.Fatal(err)
+		}
+		want := new(bytes.Buffer)
+		if err := new(Dumper).Dump(want, fsys, "hello.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Error("DumpSub(..., \"\") differs from Dump(...)")
+		}
+	})
+}
+
 func TestDumpPathFilter(t *testing.T) {
 	t.Run("unfiltered", func(t *testing.T) {
 		tmpDir := t.TempDir()
@@ -141,6 +783,53 @@ func TestDumpPathFilter(t *testing.T) {
 	})
 }
 
+func TestDumpPathFilter2(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"top.txt", "a/keep.txt", "a/skip.txt"} {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type filterCall struct {
+		osPath  string
+		narPath string
+	}
+	var calls []filterCall
+	got := new(bytes.Buffer)
+	err := DumpPathFilter2(got, root, func(osPath, narPath string, mode fs.FileMode) bool {
+		calls = append(calls, filterCall{osPath, narPath})
+		return narPath != "a/skip.txt"
+	})
+	if err != nil {
+		t.Fatal("DumpPathFilter2:", err)
+	}
+	wantCalls := []filterCall{
+		{root, ""},
+		{filepath.Join(root, "a"), "a"},
+		{filepath.Join(root, "a", "keep.txt"), "a/keep.txt"},
+		{filepath.Join(root, "a", "skip.txt"), "a/skip.txt"},
+		{filepath.Join(root, "top.txt"), "top.txt"},
+	}
+	if diff := cmp.Diff(wantCalls, calls, cmp.AllowUnexported(filterCall{})); diff != "" {
+		t.Errorf("filter calls (-want +got):\n%s", diff)
+	}
+
+	want := new(bytes.Buffer)
+	err = DumpPathFilter(want, root, func(path string, mode fs.FileMode) bool {
+		return path != filepath.Join(root, "a", "skip.txt")
+	})
+	if err != nil {
+		t.Fatal("DumpPathFilter:", err)
+	}
+	if diff := cmp.Diff(want.Bytes(), got.Bytes()); diff != "" {
+		t.Errorf("DumpPathFilter2 vs. DumpPathFilter (-want +got):\n%s", diff)
+	}
+}
+
 func BenchmarkDumpPath(b *testing.B) {
 	b.Run("testdata", func(b *testing.B) {
 		bc := new(byteCounter)
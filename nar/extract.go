@@ -0,0 +1,190 @@
+package nar
+
+import (
+	"fmt"
+	"io"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"strings"
+)
+
+// An Extractor recreates the file system objects in NAR archives
+// on the local file system.
+// Unlike [RestorePath], an Extractor refuses to create symlinks
+// that point outside of the extracted tree.
+// The zero value is an Extractor with default options.
+type Extractor struct {
+	// ReadOnly indicates whether directories should be made read-only (mode 0o555)
+	// after their entries are written, as nix-store does.
+	// If false, directories are left writable (mode 0o755)
+	// so that the extracted tree can be modified or removed afterward.
+	// Regular files are always created with mode 0o444 (or 0o555 if executable).
+	ReadOnly bool
+}
+
+// Extract reads a NAR archive from r
+// and recreates its file system objects on the local file system at dst
+// using the default [Extractor] options.
+// It is the counterpart to [DumpPath].
+func Extract(dst string, r io.Reader) error {
+	return new(Extractor).Extract(dst, r)
+}
+
+// Extract reads a NAR archive from r
+// and recreates its file system objects on the local file system at dst.
+// The archive's root is created at dst itself,
+// and any missing parent directories of dst are created.
+// Like [RestorePath], Extract refuses to overwrite anything at dst
+// other than an empty directory.
+//
+// Extract returns an error without creating any symlinks
+// if any symlink in the archive would resolve to a location outside dst,
+// either directly (an absolute target or too many ".." elements)
+// or by way of other symlinks in the archive.
+// A symlink at dst itself would resolve relative to dst's parent,
+// so an archive whose root is a symlink is always rejected.
+// If Extract returns an error, dst may be left partially written.
+func (e *Extractor) Extract(dst string, r io.Reader) error {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return fmt.Errorf("extract nar: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("extract nar: %w", err)
+	}
+	if err := checkRestoreDestination(dst); err != nil {
+		return fmt.Errorf("extract nar: %w", err)
+	}
+	target := &extractFS{
+		osRestoreFS: osRestoreFS{dir: dst},
+		links:       make(map[string]string),
+	}
+	if err := restore(target, r); err != nil {
+		return fmt.Errorf("extract nar: %w", err)
+	}
+
+	// Symlinks are only created once every symlink in the archive is known,
+	// since a later symlink can change where an earlier one resolves to.
+	for _, name := range target.linkNames {
+		archivePath := name
+		if archivePath == "." {
+			archivePath = ""
+		}
+		if !symlinkInside(dst, target.links, name) {
+			return fmt.Errorf("extract nar: %s: symlink target %q points outside %s",
+				formatLastPath(archivePath), target.links[name], dst)
+		}
+	}
+	for _, name := range target.linkNames {
+		if err := os.Symlink(target.links[name], target.path(name)); err != nil {
+			return fmt.Errorf("extract nar: %w", err)
+		}
+	}
+
+	if e.ReadOnly {
+		if err := target.chmodDirs(); err != nil {
+			return fmt.Errorf("extract nar: %w", err)
+		}
+	}
+	return nil
+}
+
+// extractMaxSymlinks is the number of symlinks symlinkInside follows
+// before giving up.
+// It is larger than the limit of any operating system Extract runs on
+// (40 on Linux, 32 on macOS and the BSDs, 63 on Windows),
+// so a symlink that needs more hops can never be followed outside dst.
+const extractMaxSymlinks = 255
+
+// extractFS is a [RestoreFS] that writes directories and regular files
+// to the local file system
+// and defers creating symlinks until they can be checked.
+type extractFS struct {
+	osRestoreFS
+	// links is a map of archive names to symlink targets.
+	links map[string]string
+	// linkNames is the list of keys in links in archive order.
+	linkNames []string
+}
+
+func (efs *extractFS) Symlink(oldname, newname string) error {
+	efs.links[newname] = oldname
+	efs.linkNames = append(efs.linkNames, newname)
+	return nil
+}
+
+// symlinkInside reports whether the symlink with the given archive name
+// resolves to a location inside the archive's root at dst,
+// following any other symlinks in links along the way.
+// Only the archive's contents are consulted:
+// names not in links are treated as directories or files created by the archive.
+// Targets that do not exist are resolved lexically.
+// A symlink that takes more than extractMaxSymlinks hops to resolve
+// (such as one in a cycle of symlinks) is reported as inside,
+// since the operating system can't resolve it either.
+func symlinkInside(dst string, links map[string]string, name string) bool {
+	if name == "." {
+		return false
+	}
+	var dir []string
+	if parent := slashpath.Dir(name); parent != "." {
+		dir = strings.Split(parent, "/")
+	}
+	elems, abs, ok := splitSymlinkTarget(dst, links[name])
+	if !ok {
+		return false
+	}
+	if abs {
+		dir = nil
+	}
+	hops := 1
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(dir) == 0 {
+				return false
+			}
+			dir = dir[:len(dir)-1]
+			continue
+		}
+		dir = append(dir, elem)
+		target, isLink := links[strings.Join(dir, "/")]
+		if !isLink {
+			continue
+		}
+		if hops >= extractMaxSymlinks {
+			return true
+		}
+		hops++
+		dir = dir[:len(dir)-1]
+		next, abs, ok := splitSymlinkTarget(dst, target)
+		if !ok {
+			return false
+		}
+		if abs {
+			dir = nil
+		}
+		elems = append(next, elems...)
+	}
+	return true
+}
+
+// splitSymlinkTarget splits a symlink target into slash-separated elements.
+// If the target is absolute, splitSymlinkTarget returns the elements
+// relative to dst and abs is true.
+// ok is false if the target is an absolute path outside dst.
+func splitSymlinkTarget(dst string, target string) (elems []string, abs bool, ok bool) {
+	if !filepath.IsAbs(target) {
+		return strings.Split(target, "/"), false, true
+	}
+	rel, err := filepath.Rel(dst, filepath.Clean(target))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, true, false
+	}
+	return strings.Split(filepath.ToSlash(rel), "/"), true, true
+}
@@ -0,0 +1,309 @@
+package nar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExtract(t *testing.T) {
+	t.Run("MiniDRV", func(t *testing.T) {
+		want, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(restoreTempDir(t), "a", "b", "out")
+		if err := Extract(dst, bytes.NewReader(want)); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(dst, "hello.txt"))
+		if string(got) != helloWorld || err != nil {
+			t.Errorf("os.ReadFile(hello.txt) = %q, %v; want %q, <nil>", got, err, helloWorld)
+		}
+		info, err := os.Stat(filepath.Join(dst, "bin", "hello.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := info.Mode(), fs.FileMode(0o555); got != want {
+			t.Errorf("bin/hello.sh mode = %v; want %v", got, want)
+		}
+		info, err = os.Stat(filepath.Join(dst, "bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := info.Mode(), fs.ModeDir|0o755; got != want {
+			t.Errorf("bin mode = %v; want %v", got, want)
+		}
+
+		// Round-trip.
+		buf := new(bytes.Buffer)
+		if err := DumpPath(buf, dst); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+			t.Errorf("DumpPath after Extract (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		want, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(restoreTempDir(t), "out")
+		e := &Extractor{ReadOnly: true}
+		if err := e.Extract(dst, bytes.NewReader(want)); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{".", "bin"} {
+			info, err := os.Stat(filepath.Join(dst, name))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if got, want := info.Mode(), fs.ModeDir|0o555; got != want {
+				t.Errorf("%s mode = %v; want %v", name, got, want)
+			}
+		}
+	})
+
+	t.Run("Symlinks", func(t *testing.T) {
+		want, err := os.ReadFile(filepath.Join("testdata", "nested-dir-and-common-prefix.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(restoreTempDir(t), "out")
+		if err := Extract(dst, bytes.NewReader(want)); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := DumpPath(buf, dst); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+			t.Errorf("DumpPath after Extract (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("NotEmpty", func(t *testing.T) {
+		dst := restoreTempDir(t)
+		if err := os.WriteFile(filepath.Join(dst, "foo"), nil, 0o666); err != nil {
+			t.Fatal(err)
+		}
+		nar := extractTestNAR(t, &Header{Mode: fs.ModeDir | 0o555})
+		if err := Extract(dst, bytes.NewReader(nar)); err == nil {
+			t.Error("Extract did not return an error")
+		}
+	})
+
+	tests := []struct {
+		name    string
+		headers func(dst string) []*Header
+		escapes bool
+	}{
+		{
+			name: "Sibling",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: 0o444},
+					{Path: "b", Mode: fs.ModeSymlink, LinkTarget: "a"},
+				}
+			},
+		},
+		{
+			name: "DotDotInside",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: 0o444},
+					{Path: "sub", Mode: fs.ModeDir | 0o555},
+					{Path: "sub/b", Mode: fs.ModeSymlink, LinkTarget: "../a"},
+				}
+			},
+		},
+		{
+			name: "AbsoluteInside",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: 0o444},
+					{Path: "b", Mode: fs.ModeSymlink, LinkTarget: filepath.Join(dst, "a")},
+				}
+			},
+		},
+		{
+			name: "Dangling",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: fs.ModeSymlink, LinkTarget: "missing/file"},
+				}
+			},
+		},
+		{
+			name: "DotDot",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: fs.ModeSymlink, LinkTarget: "../secret"},
+				}
+			},
+			escapes: true,
+		},
+		{
+			name: "DotDotThroughSubdir",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "sub", Mode: fs.ModeDir | 0o555},
+					{Path: "sub/a", Mode: fs.ModeSymlink, LinkTarget: "../../secret"},
+				}
+			},
+			escapes: true,
+		},
+		{
+			name: "Absolute",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: fs.ModeSymlink, LinkTarget: "/etc/passwd"},
+				}
+			},
+			escapes: true,
+		},
+		{
+			name: "Chained",
+			headers: func(dst string) []*Header {
+				// "sub/up" resolves to the root on its own,
+				// so "a" resolves to the root's parent.
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: fs.ModeSymlink, LinkTarget: "sub/up/.."},
+					{Path: "sub", Mode: fs.ModeDir | 0o555},
+					{Path: "sub/up", Mode: fs.ModeSymlink, LinkTarget: ".."},
+				}
+			},
+			escapes: true,
+		},
+		{
+			name: "ChainedAbsolute",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: fs.ModeSymlink, LinkTarget: "b/x"},
+					{Path: "b", Mode: fs.ModeSymlink, LinkTarget: "/tmp"},
+				}
+			},
+			escapes: true,
+		},
+		{
+			name: "Loop",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: fs.ModeSymlink, LinkTarget: "b"},
+					{Path: "b", Mode: fs.ModeSymlink, LinkTarget: "a"},
+				}
+			},
+		},
+		{
+			name: "SelfLoop",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeDir | 0o555},
+					{Path: "a", Mode: fs.ModeSymlink, LinkTarget: "a/x"},
+				}
+			},
+		},
+		{
+			name: "LongChain",
+			headers: func(dst string) []*Header {
+				// More hops than Linux or macOS will follow,
+				// but fewer than Extract checks.
+				hdrs := []*Header{{Mode: fs.ModeDir | 0o555}}
+				for i := 0; i < 50; i++ {
+					hdrs = append(hdrs, &Header{
+						Path:       fmt.Sprintf("l%02d", i),
+						Mode:       fs.ModeSymlink,
+						LinkTarget: fmt.Sprintf("l%02d", i+1),
+					})
+				}
+				return append(hdrs, &Header{
+					Path:       "l50",
+					Mode:       fs.ModeSymlink,
+					LinkTarget: "..",
+				})
+			},
+			escapes: true,
+		},
+		{
+			name: "Root",
+			headers: func(dst string) []*Header {
+				return []*Header{
+					{Mode: fs.ModeSymlink, LinkTarget: "out2"},
+				}
+			},
+			escapes: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dst := filepath.Join(restoreTempDir(t), "out")
+			hdrs := test.headers(dst)
+			nar := extractTestNAR(t, hdrs...)
+			err := Extract(dst, bytes.NewReader(nar))
+			if test.escapes {
+				if err == nil {
+					t.Error("Extract did not return an error")
+				}
+				// No symlinks should have been created.
+				for _, hdr := range hdrs {
+					if hdr.Mode.Type() != fs.ModeSymlink {
+						continue
+					}
+					if _, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(hdr.Path))); !errors.Is(err, os.ErrNotExist) {
+						t.Errorf("os.Lstat(%q) = _, %v; want %v", hdr.Path, err, os.ErrNotExist)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, hdr := range hdrs {
+				if hdr.Mode.Type() != fs.ModeSymlink {
+					continue
+				}
+				got, err := os.Readlink(filepath.Join(dst, filepath.FromSlash(hdr.Path)))
+				if got != hdr.LinkTarget || err != nil {
+					t.Errorf("os.Readlink(%q) = %q, %v; want %q, <nil>", hdr.Path, got, err, hdr.LinkTarget)
+				}
+			}
+		})
+	}
+}
+
+// extractTestNAR returns a NAR archive with the given headers.
+// Regular files in the archive are empty.
+func extractTestNAR(tb testing.TB, hdrs ...*Header) []byte {
+	tb.Helper()
+	buf := new(bytes.Buffer)
+	nw := NewWriter(buf)
+	for _, hdr := range hdrs {
+		if err := nw.WriteHeader(hdr); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := nw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
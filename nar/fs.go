@@ -1,18 +1,35 @@
 package nar
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	slashpath "path"
 	"sort"
 	"strings"
+	"sync"
 )
 
 // FS implements [fs.FS] for a NAR file.
 type FS struct {
 	r  io.ReaderAt
 	ls *Listing
+	// root is the archive path of ls.Root.
+	// It is only non-empty for an FS returned by [FS.Sub].
+	root string
+	// noResolve is true if symlinks should not be followed.
+	noResolve bool
+}
+
+// NewFSOptions is the set of optional parameters to [NewFSWithOptions].
+type NewFSOptions struct {
+	// NoResolveSymlinks indicates that symlinks should be treated as opaque
+	// instead of being followed when looking up a name as [NewFS] does.
+	// If true, opening a symlink returns a file whose Stat reports [fs.ModeSymlink],
+	// [FS.ReadLink] returns its target,
+	// and names that traverse a symlink do not exist.
+	NoResolveSymlinks bool
 }
 
 // NewFS returns a new [FS] from a NAR listing
@@ -20,10 +37,82 @@ type FS struct {
 // NewFS will return an error if the listing does not have a directory at its root.
 // The listing should not be modified while the returned FS is in use.
 func NewFS(r io.ReaderAt, ls *Listing) (*FS, error) {
+	return NewFSWithOptions(r, ls, nil)
+}
+
+// NewFSWithOptions returns a new [FS] like [NewFS]
+// with the given options.
+// A nil opts is equivalent to a zero NewFSOptions,
+// which behaves like NewFS.
+func NewFSWithOptions(r io.ReaderAt, ls *Listing, opts *NewFSOptions) (*FS, error) {
 	if !ls.Root.Mode.IsDir() {
 		return nil, fmt.Errorf("new nar fs: not a directory")
 	}
-	return &FS{r, ls}, nil
+	return &FS{
+		r:         r,
+		ls:        ls,
+		noResolve: opts != nil && opts.NoResolveSymlinks,
+	}, nil
+}
+
+// NewFSFromReaderAt returns a new [FS] from a random access reader
+// to a NAR file of the given size.
+// It reads the whole archive once to build the listing,
+// so it is a convenience for callers that do not have a listing
+// (like a ".ls" file) available.
+func NewFSFromReaderAt(r io.ReaderAt, size int64) (*FS, error) {
+	ls, err := List(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("new nar fs: %w", err)
+	}
+	return NewFS(r, ls)
+}
+
+// NewFSFromReadSeeker returns a new [FS] from a NAR listing
+// and a seekable reader to the NAR file,
+// for sources that do not implement [io.ReaderAt].
+// The NAR file is assumed to start at rs's current position.
+// If ls is nil, then NewFSFromReadSeeker reads the whole archive once
+// to build the listing.
+//
+// Since reading a file requires seeking rs,
+// reads from the returned FS are serialized with a mutex
+// and are thus slower than reads from an FS created with an [io.ReaderAt].
+// The returned FS changes rs's position,
+// so rs must not be used by anything else while the FS is in use.
+func NewFSFromReadSeeker(rs io.ReadSeeker, ls *Listing) (*FS, error) {
+	base, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("new nar fs: %w", err)
+	}
+	if ls == nil {
+		ls, err = List(rs)
+		if err != nil {
+			return nil, fmt.Errorf("new nar fs: %w", err)
+		}
+	}
+	return NewFS(&seekReaderAt{rs: rs, base: base}, ls)
+}
+
+// seekReaderAt implements [io.ReaderAt] with an [io.ReadSeeker]
+// by seeking before every read.
+type seekReaderAt struct {
+	mu   sync.Mutex
+	rs   io.ReadSeeker
+	base int64
+}
+
+func (sra *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	sra.mu.Lock()
+	defer sra.mu.Unlock()
+	if _, err := sra.rs.Seek(sra.base+off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(sra.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
 }
 
 // Open opens the named file.
@@ -63,7 +152,61 @@ func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
 	return inode.FileInfo(), nil
 }
 
+// Sub returns an [FS] corresponding to the subtree rooted at dir.
+// Relative symlinks in the subtree are resolved relative to dir,
+// so symlinks that point outside of dir cannot be followed.
+func (fsys *FS) Sub(dir string) (fs.FS, error) {
+	if dir == "." {
+		return fsys, nil
+	}
+	inode, err := fsys.find(dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: err}
+	}
+	if !inode.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fmt.Errorf("not a directory")}
+	}
+	// The new root reports itself as the root of the archive
+	// so that its FileInfo matches an FS's root.
+	root := *inode
+	root.Path = ""
+	return &FS{
+		r:         fsys.r,
+		ls:        &Listing{Root: root},
+		root:      inode.Path,
+		noResolve: fsys.noResolve,
+	}, nil
+}
+
+// relPath returns the path of the given node relative to fsys's root.
+func (fsys *FS) relPath(node *ListingNode) string {
+	if node == &fsys.ls.Root {
+		return "."
+	}
+	if fsys.root == "" {
+		return node.Path
+	}
+	return strings.TrimPrefix(node.Path, fsys.root+"/")
+}
+
+// maxSymlinks is the maximum number of symlinks
+// that [FS] will follow while looking up a single name.
+// It matches the limit Nix uses.
+const maxSymlinks = 32
+
+// errSymlinkLoop is returned when looking up a name
+// requires following more than maxSymlinks symlinks,
+// which usually indicates a symlink cycle.
+var errSymlinkLoop = errors.New("too many levels of symbolic links")
+
 func (fsys *FS) find(path string) (*ListingNode, error) {
+	hops := 0
+	return fsys.findWithHops(path, &hops)
+}
+
+// findWithHops looks up the node for the given path,
+// incrementing *hops for every symlink followed.
+func (fsys *FS) findWithHops(path string, hops *int) (*ListingNode, error) {
 	if !fs.ValidPath(path) {
 		return nil, fs.ErrInvalid
 	}
@@ -85,17 +228,21 @@ func (fsys *FS) find(path string) (*ListingNode, error) {
 			return nil, fs.ErrNotExist
 		}
 
-		if next.Mode.Type() == fs.ModeSymlink {
+		if next.Mode.Type() == fs.ModeSymlink && fsys.noResolve {
+			if end < len(path) {
+				return nil, fs.ErrNotExist
+			}
+		} else if next.Mode.Type() == fs.ModeSymlink {
 			if slashpath.IsAbs(next.LinkTarget) {
 				return nil, fmt.Errorf("cannot resolve symlink to %s", next.LinkTarget)
 			}
-			parent := curr.Path
-			if parent == "" {
-				parent = "."
+			if *hops >= maxSymlinks {
+				return nil, errSymlinkLoop
 			}
-			// TODO(soon): Prevent cycles.
+			*hops++
+			parent := fsys.relPath(curr)
 			var err error
-			next, err = fsys.find(slashpath.Join(parent, next.LinkTarget))
+			next, err = fsys.findWithHops(slashpath.Join(parent, next.LinkTarget), hops)
 			if err != nil {
 				return nil, err
 			}
@@ -115,7 +262,7 @@ func (fsys *FS) ReadLink(name string) (string, error) {
 	parentNode := &fsys.ls.Root
 	if parent != "" {
 		var err error
-		parentNode, err = fsys.find(parent)
+		parentNode, err = fsys.find(strings.TrimSuffix(parent, "/"))
 		if err != nil {
 			return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
 		}
@@ -130,6 +277,53 @@ func (fsys *FS) ReadLink(name string) (string, error) {
 	return inode.LinkTarget, nil
 }
 
+// WalkRaw walks the file tree rooted at root, calling fn for each file system object
+// in the tree, including root.
+// Unlike [io/fs.WalkDir], WalkRaw never follows symlinks,
+// including symlinks in root's parent directories:
+// fn is called with the symlink's [ListingNode],
+// whose LinkTarget field holds the symlink's target.
+// Paths passed to fn are in the form accepted by [FS.Open],
+// and directory entries are visited in lexical order.
+// The Path field of each node passed to fn is the same path
+// in the form of [Header.Path],
+// so for an FS returned by [FS.Sub], it is relative to the subtree's root.
+// If fn returns [io/fs.SkipDir] when called on a directory,
+// WalkRaw skips the directory's contents.
+// If fn returns [io/fs.SkipDir] when called on any other file system object,
+// WalkRaw skips the remaining entries in its parent directory.
+// Any other error stops the walk and is returned by WalkRaw.
+func (fsys *FS) WalkRaw(root string, fn func(path string, node *ListingNode) error) error {
+	if !fs.ValidPath(root) {
+		return &fs.PathError{Op: "walk", Path: root, Err: fs.ErrInvalid}
+	}
+	lookupPath := root
+	if lookupPath == "." {
+		lookupPath = ""
+	}
+	node := fsys.ls.lookup(lookupPath)
+	if node == nil {
+		return &fs.PathError{Op: "walk", Path: root, Err: fs.ErrNotExist}
+	}
+	if fsys.root != "" {
+		// The listing's nodes have paths relative to the whole archive.
+		archiveFn := fn
+		fn = func(path string, node *ListingNode) error {
+			subNode := *node
+			subNode.Path = fsys.relPath(node)
+			if subNode.Path == "." {
+				subNode.Path = ""
+			}
+			return archiveFn(path, &subNode)
+		}
+	}
+	err := walkListing(root, node, fn)
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
+
 type fsFile struct {
 	inode *ListingNode
 	r     *io.SectionReader
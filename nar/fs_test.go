@@ -1,11 +1,18 @@
 package nar
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestFS(t *testing.T) {
@@ -29,6 +36,100 @@ func TestFS(t *testing.T) {
 		}
 	})
 
+	t.Run("FromReaderAt", func(t *testing.T) {
+		f, err := os.Open(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsys, err := NewFSFromReaderAt(f, info.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fstest.TestFS(fsys, "a.txt", "bin/hello.sh", "hello.txt"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("FromReadSeeker", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Hide the ReadAt method of *bytes.Reader.
+		rs := struct{ io.ReadSeeker }{bytes.NewReader(data)}
+		fsys, err := NewFSFromReadSeeker(rs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fstest.TestFS(fsys, "a.txt", "bin/hello.sh", "hello.txt"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := fs.ReadFile(fsys, "hello.txt")
+		if string(got) != helloWorld || err != nil {
+			t.Errorf("fs.ReadFile(fsys, \"hello.txt\") = %q, %v; want %q, <nil>", got, err, helloWorld)
+		}
+	})
+
+	t.Run("EmptyFile", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		nw := NewWriter(buf)
+		if err := nw.WriteHeader(&Header{Path: "empty", Mode: 0o444}); err != nil {
+			t.Fatal(err)
+		}
+		if err := nw.WriteHeader(&Header{Path: "emptydir", Mode: fs.ModeDir | 0o555}); err != nil {
+			t.Fatal(err)
+		}
+		if err := nw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r := bytes.NewReader(buf.Bytes())
+		fsys, err := NewFSFromReaderAt(r, r.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := fsys.Open("empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 0 || !info.Mode().IsRegular() {
+			t.Errorf("Stat() = size %d, mode %v; want size 0, regular file", info.Size(), info.Mode())
+		}
+		if n, err := f.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+			t.Errorf("Read(...) = %d, %v; want 0, %v", n, err, io.EOF)
+		}
+		if n, err := f.(io.ReaderAt).ReadAt(make([]byte, 1), 0); n != 0 || err != io.EOF {
+			t.Errorf("ReadAt(..., 0) = %d, %v; want 0, %v", n, err, io.EOF)
+		}
+
+		dirInfo, err := fsys.Stat("emptydir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !dirInfo.IsDir() {
+			t.Errorf("Stat(%q).IsDir() = false; want true", "emptydir")
+		}
+		if got, err := fs.ReadFile(fsys, "emptydir"); err == nil {
+			t.Errorf("ReadFile(fsys, %q) = %q, <nil>; want _, <error>", "emptydir", got)
+		}
+
+		if err := fstest.TestFS(fsys, "empty", "emptydir"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
 	t.Run("Symlinks", func(t *testing.T) {
 		f, err := os.Open(filepath.Join("testdata", "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"))
 		if err != nil {
@@ -65,3 +166,268 @@ func TestFS(t *testing.T) {
 		}
 	})
 }
+
+func TestFSSub(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ls, err := List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFS(f, ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := fs.Sub(fsys, "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sub.(*FS); !ok {
+		t.Errorf("fs.Sub(fsys, \"bin\") = %T; want *FS", sub)
+	}
+	if err := fstest.TestFS(sub, "hostname", "domainname", "ypdomainname"); err != nil {
+		t.Error(err)
+	}
+	// The subtree's root should look like any other FS's root.
+	rootInfo, err := fs.Stat(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.Stat(sub, "."); err != nil {
+		t.Error(err)
+	} else if got, want := info.Name(), rootInfo.Name(); got != want {
+		t.Errorf("fs.Stat(sub, \".\").Name() = %q; want %q", got, want)
+	}
+	if root, err := sub.Open("."); err != nil {
+		t.Error(err)
+	} else {
+		info, err := root.Stat()
+		root.Close()
+		if err != nil {
+			t.Error(err)
+		} else if got, want := info.Name(), rootInfo.Name(); got != want {
+			t.Errorf("sub.Open(\".\").Stat().Name() = %q; want %q", got, want)
+		}
+	}
+
+	// domainname is a relative symlink to hostname.
+	want, err := fs.ReadFile(fsys, "bin/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile(sub, "domainname"); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("fs.ReadFile(sub, \"domainname\") = %d bytes, %v; want %d bytes, <nil>", len(got), err, len(want))
+	}
+
+	// Symlinks to directories are followed.
+	if _, err := fs.Sub(fsys, "sbin"); err != nil {
+		t.Errorf("fs.Sub(fsys, \"sbin\"): %v", err)
+	}
+	if _, err := fs.Sub(fsys, "bin/hostname"); err == nil {
+		t.Error("fs.Sub(fsys, \"bin/hostname\") did not return an error")
+	}
+}
+
+func TestFSNoResolveSymlinks(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ls, err := List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The zero options resolve symlinks like NewFS.
+	resolving, err := NewFSWithOptions(f, ls, new(NewFSOptions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := resolving.Stat("sbin"); err != nil || !info.IsDir() {
+		t.Errorf("with zero NewFSOptions, Stat(%q) = %v, %v; want directory", "sbin", info, err)
+	}
+
+	fsys, err := NewFSWithOptions(f, ls, &NewFSOptions{NoResolveSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"sbin", "bin/domainname"} {
+		file, err := fsys.Open(name)
+		if err != nil {
+			t.Errorf("Open(%q): %v", name, err)
+			continue
+		}
+		info, err := file.Stat()
+		file.Close()
+		if err != nil {
+			t.Errorf("Open(%q).Stat(): %v", name, err)
+			continue
+		}
+		if got := info.Mode().Type(); got != fs.ModeSymlink {
+			t.Errorf("Open(%q).Stat().Mode().Type() = %v; want %v", name, got, fs.ModeSymlink)
+		}
+	}
+	if got, err := fsys.ReadLink("bin/domainname"); got != "hostname" || err != nil {
+		t.Errorf("ReadLink(%q) = %q, %v; want %q, <nil>", "bin/domainname", got, err, "hostname")
+	}
+	if _, err := fsys.Stat("sbin/hostname"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(%q) = _, %v; want %v", "sbin/hostname", err, fs.ErrNotExist)
+	}
+	if _, err := fs.Sub(fsys, "sbin"); err == nil {
+		t.Errorf("fs.Sub(fsys, %q) did not return an error", "sbin")
+	}
+
+	// Walking should see symlinks as symlinks.
+	var symlinks []string
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type() == fs.ModeSymlink {
+			symlinks = append(symlinks, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSymlinks := []string{
+		"bin/dnsdomainname",
+		"bin/domainname",
+		"bin/nisdomainname",
+		"bin/ypdomainname",
+		"sbin",
+	}
+	if diff := cmp.Diff(wantSymlinks, symlinks); diff != "" {
+		t.Errorf("symlinks (-want +got):\n%s", diff)
+	}
+}
+
+func TestFSSymlinkCycles(t *testing.T) {
+	symlink := func(path, target string) *ListingNode {
+		return &ListingNode{Header: Header{
+			Path:       path,
+			Mode:       fs.ModeSymlink | 0o777,
+			LinkTarget: target,
+		}}
+	}
+	ls := &Listing{Root: ListingNode{
+		Header: Header{Mode: fs.ModeDir | 0o555},
+		Entries: map[string]*ListingNode{
+			"a":    symlink("a", "b"),
+			"b":    symlink("b", "a"),
+			"self": symlink("self", "self"),
+			"file": {Header: Header{Path: "file", Mode: 0o444}},
+		},
+	}}
+	// Build a chain of symlinks that is exactly as long as the limit.
+	prev := "file"
+	for i := 0; i < maxSymlinks; i++ {
+		name := fmt.Sprintf("link%02d", i)
+		ls.Root.Entries[name] = symlink(name, prev)
+		prev = name
+	}
+	longest := prev
+	ls.Root.Entries["toolong"] = symlink("toolong", longest)
+
+	fsys, err := NewFS(bytes.NewReader(nil), ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "self", "self/x", "toolong"} {
+		_, err := fsys.Stat(name)
+		if !errors.Is(err, errSymlinkLoop) {
+			t.Errorf("fsys.Stat(%q) = _, %v; want %v", name, err, errSymlinkLoop)
+		}
+		var pathErr *fs.PathError
+		if !errors.As(err, &pathErr) {
+			t.Errorf("fsys.Stat(%q) error is %T; want *fs.PathError", name, err)
+		}
+	}
+	if _, err := fsys.Stat(longest); err != nil {
+		t.Errorf("fsys.Stat(%q): %v", longest, err)
+	}
+}
+
+func TestFSWalkRaw(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewFSFromReaderAt(f, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	var sbin *ListingNode
+	err = fsys.WalkRaw(".", func(path string, node *ListingNode) error {
+		paths = append(paths, path)
+		if path == "sbin" {
+			sbin = node
+		}
+		if path == "share" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sbin == nil {
+		t.Fatalf("sbin not visited; visited %q", paths)
+	}
+	if got, want := sbin.Mode.Type(), fs.ModeSymlink; got != want {
+		t.Errorf("sbin type = %v; want %v", got, want)
+	}
+	if got, want := sbin.LinkTarget, "bin"; got != want {
+		t.Errorf("sbin target = %q; want %q", got, want)
+	}
+	for _, path := range paths {
+		if strings.HasPrefix(path, "sbin/") || strings.HasPrefix(path, "share/") {
+			t.Errorf("visited %q", path)
+		}
+	}
+	if len(paths) == 0 || paths[0] != "." {
+		t.Errorf("first path visited = %q; want \".\"", paths)
+	}
+
+	if err := fsys.WalkRaw("sbin/hostname", func(string, *ListingNode) error { return nil }); err == nil {
+		t.Error("WalkRaw(\"sbin/hostname\", ...) did not return an error")
+	}
+
+	t.Run("Sub", func(t *testing.T) {
+		sub, err := fsys.Sub("share/man")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		err = sub.(*FS).WalkRaw(".", func(path string, node *ListingNode) error {
+			paths = append(paths, path)
+			want := path
+			if want == "." {
+				want = ""
+			}
+			if node.Path != want {
+				t.Errorf("WalkRaw called with path %q for node %q; want node %q", path, node.Path, want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) < 2 || paths[1] != "man1" {
+			t.Errorf("paths visited = %q; want to start with [\".\" \"man1\"]", paths)
+		}
+	})
+}
@@ -9,6 +9,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"zombiezen.com/go/nix"
 )
 
 // ListingExtension is the file extension for a file containing NAR listing JSON.
@@ -25,31 +27,121 @@ type Listing struct {
 
 // List indexes a NAR file.
 func List(r io.Reader) (*Listing, error) {
+	return list(NewReader(r))
+}
+
+// IndexAndHash indexes a NAR file like [List]
+// while computing the hash and size of the archive
+// (the NARHash and NARSize fields of a [nix.NARInfo]),
+// reading r only once.
+func IndexAndHash(typ nix.HashType, r io.Reader) (*Listing, nix.Hash, int64, error) {
+	h := nix.NewHasher(typ)
+	nr := NewReader(io.TeeReader(r, h))
+	ls, err := list(nr)
+	if err != nil {
+		return ls, nix.Hash{}, nr.off, err
+	}
+	return ls, h.SumHash(), nr.off, nil
+}
+
+// ListStream indexes a NAR file read from r
+// and writes the listing to w as JSON
+// that is byte-for-byte identical to the output of [json.Marshal]
+// on the [Listing] returned by [List].
+// Unlike List, ListStream writes the listing while it reads the archive,
+// so it only holds the current chain of open directories in memory.
+func ListStream(r io.Reader, w io.Writer) error {
 	nr := NewReader(r)
-	ls := new(Listing)
+	var buf []byte
+	// hasEntries records whether each open directory has had an entry written.
+	var hasEntries []bool
+	buf = append(buf, `{"version":1,"root":`...)
 	for {
 		hdr, err := nr.Next()
 		if err == io.EOF {
-			return ls, nil
+			break
 		}
 		if err != nil {
-			return ls, fmt.Errorf("index nar: %w", err)
+			return fmt.Errorf("index nar: %w", err)
 		}
 
-		if hdr.Path == "" {
-			ls.Root.Header = *hdr
+		depth := 0
+		if hdr.Path != "" {
+			depth = strings.Count(hdr.Path, "/") + 1
+		}
+		for len(hasEntries) > depth {
+			buf = append(buf, "}}"...)
+			hasEntries = hasEntries[:len(hasEntries)-1]
+		}
+		if hdr.Path != "" {
+			if hasEntries[len(hasEntries)-1] {
+				buf = append(buf, ',')
+			}
+			hasEntries[len(hasEntries)-1] = true
+			nameJSON, err := json.Marshal(slashpath.Base(hdr.Path))
+			if err != nil {
+				return fmt.Errorf("index nar: %s: %v", hdr.Path, err)
+			}
+			buf = append(buf, nameJSON...)
+			buf = append(buf, ':')
+		}
+		if hdr.Mode.IsDir() {
+			buf = append(buf, `{"type":"directory","entries":{`...)
+			hasEntries = append(hasEntries, false)
 		} else {
-			parent, name := slashpath.Split(hdr.Path)
-			parent = strings.TrimSuffix(parent, "/")
-			curr := ls.lookup(parent)
-			if curr.Entries == nil {
-				curr.Entries = make(map[string]*ListingNode)
+			node := &ListingNode{Header: *hdr}
+			buf, err = node.marshal(buf, listingMarshalOptions{})
+			if err != nil {
+				return fmt.Errorf("index nar: %v", err)
 			}
-			curr.Entries[name] = &ListingNode{Header: *hdr}
 		}
+
+		if _, err := w.Write(buf); err != nil {
+			return fmt.Errorf("index nar: %w", err)
+		}
+		buf = buf[:0]
+	}
+	for range hasEntries {
+		buf = append(buf, "}}"...)
+	}
+	buf = append(buf, '}')
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("index nar: %w", err)
+	}
+	return nil
+}
+
+func list(nr *Reader) (*Listing, error) {
+	ls := new(Listing)
+	for {
+		hdr, err := nr.Next()
+		if err == io.EOF {
+			return ls, nil
+		}
+		if err != nil {
+			return ls, fmt.Errorf("index nar: %w", err)
+		}
+
+		ls.add(hdr)
 	}
 }
 
+// add adds a copy of hdr to the listing.
+// hdr's parent directory must already be present in the listing.
+func (ls *Listing) add(hdr *Header) {
+	if hdr.Path == "" {
+		ls.Root.Header = *hdr
+		return
+	}
+	parent, name := slashpath.Split(hdr.Path)
+	parent = strings.TrimSuffix(parent, "/")
+	curr := ls.lookup(parent)
+	if curr.Entries == nil {
+		curr.Entries = make(map[string]*ListingNode)
+	}
+	curr.Entries[name] = &ListingNode{Header: *hdr}
+}
+
 // lookup returns the node for the given path or nil if not found.
 // The path is assumed to be an unrooted, slash-separated sequence of path elements,
 // like "x/y/z".
@@ -75,12 +167,281 @@ func (ls *Listing) lookup(path string) *ListingNode {
 	return curr
 }
 
+// Find returns the node at the given slash-separated path
+// (the empty string for the root).
+// Symlinks are not followed.
+// Find reports false if there is no file system object at path
+// or path is not in the form of [Header.Path].
+func (ls *Listing) Find(path string) (*ListingNode, bool) {
+	if validatePath(path) != nil {
+		return nil, false
+	}
+	node := ls.lookup(path)
+	return node, node != nil
+}
+
+// Walk calls fn for each file system object in the listing,
+// starting with the root,
+// with the object's path (as in [Header.Path]) and its node.
+// Directory entries are visited in lexical order and symlinks are not followed.
+// If fn returns [io/fs.SkipDir] when called on a directory,
+// Walk skips the directory's contents.
+// If fn returns [io/fs.SkipDir] when called on any other file system object,
+// Walk skips the remaining entries in its parent directory.
+// Any other error stops the walk and is returned by Walk.
+func (ls *Listing) Walk(fn func(path string, node *ListingNode) error) error {
+	err := walkListing("", &ls.Root, fn)
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkListing calls fn for node and its descendents in lexical order.
+// Descendents' paths are formed by joining their names to path.
+func walkListing(path string, node *ListingNode, fn func(path string, node *ListingNode) error) error {
+	if err := fn(path, node); err != nil || !node.Mode.IsDir() {
+		if err == fs.SkipDir && node.Mode.IsDir() {
+			return nil
+		}
+		return err
+	}
+	names := make([]string, 0, len(node.Entries))
+	for name := range node.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := walkListing(slashpath.Join(path, name), node.Entries[name], fn)
+		if err == fs.SkipDir {
+			// Returned for a non-directory: skip the rest of this directory.
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Children returns the immediate children of the directory at the given
+// slash-separated path (the empty string for the root),
+// sorted by name.
+// Children returns an error if there is no file system object at dir
+// or if it is not a directory.
+func (ls *Listing) Children(dir string) ([]*ListingNode, error) {
+	if err := validatePath(dir); err != nil {
+		return nil, fmt.Errorf("list nar directory: %v", err)
+	}
+	node := ls.lookup(dir)
+	if node == nil {
+		return nil, fmt.Errorf("list nar directory %s: %w", formatListingPath(dir), fs.ErrNotExist)
+	}
+	if !node.Mode.IsDir() {
+		return nil, fmt.Errorf("list nar directory %s: not a directory", formatListingPath(dir))
+	}
+	names := make([]string, 0, len(node.Entries))
+	for name := range node.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	children := make([]*ListingNode, 0, len(names))
+	for _, name := range names {
+		children = append(children, node.Entries[name])
+	}
+	return children, nil
+}
+
+// Graft inserts a copy of sub's tree into ls at the given slash-separated prefix,
+// creating any intermediate directories that do not exist.
+// For example, grafting a listing with a single file at its root
+// with a prefix of "opt/foo" creates the "opt" directory (if needed)
+// and places the file at "opt/foo".
+// Graft returns an error if ls's root is not a directory,
+// if a file system object already exists at the prefix,
+// or if one of the intermediate path elements is not a directory.
+//
+// The ContentOffset fields of the grafted nodes are not changed,
+// so they continue to refer to positions in sub's NAR file.
+func (ls *Listing) Graft(prefix string, sub *Listing) error {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return fmt.Errorf("graft nar listing: empty prefix")
+	}
+	if err := validatePath(prefix); err != nil {
+		return fmt.Errorf("graft nar listing: %v", err)
+	}
+	if !ls.Root.Mode.IsDir() {
+		return fmt.Errorf("graft nar listing: root is not a directory")
+	}
+
+	parentPath, name := slashpath.Split(prefix)
+	curr := &ls.Root
+	for parentPath != "" {
+		elem := firstPathComponent(parentPath)
+		parentPath = strings.TrimPrefix(parentPath[len(elem):], "/")
+		next := curr.Entries[elem]
+		if next == nil {
+			var nextPath string
+			if curr.Path == "" {
+				nextPath = elem
+			} else {
+				nextPath = curr.Path + "/" + elem
+			}
+			next = &ListingNode{Header: Header{Path: nextPath, Mode: modeDirectory}}
+			if curr.Entries == nil {
+				curr.Entries = make(map[string]*ListingNode)
+			}
+			curr.Entries[elem] = next
+		} else if !next.Mode.IsDir() {
+			return fmt.Errorf("graft nar listing: %s is not a directory", next.Path)
+		}
+		curr = next
+	}
+	if curr.Entries[name] != nil {
+		return fmt.Errorf("graft nar listing: %s already exists", prefix)
+	}
+	if curr.Entries == nil {
+		curr.Entries = make(map[string]*ListingNode)
+	}
+	curr.Entries[name] = sub.Root.cloneWithPrefix(prefix)
+	return nil
+}
+
+// cloneWithPrefix returns a deep copy of node
+// with prefix prepended to the paths of node and all its descendents.
+func (node *ListingNode) cloneWithPrefix(prefix string) *ListingNode {
+	newNode := &ListingNode{Header: node.Header}
+	if node.Path == "" {
+		newNode.Path = prefix
+	} else {
+		newNode.Path = prefix + "/" + node.Path
+	}
+	if node.Entries != nil {
+		newNode.Entries = make(map[string]*ListingNode, len(node.Entries))
+		for name, child := range node.Entries {
+			newNode.Entries[name] = child.cloneWithPrefix(prefix)
+		}
+	}
+	return newNode
+}
+
+// VerifyAgainstNAR reads the NAR file from r
+// and reports an error if it does not match the listing.
+// Every file system object in the archive must be present in the listing
+// with the same type, executable bit, size, symlink target, and content offset,
+// and every object in the listing must be present in the archive.
+// The error names the first mismatched path.
+func (ls *Listing) VerifyAgainstNAR(r io.Reader) error {
+	nr := NewReader(r)
+	seen := make(map[string]struct{})
+	for {
+		hdr, err := nr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("verify nar listing: %w", err)
+		}
+		seen[hdr.Path] = struct{}{}
+		node := ls.lookup(hdr.Path)
+		if node == nil {
+			return fmt.Errorf("verify nar listing: %s: not in listing", formatListingPath(hdr.Path))
+		}
+		if err := node.verifyHeader(hdr); err != nil {
+			return fmt.Errorf("verify nar listing: %s: %v", formatListingPath(hdr.Path), err)
+		}
+	}
+	if missing, ok := ls.Root.findUnseen(seen); ok {
+		return fmt.Errorf("verify nar listing: %s: not in archive", formatListingPath(missing))
+	}
+	return nil
+}
+
+// verifyHeader returns an error if hdr does not match the node.
+func (node *ListingNode) verifyHeader(hdr *Header) error {
+	if got, want := hdr.Mode.Type(), node.Mode.Type(); got != want {
+		return fmt.Errorf("type is %s in archive, %s in listing", nodeTypeName(got), nodeTypeName(want))
+	}
+	switch node.Mode.Type() {
+	case 0:
+		if got, want := hdr.Mode&0o111 != 0, node.Mode&0o111 != 0; got != want {
+			return fmt.Errorf("executable is %t in archive, %t in listing", got, want)
+		}
+		if hdr.Size != node.Size {
+			return fmt.Errorf("size is %d in archive, %d in listing", hdr.Size, node.Size)
+		}
+		if hdr.ContentOffset != node.ContentOffset {
+			return fmt.Errorf("content offset is %d in archive, %d in listing", hdr.ContentOffset, node.ContentOffset)
+		}
+	case fs.ModeSymlink:
+		if hdr.LinkTarget != node.LinkTarget {
+			return fmt.Errorf("target is %q in archive, %q in listing", hdr.LinkTarget, node.LinkTarget)
+		}
+	}
+	return nil
+}
+
+// findUnseen returns the path of the first node in NAR order
+// (node itself, then its entries sorted by name)
+// whose path is not in seen.
+func (node *ListingNode) findUnseen(seen map[string]struct{}) (path string, ok bool) {
+	if _, found := seen[node.Path]; !found {
+		return node.Path, true
+	}
+	names := make([]string, 0, len(node.Entries))
+	for name := range node.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if path, ok := node.Entries[name].findUnseen(seen); ok {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+func nodeTypeName(typ fs.FileMode) string {
+	switch typ {
+	case 0:
+		return typeRegular
+	case fs.ModeDir:
+		return typeDirectory
+	case fs.ModeSymlink:
+		return typeSymlink
+	default:
+		return typ.String()
+	}
+}
+
+// formatListingPath returns a human-readable form of a path in a listing.
+func formatListingPath(path string) string {
+	if path == "" {
+		return "<root>"
+	}
+	return path
+}
+
 // MarshalJSON encodes a listing to JSON.
+// It is equivalent to calling [Listing.MarshalJSONWithOptions] with includeOffsets set to true.
+// The output contains no whitespace and directory entries are sorted by name,
+// so marshaling the same listing always produces the same bytes.
+// Object keys are written in the same order as Nix
+// (e.g. "type" first); use [Listing.CanonicalJSON] for sorted keys.
 func (ls *Listing) MarshalJSON() ([]byte, error) {
+	return ls.MarshalJSONWithOptions(true)
+}
+
+// MarshalJSONWithOptions encodes a listing to JSON.
+// If includeOffsets is false, the "narOffset" field is omitted from regular files.
+// This is useful for listings of archives that will be recompressed,
+// where offsets into the archive are not meaningful.
+func (ls *Listing) MarshalJSONWithOptions(includeOffsets bool) ([]byte, error) {
 	var buf []byte
 	var err error
 	buf = append(buf, `{"version":1,"root":`...)
-	buf, err = ls.Root.marshal(buf)
+	buf, err = ls.Root.marshal(buf, listingMarshalOptions{omitOffsets: !includeOffsets})
 	if err != nil {
 		return nil, err
 	}
@@ -88,6 +449,24 @@ func (ls *Listing) MarshalJSON() ([]byte, error) {
 	return buf, nil
 }
 
+// CanonicalJSON encodes a listing to canonical JSON:
+// object keys are sorted, directory entries are sorted by name,
+// and there is no insignificant whitespace.
+// The output is produced without relying on [encoding/json] ordering,
+// so it is byte-for-byte stable across Go versions
+// and suitable for hashing or signing.
+func (ls *Listing) CanonicalJSON() ([]byte, error) {
+	var buf []byte
+	var err error
+	buf = append(buf, `{"root":`...)
+	buf, err = ls.Root.marshal(buf, listingMarshalOptions{sortKeys: true})
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, `,"version":1}`...)
+	return buf, nil
+}
+
 // UnmarshalJSON decodes a listing from JSON.
 func (ls *Listing) UnmarshalJSON(data []byte) error {
 	var object map[string]json.RawMessage
@@ -126,24 +505,52 @@ type ListingNode struct {
 	Entries map[string]*ListingNode
 }
 
-func (node *ListingNode) marshal(dst []byte) ([]byte, error) {
-	dst = append(dst, `{"type":"`...)
+// listingMarshalOptions is the set of options for [ListingNode.marshal].
+type listingMarshalOptions struct {
+	omitOffsets bool
+	// sortKeys causes object keys to be written in sorted order.
+	// Otherwise, "type" is written first to match Nix.
+	sortKeys bool
+}
+
+func (node *ListingNode) marshal(dst []byte, opts listingMarshalOptions) ([]byte, error) {
+	var typ string
+	switch node.Mode.Type() {
+	case 0:
+		typ = typeRegular
+	case fs.ModeDir:
+		typ = typeDirectory
+	case fs.ModeSymlink:
+		typ = typeSymlink
+	default:
+		return dst, fmt.Errorf("marshal nar listing: unknown type %v", node.Mode)
+	}
+	dst = append(dst, '{')
+	if !opts.sortKeys {
+		dst = append(dst, `"type":"`...)
+		dst = append(dst, typ...)
+		dst = append(dst, `",`...)
+	}
 	switch node.Mode.Type() {
 	case 0:
-		dst = append(dst, typeRegular...)
-		dst = append(dst, `","executable":`...)
+		dst = append(dst, `"executable":`...)
 		if node.Mode&0o111 != 0 {
 			dst = append(dst, "true"...)
 		} else {
 			dst = append(dst, "false"...)
 		}
+		if opts.sortKeys && !opts.omitOffsets {
+			dst = append(dst, `,"narOffset":`...)
+			dst = strconv.AppendInt(dst, node.ContentOffset, 10)
+		}
 		dst = append(dst, `,"size":`...)
 		dst = strconv.AppendInt(dst, node.Size, 10)
-		dst = append(dst, `,"narOffset":`...)
-		dst = strconv.AppendInt(dst, node.ContentOffset, 10)
+		if !opts.sortKeys && !opts.omitOffsets {
+			dst = append(dst, `,"narOffset":`...)
+			dst = strconv.AppendInt(dst, node.ContentOffset, 10)
+		}
 	case fs.ModeDir:
-		dst = append(dst, typeDirectory...)
-		dst = append(dst, `","entries":{`...)
+		dst = append(dst, `"entries":{`...)
 		names := make([]string, 0, len(node.Entries))
 		for name := range node.Entries {
 			names = append(names, name)
@@ -159,15 +566,14 @@ func (node *ListingNode) marshal(dst []byte) ([]byte, error) {
 			}
 			dst = append(dst, nameJSON...)
 			dst = append(dst, ':')
-			dst, err = node.Entries[name].marshal(dst)
+			dst, err = node.Entries[name].marshal(dst, opts)
 			if err != nil {
 				return nil, err
 			}
 		}
 		dst = append(dst, '}')
 	case fs.ModeSymlink:
-		dst = append(dst, typeSymlink...)
-		dst = append(dst, `","target":`...)
+		dst = append(dst, `"target":`...)
 		if node.LinkTarget == "" {
 			return dst, fmt.Errorf("marshal nar listing: symlink target empty")
 		}
@@ -176,8 +582,11 @@ func (node *ListingNode) marshal(dst []byte) ([]byte, error) {
 			return dst, fmt.Errorf("marshal nar listing: target: %v", err)
 		}
 		dst = append(dst, targetString...)
-	default:
-		return dst, fmt.Errorf("marshal nar listing: unknown type %v", node.Mode)
+	}
+	if opts.sortKeys {
+		dst = append(dst, `,"type":"`...)
+		dst = append(dst, typ...)
+		dst = append(dst, '"')
 	}
 	dst = append(dst, '}')
 	return dst, nil
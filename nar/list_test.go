@@ -3,13 +3,17 @@ package nar
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"zombiezen.com/go/nix"
 )
 
 func TestList(t *testing.T) {
@@ -28,13 +32,41 @@ func TestList(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			if diff := cmp.Diff(&test.wantList, got, cmpopts.EquateEmpty()); diff != "" {
+			if diff := cmp.Diff(&test.wantList, got, cmpopts.EquateEmpty(), ignoreHeaderOffset); diff != "" {
 				t.Errorf("-want +got:\n%s", diff)
 			}
 		})
 	}
 }
 
+func TestIndexAndHash(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantListing, err := List(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := nix.NewHasher(nix.SHA256)
+	h.Write(data)
+	wantHash := h.SumHash()
+
+	gotListing, gotHash, gotSize, err := IndexAndHash(nix.SHA256, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantListing, gotListing, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("listing (-want +got):\n%s", diff)
+	}
+	if !gotHash.Equal(wantHash) {
+		t.Errorf("hash = %v; want %v", gotHash, wantHash)
+	}
+	if gotSize != int64(len(data)) {
+		t.Errorf("size = %d; want %d", gotSize, len(data))
+	}
+}
+
 const testListingJSON = `
 {
   "version": 1,
@@ -110,6 +142,116 @@ func TestListingMarshalJSON(t *testing.T) {
 	}
 }
 
+func TestListStream(t *testing.T) {
+	for _, test := range narTests {
+		if test.err {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", test.dataFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ls, err := List(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.Marshal(ls)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := new(bytes.Buffer)
+			if err := ListStream(bytes.NewReader(data), got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(want), got.String()); diff != "" {
+				t.Errorf("-json.Marshal(List(...)) +ListStream(...):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("testdata", "invalid-order.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ListStream(bytes.NewReader(data), io.Discard); err == nil {
+			t.Error("ListStream did not return an error")
+		}
+	})
+}
+
+func TestListingMarshalJSONWithOptions(t *testing.T) {
+	withOffsets, err := wantListing().MarshalJSONWithOptions(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultJSON, err := wantListing().MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(withOffsets, defaultJSON) {
+		t.Errorf("MarshalJSONWithOptions(true) = %s; want %s", withOffsets, defaultJSON)
+	}
+	if !bytes.Contains(withOffsets, []byte(`"narOffset"`)) {
+		t.Errorf("MarshalJSONWithOptions(true) = %s; missing narOffset", withOffsets)
+	}
+
+	withoutOffsets, err := wantListing().MarshalJSONWithOptions(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(withoutOffsets, []byte(`"narOffset"`)) {
+		t.Errorf("MarshalJSONWithOptions(false) = %s; contains narOffset", withoutOffsets)
+	}
+	got := new(Listing)
+	if err := json.Unmarshal(withoutOffsets, got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantListing(), got, cmpopts.EquateEmpty(), cmpopts.IgnoreFields(Header{}, "ContentOffset")); diff != "" {
+		t.Errorf("round trip (-want +got):\n%s", diff)
+	}
+}
+
+func TestListingMarshalJSONStable(t *testing.T) {
+	const want = `{"version":1,"root":{"type":"directory","entries":{` +
+		`"bin":{"type":"directory","entries":{"curl":{"type":"regular","executable":true,"size":182520,"narOffset":400}}},` +
+		`"sbin":{"type":"symlink","target":"bin"}}}}`
+	for i := 0; i < 10; i++ {
+		got, err := wantListing().MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("MarshalJSON() #%d = %s; want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestListingCanonicalJSON(t *testing.T) {
+	const want = `{"root":{"entries":{` +
+		`"bin":{"entries":{"curl":{"executable":true,"narOffset":400,"size":182520,"type":"regular"}},"type":"directory"},` +
+		`"sbin":{"target":"bin","type":"symlink"}},"type":"directory"},"version":1}`
+	for i := 0; i < 10; i++ {
+		got, err := wantListing().CanonicalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("CanonicalJSON() #%d = %s; want %s", i+1, got, want)
+		}
+	}
+
+	got := new(Listing)
+	if err := json.Unmarshal([]byte(want), got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantListing(), got, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("round trip (-want +got):\n%s", diff)
+	}
+}
+
 func TestListingUnmarshalJSON(t *testing.T) {
 	got := new(Listing)
 	if err := json.Unmarshal([]byte(testListingJSON), &got); err != nil {
@@ -121,6 +263,301 @@ func TestListingUnmarshalJSON(t *testing.T) {
 	}
 }
 
+func TestListingChildren(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ls, err := List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir  string
+		want []string
+		err  bool
+	}{
+		{dir: "", want: []string{"bin", "sbin", "share"}},
+		{dir: "share/man", want: []string{"share/man/man1", "share/man/man5", "share/man/man8"}},
+		{dir: "share/man/man5", want: []string{"share/man/man5/ethers.5.gz"}},
+		{dir: "share/man/man5/ethers.5.gz", err: true},
+		{dir: "bin/dnsdomainname", err: true},
+		{dir: "nonexistent", err: true},
+		{dir: "share/../bin", err: true},
+	}
+	for _, test := range tests {
+		children, err := ls.Children(test.dir)
+		if test.err {
+			if err == nil {
+				t.Errorf("ls.Children(%q) = %d children, <nil>; want _, <error>", test.dir, len(children))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ls.Children(%q): %v", test.dir, err)
+			continue
+		}
+		var got []string
+		for _, child := range children {
+			got = append(got, child.Path)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("ls.Children(%q) paths (-want +got):\n%s", test.dir, diff)
+		}
+	}
+}
+
+func TestListingFind(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ls, err := List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		wantMode fs.FileMode
+		ok       bool
+	}{
+		{path: "", wantMode: fs.ModeDir | 0o555, ok: true},
+		{path: "bin/hostname", wantMode: 0o555, ok: true},
+		{path: "sbin", wantMode: fs.ModeSymlink | 0o777, ok: true},
+		{path: "share/man/man5/ethers.5.gz", wantMode: 0o444, ok: true},
+		{path: "sbin/hostname"},
+		{path: "nonexistent"},
+		{path: "bin/../sbin"},
+		{path: "/bin"},
+	}
+	for _, test := range tests {
+		node, ok := ls.Find(test.path)
+		if ok != test.ok {
+			t.Errorf("ls.Find(%q) = _, %t; want _, %t", test.path, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if node.Path != test.path || node.Mode != test.wantMode {
+			t.Errorf("ls.Find(%q) = {Path: %q, Mode: %v}, true; want {Path: %q, Mode: %v}, true",
+				test.path, node.Path, node.Mode, test.path, test.wantMode)
+		}
+	}
+}
+
+func TestListingWalk(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ls, err := List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = ls.Walk(func(path string, node *ListingNode) error {
+		if path != node.Path {
+			t.Errorf("Walk called with path %q for node %q", path, node.Path)
+		}
+		got = append(got, path)
+		if path == "bin" || path == "share/man/man8" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"",
+		"bin",
+		"sbin",
+		"share",
+		"share/man",
+		"share/man/man1",
+		"share/man/man1/dnsdomainname.1.gz",
+		"share/man/man1/domainname.1.gz",
+		"share/man/man1/hostname.1.gz",
+		"share/man/man1/nisdomainname.1.gz",
+		"share/man/man1/ypdomainname.1.gz",
+		"share/man/man5",
+		"share/man/man5/ethers.5.gz",
+		"share/man/man8",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("visited paths (-want +got):\n%s", diff)
+	}
+
+	// SkipDir on a file skips the rest of its parent directory, as in fs.WalkDir.
+	got = nil
+	err = ls.Walk(func(path string, node *ListingNode) error {
+		got = append(got, path)
+		switch path {
+		case "bin", "share/man/man1/domainname.1.gz", "share/man/man8":
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"",
+		"bin",
+		"sbin",
+		"share",
+		"share/man",
+		"share/man/man1",
+		"share/man/man1/dnsdomainname.1.gz",
+		"share/man/man1/domainname.1.gz",
+		"share/man/man5",
+		"share/man/man5/ethers.5.gz",
+		"share/man/man8",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("visited paths after SkipDir on a file (-want +got):\n%s", diff)
+	}
+
+	errStop := errors.New("stop")
+	err = ls.Walk(func(path string, node *ListingNode) error {
+		if path == "sbin" {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("Walk(...) = %v; want %v", err, errStop)
+	}
+}
+
+func TestListingGraft(t *testing.T) {
+	sub := &Listing{Root: ListingNode{Header: Header{
+		Mode:          0o444,
+		Size:          int64(len(helloWorld)),
+		ContentOffset: 96,
+	}}}
+
+	ls := wantListing()
+	if err := ls.Graft("opt/hello.txt", sub); err != nil {
+		t.Fatal(err)
+	}
+	want := wantListing()
+	want.Root.Entries["opt"] = &ListingNode{
+		Header: Header{
+			Path: "opt",
+			Mode: fs.ModeDir | 0o555,
+		},
+		Entries: map[string]*ListingNode{
+			"hello.txt": {Header: Header{
+				Path:          "opt/hello.txt",
+				Mode:          0o444,
+				Size:          int64(len(helloWorld)),
+				ContentOffset: 96,
+			}},
+		},
+	}
+	if diff := cmp.Diff(want, ls, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("-want +got:\n%s", diff)
+	}
+
+	if err := ls.Graft("opt/hello.txt", sub); err == nil {
+		t.Error("Grafting onto existing path did not return an error")
+	}
+	if err := ls.Graft("sbin/hello.txt", sub); err == nil {
+		t.Error("Grafting under symlink did not return an error")
+	}
+}
+
+func TestListingVerifyAgainstNAR(t *testing.T) {
+	narData, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newListing := func(t *testing.T) *Listing {
+		ls, err := List(bytes.NewReader(narData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ls
+	}
+
+	t.Run("Match", func(t *testing.T) {
+		if err := newListing(t).VerifyAgainstNAR(bytes.NewReader(narData)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		tamper func(ls *Listing)
+		path   string
+	}{
+		{
+			name: "Size",
+			tamper: func(ls *Listing) {
+				ls.Root.Entries["hello.txt"].Size++
+			},
+			path: "hello.txt",
+		},
+		{
+			name: "Offset",
+			tamper: func(ls *Listing) {
+				ls.Root.Entries["a.txt"].ContentOffset += 8
+			},
+			path: "a.txt",
+		},
+		{
+			name: "Executable",
+			tamper: func(ls *Listing) {
+				ls.Root.Entries["bin"].Entries["hello.sh"].Mode = modeRegular
+			},
+			path: "bin/hello.sh",
+		},
+		{
+			name: "Type",
+			tamper: func(ls *Listing) {
+				ls.Root.Entries["bin"].Mode = modeSymlink
+				ls.Root.Entries["bin"].LinkTarget = "."
+			},
+			path: "bin",
+		},
+		{
+			name: "Missing",
+			tamper: func(ls *Listing) {
+				delete(ls.Root.Entries, "a.txt")
+			},
+			path: "a.txt",
+		},
+		{
+			name: "Extra",
+			tamper: func(ls *Listing) {
+				ls.Root.Entries["zzz"] = &ListingNode{Header: Header{Path: "zzz", Mode: modeRegular}}
+			},
+			path: "zzz",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ls := newListing(t)
+			test.tamper(ls)
+			err := ls.VerifyAgainstNAR(bytes.NewReader(narData))
+			if err == nil {
+				t.Fatal("VerifyAgainstNAR did not return an error")
+			}
+			if got := err.Error(); !strings.Contains(got, test.path+":") {
+				t.Errorf("VerifyAgainstNAR(...) = %v; want error mentioning %q", err, test.path)
+			}
+		})
+	}
+}
+
 func parseJSONTestValue(data []byte) (any, error) {
 	d := json.NewDecoder(bytes.NewReader(data))
 	d.UseNumber()
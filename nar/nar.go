@@ -16,6 +16,8 @@ import (
 	"strings"
 	"time"
 	"unicode/utf8"
+
+	"zombiezen.com/go/nix"
 )
 
 // Extension is the file extension for a file containing a Nix Archive.
@@ -40,6 +42,10 @@ type Header struct {
 	// Size is the size of a regular file in bytes.
 	Size int64
 	// LinkTarget is the target of a symlink.
+	// Targets are arbitrary byte strings:
+	// [Reader] returns them exactly as stored in the archive
+	// (they need not be UTF-8 or name an existing file)
+	// and only enforces a maximum length.
 	LinkTarget string
 	// ContentOffset is the position in the NAR file
 	// (in bytes from the beginning of the NAR file)
@@ -48,6 +54,133 @@ type Header struct {
 	//
 	// This field is ignored by [Writer.WriteHeader].
 	ContentOffset int64
+	// HeaderOffset is the position in the NAR file
+	// (in bytes from the beginning of the NAR file)
+	// of the opening parenthesis token of the file system object's node.
+	// It is populated by [Reader.Next] for every type of file system object.
+	//
+	// This field is ignored by [Writer.WriteHeader].
+	HeaderOffset int64
+	// ArchivePath is the path of the file system object as stored in the archive
+	// if it differs from Path.
+	// It is only populated by a [Reader] that has case-hack suffixes enabled
+	// (see [NewReaderOptions]);
+	// Path is then the logical path with the suffixes removed.
+	//
+	// This field is ignored by [Writer.WriteHeader].
+	ArchivePath string
+	// ModTime is the modification time reported by [Header.FileInfo].
+	// NAR archives do not store timestamps,
+	// so [Reader] never sets it and [Writer.WriteHeader] ignores it.
+	// It allows callers that restore archives to a file system
+	// to apply a fixed timestamp (like SOURCE_DATE_EPOCH).
+	// If ModTime is the zero time, FileInfo reports the Unix epoch.
+	ModTime time.Time
+}
+
+// AbsolutePath returns the absolute slash-separated path of the file system object
+// if the archive is the contents of the given store object.
+// For example, a header with the Path "bin/hello" and the store path
+// "/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1"
+// has the absolute path
+// "/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1/bin/hello".
+func (h *Header) AbsolutePath(storePath nix.StorePath) string {
+	if h.Path == "" {
+		return string(storePath)
+	}
+	return string(storePath) + "/" + h.Path
+}
+
+// NormalizePath converts h.Path into the form expected by [Writer.WriteHeader]:
+// backslashes are converted to forward slashes,
+// the path is cleaned as if by [path.Clean],
+// and leading slashes and "." are removed.
+// This is useful for paths produced by the path/filepath package on Windows.
+// Backslashes are valid characters in NAR filenames,
+// so NormalizePath must not be used on paths that may legitimately contain them.
+func (h *Header) NormalizePath() {
+	p := slashpath.Clean(strings.ReplaceAll(h.Path, `\`, "/"))
+	p = strings.TrimLeft(p, "/")
+	if p == "." {
+		p = ""
+	}
+	h.Path = p
+}
+
+// Validate checks h for inconsistencies that would produce
+// a structurally valid but semantically wrong archive,
+// like a symlink without a target or a directory with a size.
+// It also checks that h.Path is in the form [Writer.WriteHeader] accepts.
+// [Writer] only calls Validate if [Writer.StrictHeaders] has been called.
+func (h *Header) Validate() error {
+	if err := validatePath(h.Path); err != nil {
+		return fmt.Errorf("nar: %v", err)
+	}
+	typ := h.Mode.Type()
+	switch typ {
+	case 0:
+		if h.Size < 0 {
+			return fmt.Errorf("nar: %s: negative size", formatLastPath(h.Path))
+		}
+		if h.LinkTarget != "" {
+			return fmt.Errorf("nar: %s: type is regular, but LinkTarget is not empty", formatLastPath(h.Path))
+		}
+	case fs.ModeDir:
+		if h.Size != 0 {
+			return fmt.Errorf("nar: %s: type is directory, but Size is not 0", formatLastPath(h.Path))
+		}
+		if h.LinkTarget != "" {
+			return fmt.Errorf("nar: %s: type is directory, but LinkTarget is not empty", formatLastPath(h.Path))
+		}
+	case fs.ModeSymlink:
+		if h.Size != 0 {
+			return fmt.Errorf("nar: %s: type is symlink, but Size is not 0", formatLastPath(h.Path))
+		}
+		if h.LinkTarget == "" {
+			return fmt.Errorf("nar: %s: type is symlink, but LinkTarget is empty", formatLastPath(h.Path))
+		}
+		if len(h.LinkTarget) > symlinkTargetMaxLen {
+			return fmt.Errorf("nar: %s: LinkTarget longer than %d bytes", formatLastPath(h.Path), symlinkTargetMaxLen)
+		}
+	default:
+		return fmt.Errorf("nar: %s: unsupported type %v", formatLastPath(h.Path), typ)
+	}
+	return nil
+}
+
+// Permission bits that Nix applies to file system objects
+// when it restores them from a NAR archive,
+// as returned by [Header.UnixMode].
+// The NAR format only records whether a regular file is executable,
+// so these are the only permissions a restored object can have.
+const (
+	RegularPerm    uint32 = 0o444
+	ExecutablePerm uint32 = 0o555
+	DirectoryPerm  uint32 = 0o555
+	SymlinkPerm    uint32 = 0o777
+)
+
+// UnixMode returns the permission bits that Nix uses
+// when restoring the file system object described by h:
+// [RegularPerm] for a non-executable regular file,
+// [ExecutablePerm] for a regular file with any executable bits set in h.Mode,
+// [DirectoryPerm] for a directory,
+// and [SymlinkPerm] for a symlink.
+// UnixMode returns 0 if h.Mode has an unknown type.
+func (h *Header) UnixMode() uint32 {
+	switch h.Mode.Type() {
+	case 0:
+		if h.Mode&0o111 != 0 {
+			return ExecutablePerm
+		}
+		return RegularPerm
+	case fs.ModeDir:
+		return DirectoryPerm
+	case fs.ModeSymlink:
+		return SymlinkPerm
+	default:
+		return 0
+	}
 }
 
 // Modes returned from parsing,
@@ -68,11 +201,17 @@ type headerFileInfo struct {
 	h *Header
 }
 
-func (fi headerFileInfo) Mode() fs.FileMode  { return fi.h.Mode }
-func (fi headerFileInfo) Size() int64        { return fi.h.Size }
-func (fi headerFileInfo) IsDir() bool        { return fi.h.Mode.IsDir() }
-func (fi headerFileInfo) ModTime() time.Time { return time.Unix(0, 0) }
-func (fi headerFileInfo) Sys() any           { return fi.h }
+func (fi headerFileInfo) Mode() fs.FileMode { return fi.h.Mode }
+func (fi headerFileInfo) Size() int64       { return fi.h.Size }
+func (fi headerFileInfo) IsDir() bool       { return fi.h.Mode.IsDir() }
+func (fi headerFileInfo) Sys() any          { return fi.h }
+
+func (fi headerFileInfo) ModTime() time.Time {
+	if fi.h.ModTime.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return fi.h.ModTime
+}
 
 func (fi headerFileInfo) Name() string {
 	if fi.h.Path == "" {
@@ -105,6 +244,22 @@ const (
 	symlinkTargetMaxLen = 4095
 )
 
+// caseHackSuffix is the separator Nix inserts into directory entry names
+// that differ only by case
+// when its use-case-hack setting is enabled.
+// It is followed by a decimal number.
+const caseHackSuffix = "~nix~case~hack~"
+
+// stripCaseHack returns name with any case-hack suffix removed.
+// suffix is normally [caseHackSuffix].
+func stripCaseHack(name, suffix string) string {
+	i := strings.Index(name, suffix)
+	if i < 0 {
+		return name
+	}
+	return name[:i]
+}
+
 const stringAlign = 8
 
 // padStringSize returns the smallest integer >= n
@@ -1,18 +1,58 @@
 package nar
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"strings"
-)
 
-var (
-	errInvalid      = errors.New("nar: invalid data")
-	errTrailingData = errors.New("nar: trailing data")
+	"zombiezen.com/go/nix"
 )
 
+var errTrailingData = errors.New("trailing data")
+
+// ErrNotRegularFile is returned by [Reader.WriteCurrentFileTo]
+// if the current file system object is not a regular file.
+var ErrNotRegularFile = errors.New("nar: not a regular file")
+
+// ErrFileTooLarge is returned by [Reader.Next]
+// if the archive exceeds a limit set by
+// [Reader.SetMaxFileSize] or [Reader.SetMaxTotalSize].
+var ErrFileTooLarge = errors.New("nar: file too large")
+
+// ReadError is the error type returned by [Reader] methods
+// when the archive cannot be read,
+// either because the underlying reader failed
+// or because the data is not a valid NAR archive.
+// Truncated archives can be detected with
+// errors.Is(err, io.ErrUnexpectedEOF).
+type ReadError struct {
+	// Offset is the position in the NAR file
+	// (in bytes from the beginning of the NAR file)
+	// just past the last byte the Reader consumed before the error.
+	Offset int64
+	// Op is the operation that failed (e.g. "next" or "read").
+	Op string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns a message describing the error.
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("nar: %s at offset %d: %v", e.Op, e.Offset, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
 const (
 	readerStateFirst int8 = iota
 	readerStateFile
@@ -36,6 +76,24 @@ type Reader struct {
 	state int8
 
 	allowTrailingData bool
+	// requireZeroPadding is true if padding bytes must be zero.
+	requireZeroPadding bool
+	// maxFilename is the maximum length of a directory entry name.
+	// Zero means entryNameMaxLen.
+	maxFilename int
+	// maxSymlinkTarget is the maximum length of a symlink target.
+	// Zero means symlinkTargetMaxLen.
+	maxSymlinkTarget int
+	// caseHack is true if case-hack suffixes should be removed from entry names.
+	caseHack bool
+	// maxFileSize is the maximum size of a single regular file.
+	// Zero means unlimited.
+	maxFileSize int64
+	// maxTotalSize is the maximum sum of all regular files' sizes (including padding).
+	// Zero means unlimited.
+	maxTotalSize int64
+	// onSymlink is called for each symlink encountered (if not nil).
+	onSymlink func(path, target string)
 
 	// padding is the number of padding bytes that trail after the file contents
 	// (only valid if state == readerStateFile).
@@ -49,13 +107,93 @@ type Reader struct {
 	prefix string
 	// nameStack contains the last encountered name for each open directory.
 	nameStack []string
+	// archivePrefix is the current directory's path as stored in the archive
+	// including a trailing slash (only valid if caseHack is true).
+	archivePrefix string
+	// caseHackNames contains the set of entry names with case-hack suffixes removed
+	// for each open directory (only valid if caseHack is true).
+	caseHackNames []map[string]struct{}
 	// err is the error to return for future calls to Next or Read.
 	err error
+	// skip is used to discard the remainder of a file in Next.
+	// It is stored in the Reader to avoid an allocation per call.
+	skip io.LimitedReader
+	// stats holds the counts returned by Stats.
+	stats ReaderStats
+	// totalSize is the sum of all regular files' sizes (including padding)
+	// encountered so far.
+	totalSize int64
+}
+
+// ReaderStats is a set of counts of the data a [Reader] has parsed.
+type ReaderStats struct {
+	// Directories is the number of directory headers read.
+	Directories int64
+	// Files is the number of regular file headers read.
+	Files int64
+	// Symlinks is the number of symlink headers read.
+	Symlinks int64
+	// ContentBytes is the sum of the sizes of all regular files read,
+	// including any file contents that were skipped over.
+	ContentBytes int64
+	// Tokens is the number of length-prefixed tokens read,
+	// counting each file's contents as a single token.
+	Tokens int64
+}
+
+// NewReaderOptions is the set of optional parameters to [NewReaderWithOptions].
+type NewReaderOptions struct {
+	// CaseHackSuffix indicates whether the Reader should remove case-hack suffixes
+	// (like "~nix~case~hack~1") from directory entry names,
+	// mirroring Nix's use-case-hack setting.
+	// Nix adds these suffixes to names that differ only by case
+	// so that they can coexist on case-insensitive file systems.
+	// When a suffix is removed, [Header.Path] is the logical path
+	// and [Header.ArchivePath] is the path as stored in the archive.
+	// [Reader.Next] returns an error if two entries in the same directory
+	// have the same name after removing suffixes.
+	CaseHackSuffix bool
 }
 
 // NewReader creates a new [Reader] reading from r.
 func NewReader(r io.Reader) *Reader {
-	return &Reader{r: r}
+	return NewReaderWithOptions(r, nil)
+}
+
+// NewReaderWithOptions creates a new [Reader] reading from r
+// with the given options.
+// A nil opts is equivalent to a zero NewReaderOptions,
+// which behaves like NewReader.
+func NewReaderWithOptions(r io.Reader, opts *NewReaderOptions) *Reader {
+	return &Reader{
+		r:        r,
+		caseHack: opts != nil && opts.CaseHackSuffix,
+	}
+}
+
+// Reset discards the Reader's state and makes it equivalent
+// to the result of [NewReaderWithOptions] on r,
+// except that options set by [NewReaderOptions]
+// or by methods like [Reader.AllowTrailingData]
+// and [Reader.SetMaxFilename] are preserved.
+// Any error from a previous archive is cleared.
+// Reset allows reusing a Reader's memory across many archives.
+func (nr *Reader) Reset(r io.Reader) {
+	for i := range nr.nameStack {
+		nr.nameStack[i] = "" // clear for GC
+	}
+	*nr = Reader{
+		r:                  r,
+		allowTrailingData:  nr.allowTrailingData,
+		requireZeroPadding: nr.requireZeroPadding,
+		maxFilename:        nr.maxFilename,
+		maxSymlinkTarget:   nr.maxSymlinkTarget,
+		caseHack:           nr.caseHack,
+		maxFileSize:        nr.maxFileSize,
+		maxTotalSize:       nr.maxTotalSize,
+		onSymlink:          nr.onSymlink,
+		nameStack:          nr.nameStack[:0],
+	}
 }
 
 // AllowTrailingData causes the Reader to halt reading
@@ -66,28 +204,123 @@ func (nr *Reader) AllowTrailingData() {
 	nr.allowTrailingData = true
 }
 
+// Stats returns counts of the data the Reader has parsed so far.
+func (nr *Reader) Stats() ReaderStats {
+	return nr.stats
+}
+
+// RequireZeroPadding causes the Reader to verify
+// that the padding bytes after strings and file contents are all zero,
+// as they always are in archives produced by Nix.
+// Non-zero padding usually indicates corruption,
+// so [Reader.Next] returns an error if it encounters any.
+// By default, the Reader ignores the values of padding bytes.
+func (nr *Reader) RequireZeroPadding() {
+	nr.requireZeroPadding = true
+}
+
+// SetMaxFilename sets the maximum length in bytes
+// of a directory entry name that the Reader will accept.
+// Names longer than n cause [Reader.Next] to return an error.
+// If n is not positive or is greater than the NAR format's maximum (255),
+// then the NAR format's maximum is used.
+func (nr *Reader) SetMaxFilename(n int) {
+	nr.maxFilename = clampLimit(n, entryNameMaxLen)
+}
+
+// SetMaxSymlinkTarget sets the maximum length in bytes
+// of a symlink target that the Reader will accept.
+// Targets longer than n cause [Reader.Next] to return an error.
+// If n is not positive or is greater than the NAR format's maximum (4095),
+// then the NAR format's maximum is used.
+func (nr *Reader) SetMaxSymlinkTarget(n int) {
+	nr.maxSymlinkTarget = clampLimit(n, symlinkTargetMaxLen)
+}
+
+// SetMaxFileSize sets the maximum size in bytes
+// of a single regular file that the Reader will accept.
+// A regular file whose declared size is larger than n
+// causes [Reader.Next] to return an error wrapping [ErrFileTooLarge].
+// If n is not positive, then file sizes are not limited (the default).
+func (nr *Reader) SetMaxFileSize(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	nr.maxFileSize = n
+}
+
+// SetMaxTotalSize sets the maximum number of bytes of file contents
+// that the Reader will accept across the whole archive.
+// The total includes the padding after each file's contents.
+// Once the total exceeds n,
+// [Reader.Next] returns an error wrapping [ErrFileTooLarge].
+// If n is not positive, then the total is not limited (the default).
+func (nr *Reader) SetMaxTotalSize(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	nr.maxTotalSize = n
+}
+
+// OnSymlink registers fn to be called during [Reader.Next]
+// for each symlink in the archive,
+// with the symlink's path (as in [Header.Path]) and its target.
+// This allows collecting symlink targets (for example, to find store references)
+// without a second pass over the archive.
+// fn is called before Next returns the symlink's header.
+// Passing nil removes any previously registered function.
+func (nr *Reader) OnSymlink(fn func(path, target string)) {
+	nr.onSymlink = fn
+}
+
+func clampLimit(n, max int) int {
+	if n <= 0 || n > max {
+		return max
+	}
+	return n
+}
+
+func (nr *Reader) filenameMaxLen() int {
+	if nr.maxFilename == 0 {
+		return entryNameMaxLen
+	}
+	return nr.maxFilename
+}
+
+func (nr *Reader) symlinkTargetMaxLen() int {
+	if nr.maxSymlinkTarget == 0 {
+		return symlinkTargetMaxLen
+	}
+	return nr.maxSymlinkTarget
+}
+
 // Next advances to the next entry in the NAR archive.
 // The Header.Size determines how many bytes can be read for the next file.
 // Any remaining data in the current file is automatically discarded.
 // At the end of the archive, Next returns the error [io.EOF].
+// Any other error is of type [*ReadError].
 func (nr *Reader) Next() (_ *Header, err error) {
 	if nr.err != nil {
 		return nil, nr.err
 	}
 	defer func() {
-		if err != nil && nr.err == nil {
-			nr.err = errInvalid
+		if err == nil || err == io.EOF {
+			return
+		}
+		if !errors.As(err, new(*ReadError)) {
+			err = &ReadError{Offset: nr.off, Op: "next", Err: err}
 		}
+		nr.err = err
 	}()
 
 	switch nr.state {
 	case readerStateFirst:
 		if err := nr.expect(magic); err != nil {
-			return nil, fmt.Errorf("nar: magic number: %w", err)
+			return nil, fmt.Errorf("magic number: %w", err)
 		}
 		hdr := new(Header)
 		if err := nr.node(hdr); err != nil {
-			return nil, fmt.Errorf("nar: %w", err)
+			return nil, err
 		}
 		switch nr.state {
 		case readerStateFirst:
@@ -100,17 +333,19 @@ func (nr *Reader) Next() (_ *Header, err error) {
 		return hdr, nil
 	case readerStateFile:
 		// Advance to end of file.
-		n, err := io.CopyN(io.Discard, nr.r, nr.remaining+int64(nr.padding))
-		nr.off += n
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+		if err := nr.Skip(); err != nil {
+			return nil, err
 		}
-		if err != nil {
-			nr.err = fmt.Errorf("nar: %w", err)
-			return nil, nr.err
+		if err := nr.read(nr.buf[:nr.padding]); err != nil {
+			return nil, err
+		}
+		if nr.requireZeroPadding {
+			if err := checkZeroPadding(nr.buf[:nr.padding]); err != nil {
+				return nil, fmt.Errorf("file contents: %v", err)
+			}
 		}
 		if err := nr.expect(")"); err != nil {
-			return nil, fmt.Errorf("nar: %w", err)
+			return nil, err
 		}
 
 		// Now advance to next header.
@@ -124,7 +359,7 @@ func (nr *Reader) Next() (_ *Header, err error) {
 		// Close out the previous entry's parenthesis.
 		if nr.state != readerStateDirectoryStart {
 			if err := nr.expect(")"); err != nil {
-				return nil, fmt.Errorf("nar: %w", err)
+				return nil, err
 			}
 			nr.state = readerStateDirectory
 		}
@@ -133,7 +368,7 @@ func (nr *Reader) Next() (_ *Header, err error) {
 		for {
 			n, err := nr.readSmallString()
 			if err != nil {
-				return nil, fmt.Errorf("nar: %w", err)
+				return nil, err
 			}
 			switch string(nr.buf[:n]) {
 			case ")":
@@ -144,47 +379,62 @@ func (nr *Reader) Next() (_ *Header, err error) {
 				}
 				// Close out the directory entry's parenthesis.
 				if err := nr.expect(")"); err != nil {
-					return nil, fmt.Errorf("nar: %w", err)
+					return nil, err
 				}
 
 				nr.nameStack[len(nr.nameStack)-1] = "" // clear for GC
 				nr.nameStack = nr.nameStack[:len(nr.nameStack)-1]
-				prevSlash := strings.LastIndexByte(nr.prefix[:len(nr.prefix)-len("/")], '/')
-				if prevSlash < 0 {
-					nr.prefix = ""
-				} else {
-					nr.prefix = nr.prefix[:prevSlash+len("/")]
+				nr.prefix = parentPrefix(nr.prefix)
+				if nr.caseHack {
+					nr.caseHackNames[len(nr.caseHackNames)-1] = nil // clear for GC
+					nr.caseHackNames = nr.caseHackNames[:len(nr.caseHackNames)-1]
+					nr.archivePrefix = parentPrefix(nr.archivePrefix)
 				}
 			case entryToken:
 				break popLoop
 			default:
-				return nil, fmt.Errorf("nar: directory: got %q token (expected \")\" or %q)", nr.buf[:n], entryToken)
+				return nil, fmt.Errorf("directory: got %q token (expected \")\" or %q)", nr.buf[:n], entryToken)
 			}
 		}
 
 		if err := nr.expect("("); err != nil {
-			return nil, fmt.Errorf("nar: directory: %w", err)
+			return nil, fmt.Errorf("directory: %w", err)
 		}
 		if err := nr.expect(nameToken); err != nil {
-			return nil, fmt.Errorf("nar: directory: %w", err)
+			return nil, fmt.Errorf("directory: %w", err)
 		}
-		name, err := nr.readString(entryNameMaxLen)
+		name, err := nr.readString(nr.filenameMaxLen())
 		if err != nil {
-			return nil, fmt.Errorf("nar: directory: entry name: %w", err)
+			return nil, fmt.Errorf("directory: entry name: %w", err)
 		}
 		if err := validateFilename(name); err != nil {
-			return nil, fmt.Errorf("nar: directory: entry name: %v", err)
+			return nil, fmt.Errorf("directory: entry name: %v", err)
 		}
 		if last := nr.nameStack[len(nr.nameStack)-1]; last >= name {
-			return nil, fmt.Errorf("nar: directory: entry name %q >= %q", last, name)
+			return nil, fmt.Errorf("directory: entry name %q >= %q", last, name)
 		}
 		nr.nameStack[len(nr.nameStack)-1] = name
 		if err := nr.expect(nodeToken); err != nil {
-			return nil, fmt.Errorf("nar: directory: %w", err)
+			return nil, fmt.Errorf("directory: %w", err)
 		}
 		hdr := &Header{Path: nr.prefix + name}
+		if nr.caseHack {
+			logicalName := stripCaseHack(name, caseHackSuffix)
+			if err := validateFilename(logicalName); err != nil {
+				return nil, fmt.Errorf("directory: entry name %q: %v", name, err)
+			}
+			names := nr.caseHackNames[len(nr.caseHackNames)-1]
+			if _, dup := names[logicalName]; dup {
+				return nil, fmt.Errorf("directory: entry name %q collides with another entry named %q", name, logicalName)
+			}
+			names[logicalName] = struct{}{}
+			hdr.Path = nr.prefix + logicalName
+			if archivePath := nr.archivePrefix + name; archivePath != hdr.Path {
+				hdr.ArchivePath = archivePath
+			}
+		}
 		if err := nr.node(hdr); err != nil {
-			return nil, fmt.Errorf("nar: %w", err)
+			return nil, err
 		}
 		return hdr, nil
 	default:
@@ -192,9 +442,24 @@ func (nr *Reader) Next() (_ *Header, err error) {
 	}
 }
 
+// parentPrefix returns the parent directory's prefix
+// of a slash-terminated directory prefix.
+func parentPrefix(prefix string) string {
+	prevSlash := strings.LastIndexByte(prefix[:len(prefix)-len("/")], '/')
+	if prevSlash < 0 {
+		return ""
+	}
+	return prefix[:prevSlash+len("/")]
+}
+
 // Read reads from the current file in the NAR archive.
 // It returns (0, io.EOF) when it reaches the end of that file,
 // until [Reader.Next] is called to advance to the next file.
+// The Read call that returns the file's last bytes reports a nil error,
+// even if the underlying reader ended there;
+// such an error is reported by the following call to Next instead.
+//
+// Errors other than io.EOF are of type [*ReadError].
 //
 // Calling Read on special types like [fs.ModeDir] and [fs.ModeSymlink]
 // returns (0, io.EOF).
@@ -219,7 +484,8 @@ func (nr *Reader) Read(p []byte) (n int, err error) {
 		err = io.ErrUnexpectedEOF
 	}
 	if err != nil {
-		nr.err = fmt.Errorf("nar: %w", err)
+		nr.err = &ReadError{Offset: nr.off, Op: "read", Err: err}
+		err = nr.err
 	}
 	if nr.remaining <= 0 {
 		// If we've hit the regular file's contents boundary,
@@ -230,7 +496,324 @@ func (nr *Reader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// WalkNARDir calls fn for each regular file in dir with a ".nar" extension
+// in lexical order of file name.
+// Each file is opened and passed to fn as a buffered [Reader],
+// and is closed after fn returns.
+// If fn returns an error, WalkNARDir stops and returns that error.
+func WalkNARDir(dir string, fn func(name string, r *Reader) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("walk nar directory: %w", err)
+	}
+	for _, ent := range entries {
+		name := ent.Name()
+		if !ent.Type().IsRegular() || filepath.Ext(name) != ".nar" {
+			continue
+		}
+		if err := walkNARFile(filepath.Join(dir, name), name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkNARFile(path, name string, fn func(name string, r *Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("walk nar directory: %w", err)
+	}
+	defer f.Close()
+	return fn(name, NewReader(bufio.NewReader(f)))
+}
+
+// WriteCurrentFileTo writes the remaining contents of the current regular file to w
+// and returns the number of bytes written.
+// It does not write any padding or other archive structure,
+// so the Reader remains positioned for the next call to [Reader.Next].
+// WriteCurrentFileTo returns [ErrNotRegularFile]
+// if the current file system object is a directory or symlink.
+func (nr *Reader) WriteCurrentFileTo(w io.Writer) (int64, error) {
+	if nr.state != readerStateFile {
+		return 0, ErrNotRegularFile
+	}
+	return io.Copy(w, nr)
+}
+
+// Skip discards the remaining contents of the current file.
+// If the underlying reader implements [io.Seeker],
+// Skip seeks past the contents instead of reading them.
+// Subsequent calls to [Reader.Read] return (0, io.EOF)
+// until [Reader.Next] is called.
+// Skip does nothing if the current file is not a regular file.
+// Calling Skip is not necessary before calling Next,
+// but it allows Next to return any errors that occurred
+// while reading the file's contents separately from errors in the next header.
+func (nr *Reader) Skip() error {
+	if nr.state != readerStateFile || nr.remaining <= 0 {
+		return nr.err
+	}
+	if nr.err != nil {
+		return nr.err
+	}
+	err := nr.discard(nr.remaining)
+	nr.remaining = 0
+	if err != nil {
+		nr.err = &ReadError{Offset: nr.off, Op: "skip", Err: err}
+		return nr.err
+	}
+	return nil
+}
+
+// discard advances the underlying reader by n bytes,
+// seeking if the underlying reader supports it
+// and falling back to reading otherwise.
+func (nr *Reader) discard(n int64) error {
+	if seeker, ok := nr.r.(io.Seeker); ok {
+		if _, err := seeker.Seek(n, io.SeekCurrent); err == nil {
+			nr.off += n
+			return nil
+		}
+	}
+	// io.Discard implements io.ReaderFrom with a pooled buffer,
+	// so this does not allocate.
+	nr.skip = io.LimitedReader{R: nr.r, N: n}
+	copied, err := io.Copy(io.Discard, &nr.skip)
+	nr.skip.R = nil
+	nr.off += copied
+	if err == nil && copied < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// A SeekingReader is a [Reader] over an [io.ReadSeeker]
+// that can also jump directly to the contents of a regular file
+// given its [Header.ContentOffset] (e.g. from a [Listing]).
+type SeekingReader struct {
+	Reader
+	rs io.ReadSeeker
+	// base is the position in rs of the beginning of the NAR file.
+	base int64
+	// seeked is true if SeekToContent has been called since the last Reset.
+	seeked bool
+}
+
+var errSeeked = errors.New("Next called after SeekToContent")
+
+// NewSeekingReader returns a new [SeekingReader] that reads a NAR file from rs.
+// The NAR file is assumed to start at rs's current position.
+func NewSeekingReader(rs io.ReadSeeker) (*SeekingReader, error) {
+	base, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("nar: %w", err)
+	}
+	sr := &SeekingReader{rs: rs, base: base}
+	sr.Reader.r = rs
+	return sr, nil
+}
+
+// Next advances to the next entry in the NAR archive like [Reader.Next].
+// Seeking with [SeekingReader.SeekToContent] invalidates the directory-walk state,
+// so Next returns a [*ReadError] after SeekToContent
+// until [SeekingReader.Reset] is called.
+func (sr *SeekingReader) Next() (*Header, error) {
+	if sr.seeked {
+		return nil, &ReadError{Offset: sr.off, Op: "next", Err: errSeeked}
+	}
+	return sr.Reader.Next()
+}
+
+// SeekToContent positions the reader at the beginning of the contents of the regular file
+// whose [Header.ContentOffset] is offset.
+// Subsequent calls to Read return exactly the file's contents,
+// followed by io.EOF.
+// SeekToContent returns a [*ReadError] with Op "seek"
+// if offset is not the start of a regular file's contents
+// or the underlying reader fails.
+func (sr *SeekingReader) SeekToContent(offset int64) error {
+	// Regular file contents are always preceded by the contents token
+	// and the 8-byte size of the file.
+	const preambleSize = int64(8 + len(contentsToken) + 8)
+	nr := &sr.Reader
+	if offset < preambleSize || offset%stringAlign != 0 {
+		return &ReadError{Offset: nr.off, Op: "seek", Err: fmt.Errorf("content offset %d: invalid offset", offset)}
+	}
+	sr.seeked = true
+	nr.state = readerStateFirst
+	nr.remaining = 0
+	nr.padding = 0
+	nr.err = nil
+	if _, err := sr.rs.Seek(sr.base+offset-preambleSize, io.SeekStart); err != nil {
+		nr.err = &ReadError{Offset: nr.off, Op: "seek", Err: fmt.Errorf("content offset %d: %w", offset, err)}
+		return nr.err
+	}
+	nr.off = offset - preambleSize
+	if err := nr.expect(contentsToken); err != nil {
+		nr.err = &ReadError{Offset: nr.off, Op: "seek", Err: fmt.Errorf("content offset %d: %w", offset, err)}
+		return nr.err
+	}
+	size, err := nr.readInt()
+	if err != nil {
+		nr.err = &ReadError{Offset: nr.off, Op: "seek", Err: fmt.Errorf("content offset %d: %w", offset, err)}
+		return nr.err
+	}
+	if size >= 1<<63 {
+		nr.err = &ReadError{Offset: nr.off, Op: "seek", Err: fmt.Errorf("content offset %d: file too large (%d bytes)", offset, size)}
+		return nr.err
+	}
+	nr.state = readerStateFile
+	nr.remaining = int64(size)
+	nr.padding = int8(stringPaddingLength(int(size % stringAlign)))
+	return nil
+}
+
+// Reset seeks back to the beginning of the NAR file
+// and resets the reader's state
+// so that [SeekingReader.Next] reads the archive from the start.
+func (sr *SeekingReader) Reset() error {
+	if _, err := sr.rs.Seek(sr.base, io.SeekStart); err != nil {
+		return fmt.Errorf("nar: %w", err)
+	}
+	sr.Reader.Reset(sr.rs)
+	sr.seeked = false
+	return nil
+}
+
+// MeasureNAR reads a NAR archive from r to completion
+// and returns the number of bytes in the archive,
+// which should equal the NARSize field of a [nix.NARInfo] for the archive.
+// If the archive is invalid or truncated,
+// MeasureNAR returns the number of bytes consumed before the error along with the error.
+func MeasureNAR(r io.Reader) (size int64, err error) {
+	nr := NewReader(r)
+	for {
+		_, err := nr.Next()
+		if err == io.EOF {
+			return nr.off, nil
+		}
+		if err != nil {
+			return nr.off, fmt.Errorf("measure nar: %w", err)
+		}
+	}
+}
+
+// SameStoreContent reports whether a and b contain identical NAR archives
+// by comparing their SHA-256 hashes,
+// which determine the store paths of content-addressed store objects.
+// Each archive is read to completion and validated,
+// but neither is held in memory.
+func SameStoreContent(a, b io.Reader) (bool, error) {
+	ha, err := hashNAR(a)
+	if err != nil {
+		return false, fmt.Errorf("compare nar: first archive: %w", err)
+	}
+	hb, err := hashNAR(b)
+	if err != nil {
+		return false, fmt.Errorf("compare nar: second archive: %w", err)
+	}
+	return ha.Equal(hb), nil
+}
+
+// hashNAR reads a NAR archive from r to completion
+// and returns its SHA-256 hash.
+func hashNAR(r io.Reader) (nix.Hash, error) {
+	h := nix.NewHasher(nix.SHA256)
+	nr := NewReader(io.TeeReader(r, h))
+	for {
+		_, err := nr.Next()
+		if err == io.EOF {
+			return h.SumHash(), nil
+		}
+		if err != nil {
+			return nix.Hash{}, err
+		}
+	}
+}
+
+// ScanReferences reads a NAR archive from r to completion
+// and returns the subset of candidates whose digests appear in it,
+// sorted and without duplicates.
+// Like Nix, ScanReferences searches the whole serialization,
+// which covers regular file contents, symlink targets, and entry names.
+// Every candidate must be a store path in dir.
+// See [nix.ScanReferences] for details on how digests are found.
+func ScanReferences(dir nix.StoreDirectory, candidates []nix.StorePath, r io.Reader) ([]nix.StorePath, error) {
+	s, err := nix.NewReferenceScanner(dir, candidates)
+	if err != nil {
+		return nil, err
+	}
+	nr := NewReader(io.TeeReader(r, s))
+	for {
+		_, err := nr.Next()
+		if err == io.EOF {
+			return s.Found(), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("scan nar: %w", err)
+		}
+	}
+}
+
+// IsNAR reports whether prefix begins with the NAR magic token:
+// the 8-byte little-endian length followed by the string "nix-archive-1".
+// It is intended for sniffing content types
+// and does not validate anything after the magic token.
+func IsNAR(prefix []byte) bool {
+	const n = 8 + len(magic)
+	if len(prefix) < n {
+		return false
+	}
+	return binary.LittleEndian.Uint64(prefix) == uint64(len(magic)) &&
+		string(prefix[8:n]) == magic
+}
+
+// PeekRootType reads the NAR header and the type of the root file system object from r
+// and returns the type bits of the root's mode:
+// 0 for a regular file, [fs.ModeDir], or [fs.ModeSymlink].
+// The returned reader yields the bytes consumed from r
+// followed by the rest of r,
+// so it can be passed to [NewReader] to parse the full archive.
+// The returned reader is valid even if PeekRootType returns an error.
+func PeekRootType(r io.Reader) (fs.FileMode, io.Reader, error) {
+	consumed := new(bytes.Buffer)
+	nr := &Reader{r: io.TeeReader(r, consumed)}
+	typ, err := nr.peekRootType()
+	rest := io.MultiReader(consumed, r)
+	if err != nil {
+		return 0, rest, fmt.Errorf("nar: peek root type: %w", err)
+	}
+	return typ, rest, nil
+}
+
+func (nr *Reader) peekRootType() (fs.FileMode, error) {
+	if err := nr.expect(magic); err != nil {
+		return 0, fmt.Errorf("magic number: %w", err)
+	}
+	if err := nr.expect("("); err != nil {
+		return 0, err
+	}
+	if err := nr.expect(typeToken); err != nil {
+		return 0, err
+	}
+	n, err := nr.readSmallString()
+	if err != nil {
+		return 0, fmt.Errorf("type: %w", err)
+	}
+	switch string(nr.buf[:n]) {
+	case typeRegular:
+		return 0, nil
+	case typeDirectory:
+		return fs.ModeDir, nil
+	case typeSymlink:
+		return fs.ModeSymlink, nil
+	default:
+		return 0, fmt.Errorf("invalid node type %q", nr.buf[:n])
+	}
+}
+
 func (nr *Reader) node(hdr *Header) error {
+	hdr.HeaderOffset = nr.off
 	if err := nr.expect("("); err != nil {
 		return err
 	}
@@ -270,15 +853,38 @@ func (nr *Reader) node(hdr *Header) error {
 			return fmt.Errorf("file too large (%d bytes)", unsignedSize)
 		}
 		hdr.Size = int64(unsignedSize)
+		padding := int64(stringPaddingLength(int(unsignedSize % stringAlign)))
+		if nr.maxFileSize > 0 && hdr.Size > nr.maxFileSize {
+			return fmt.Errorf("%d bytes exceeds limit of %d: %w", hdr.Size, nr.maxFileSize, ErrFileTooLarge)
+		}
+		if nr.maxTotalSize > 0 {
+			if rem := nr.maxTotalSize - nr.totalSize; hdr.Size > rem || padding > rem-hdr.Size {
+				return fmt.Errorf("archive contents exceed limit of %d bytes: %w", nr.maxTotalSize, ErrFileTooLarge)
+			}
+		}
+		nr.totalSize += hdr.Size + padding
 		hdr.ContentOffset = nr.off
+		nr.stats.Files++
+		nr.stats.ContentBytes += hdr.Size
 		nr.state = readerStateFile
 		nr.remaining = int64(unsignedSize)
-		nr.padding = int8(stringPaddingLength(int(unsignedSize % stringAlign)))
+		nr.padding = int8(padding)
 	case typeDirectory:
 		if hdr.Path != "" {
 			nr.prefix = hdr.Path + "/"
+			if nr.caseHack {
+				if hdr.ArchivePath != "" {
+					nr.archivePrefix = hdr.ArchivePath + "/"
+				} else {
+					nr.archivePrefix = hdr.Path + "/"
+				}
+			}
+		}
+		if nr.caseHack {
+			nr.caseHackNames = append(nr.caseHackNames, make(map[string]struct{}))
 		}
 		hdr.Mode = modeDirectory
+		nr.stats.Directories++
 		nr.state = readerStateDirectoryStart
 		nr.nameStack = append(nr.nameStack, "")
 	case typeSymlink:
@@ -286,14 +892,18 @@ func (nr *Reader) node(hdr *Header) error {
 			return fmt.Errorf("symlink: %w", err)
 		}
 		var err error
-		hdr.LinkTarget, err = nr.readString(symlinkTargetMaxLen)
+		hdr.LinkTarget, err = nr.readString(nr.symlinkTargetMaxLen())
 		if err != nil {
 			return fmt.Errorf("symlink target: %w", err)
 		}
 		hdr.Mode = modeSymlink
+		nr.stats.Symlinks++
 		if err := nr.expect(")"); err != nil {
 			return err
 		}
+		if nr.onSymlink != nil {
+			nr.onSymlink(hdr.Path, hdr.LinkTarget)
+		}
 		if nr.state == readerStateDirectoryStart {
 			nr.state = readerStateDirectory
 		}
@@ -314,11 +924,11 @@ func (nr *Reader) verifyEOF() {
 	switch _, err := io.ReadFull(nr.r, nr.buf[:1]); err {
 	case nil:
 		nr.off++
-		nr.err = errTrailingData
+		nr.err = &ReadError{Offset: nr.off, Op: "next", Err: errTrailingData}
 	case io.EOF:
 		nr.err = io.EOF
 	default:
-		nr.err = fmt.Errorf("nar: at eof: %w", err)
+		nr.err = &ReadError{Offset: nr.off, Op: "next", Err: fmt.Errorf("at eof: %w", err)}
 	}
 }
 
@@ -335,10 +945,14 @@ func (nr *Reader) read(p []byte) error {
 	return nil
 }
 
+// readInt reads a little-endian 64-bit integer.
+// Every token in the NAR format starts with one,
+// so readInt counts the token in nr.stats.
 func (nr *Reader) readInt() (uint64, error) {
 	if err := nr.read(nr.buf[:8]); err != nil {
 		return 0, err
 	}
+	nr.stats.Tokens++
 	return binary.LittleEndian.Uint64(nr.buf[:8]), nil
 }
 
@@ -357,6 +971,11 @@ func (nr *Reader) readSmallString() (n int, err error) {
 	if err := nr.read(nr.buf[:padStringSize(int(nn))]); err != nil {
 		return 0, err
 	}
+	if nr.requireZeroPadding {
+		if err := checkZeroPadding(nr.buf[nn:padStringSize(int(nn))]); err != nil {
+			return 0, err
+		}
+	}
 	return int(nn), nil
 }
 
@@ -372,9 +991,24 @@ func (nr *Reader) readString(maxLength int) (string, error) {
 	if err := nr.read(buf); err != nil {
 		return "", err
 	}
+	if nr.requireZeroPadding {
+		if err := checkZeroPadding(buf[n:]); err != nil {
+			return "", err
+		}
+	}
 	return string(buf[:n]), nil
 }
 
+// checkZeroPadding returns an error if any of the bytes in padding are non-zero.
+func checkZeroPadding(padding []byte) error {
+	for _, b := range padding {
+		if b != 0 {
+			return fmt.Errorf("non-zero padding byte %#02x", b)
+		}
+	}
+	return nil
+}
+
 func (nr *Reader) expect(s string) error {
 	n, err := nr.readSmallString()
 	if err != nil {
@@ -3,14 +3,20 @@ package nar
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"zombiezen.com/go/nix"
 )
 
 type testEntry struct {
@@ -815,7 +821,7 @@ func TestReader(t *testing.T) {
 				if err != nil {
 					t.Fatalf("r.Next() #%d: %v", i+1, err)
 				}
-				if diff := cmp.Diff(test.want[i].header, gotHeader); diff != "" {
+				if diff := cmp.Diff(test.want[i].header, gotHeader, ignoreHeaderOffset); diff != "" {
 					t.Errorf("header #%d (-want +got):\n%s", i+1, diff)
 				}
 				if !test.ignoreContents {
@@ -886,6 +892,1305 @@ func TestReader(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("MaxSymlinkTarget", func(t *testing.T) {
+		f, err := os.Open(filepath.Join("testdata", "symlink.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		nr := NewReader(f)
+		nr.SetMaxSymlinkTarget(10)
+		if hdr, err := nr.Next(); err == nil {
+			t.Errorf("nr.Next() = %+v, <nil>; want _, <error>", hdr)
+		} else {
+			t.Log("nr.Next():", err)
+		}
+	})
+
+	t.Run("MaxFilename", func(t *testing.T) {
+		f, err := os.Open(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		nr := NewReader(f)
+		nr.SetMaxFilename(3)
+		if _, err := nr.Next(); err != nil {
+			t.Fatal("root:", err)
+		}
+		if hdr, err := nr.Next(); err == nil {
+			t.Errorf("nr.Next() = %+v, <nil>; want _, <error>", hdr)
+		} else {
+			t.Log("nr.Next():", err)
+		}
+	})
+
+	t.Run("LimitClamped", func(t *testing.T) {
+		f, err := os.Open(filepath.Join("testdata", "symlink.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		nr := NewReader(f)
+		nr.SetMaxSymlinkTarget(1 << 20)
+		if got := nr.symlinkTargetMaxLen(); got != symlinkTargetMaxLen {
+			t.Errorf("after SetMaxSymlinkTarget(1<<20), limit = %d; want %d", got, symlinkTargetMaxLen)
+		}
+		if _, err := nr.Next(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReaderReadBoundary(t *testing.T) {
+	t.Run("ChunkSizes", func(t *testing.T) {
+		for _, test := range narTests {
+			if test.err || test.ignoreContents {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join("testdata", test.dataFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, chunkSize := range []int{1, 3, 7, 8, 9, 1024} {
+				t.Run(fmt.Sprintf("%s/%d", test.name, chunkSize), func(t *testing.T) {
+					nr := NewReader(iotest.OneByteReader(bytes.NewReader(data)))
+					buf := make([]byte, chunkSize)
+					for i, want := range test.want {
+						if _, err := nr.Next(); err != nil {
+							t.Fatalf("nr.Next() #%d: %v", i+1, err)
+						}
+						var got []byte
+						for {
+							n, err := nr.Read(buf)
+							got = append(got, buf[:n]...)
+							if err == io.EOF {
+								if n != 0 {
+									t.Errorf("nr.Read(...) #%d = %d, io.EOF; want 0, io.EOF", i+1, n)
+								}
+								break
+							}
+							if err != nil {
+								t.Fatalf("nr.Read(...) #%d: %v", i+1, err)
+							}
+							if n == 0 {
+								t.Fatalf("nr.Read(...) #%d = 0, <nil>", i+1)
+							}
+						}
+						if string(got) != want.data {
+							t.Errorf("contents #%d = %q; want %q", i+1, got, want.data)
+						}
+						if n, err := nr.Read(buf); n != 0 || err != io.EOF {
+							t.Errorf("nr.Read(...) after EOF #%d = %d, %v; want 0, io.EOF", i+1, n, err)
+						}
+					}
+					if _, err := nr.Next(); err != io.EOF {
+						t.Errorf("final nr.Next() = _, %v; want _, io.EOF", err)
+					}
+				})
+			}
+		}
+	})
+
+	t.Run("ExactSize", func(t *testing.T) {
+		f, err := os.Open(filepath.Join("testdata", "hello-world.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		nr := NewReader(f)
+		hdr, err := nr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, hdr.Size+1)
+		if n, err := nr.Read(buf[:hdr.Size]); n != int(hdr.Size) || err != nil {
+			t.Fatalf("nr.Read(make([]byte, %d)) = %d, %v; want %d, <nil>", hdr.Size, n, err, hdr.Size)
+		}
+		if got := string(buf[:hdr.Size]); got != helloWorld {
+			t.Errorf("contents = %q; want %q", got, helloWorld)
+		}
+		if n, err := nr.Read(buf); n != 0 || err != io.EOF {
+			t.Errorf("nr.Read(...) past end = %d, %v; want 0, io.EOF", n, err)
+		}
+		if _, err := nr.Next(); err != io.EOF {
+			t.Errorf("nr.Next() = _, %v; want _, io.EOF", err)
+		}
+	})
+
+	t.Run("OnePastSize", func(t *testing.T) {
+		f, err := os.Open(filepath.Join("testdata", "hello-world.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		nr := NewReader(f)
+		hdr, err := nr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, hdr.Size+1)
+		if n, err := nr.Read(buf); n != int(hdr.Size) || err != nil {
+			t.Fatalf("nr.Read(make([]byte, %d)) = %d, %v; want %d, <nil>", len(buf), n, err, hdr.Size)
+		}
+		if n, err := nr.Read(buf); n != 0 || err != io.EOF {
+			t.Errorf("nr.Read(...) past end = %d, %v; want 0, io.EOF", n, err)
+		}
+		if _, err := nr.Next(); err != io.EOF {
+			t.Errorf("nr.Next() = _, %v; want _, io.EOF", err)
+		}
+	})
+
+	t.Run("TruncatedAtBoundary", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("testdata", "hello-world.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nr := NewReader(bytes.NewReader(data))
+		hdr, err := nr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Cut the archive right after the contents, before padding.
+		end := hdr.ContentOffset + hdr.Size
+		nr = NewReader(bytes.NewReader(data[:end]))
+		if _, err := nr.Next(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(nr)
+		if string(got) != helloWorld || err != nil {
+			t.Errorf("io.ReadAll(nr) = %q, %v; want %q, <nil>", got, err, helloWorld)
+		}
+		if hdr, err := nr.Next(); err == nil || err == io.EOF {
+			t.Errorf("nr.Next() = %+v, %v; want _, <non-EOF error>", hdr, err)
+		}
+	})
+}
+
+func TestReaderCaseHack(t *testing.T) {
+	writeNAR := func(tb testing.TB, hdrs []*Header) []byte {
+		buf := new(bytes.Buffer)
+		nw := NewWriter(buf)
+		for _, hdr := range hdrs {
+			if err := nw.WriteHeader(hdr); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		if err := nw.Close(); err != nil {
+			tb.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("Strip", func(t *testing.T) {
+		data := writeNAR(t, []*Header{
+			{Mode: fs.ModeDir},
+			{Path: "README", Mode: 0o644},
+			{Path: "dir~nix~case~hack~1", Mode: fs.ModeDir | 0o755},
+			{Path: "dir~nix~case~hack~1/a", Mode: 0o644},
+			{Path: "readme~nix~case~hack~1", Mode: 0o644},
+		})
+		want := []*Header{
+			{Path: "", Mode: fs.ModeDir | 0o555},
+			{Path: "README", Mode: 0o444},
+			{Path: "dir", ArchivePath: "dir~nix~case~hack~1", Mode: fs.ModeDir | 0o555},
+			{Path: "dir/a", ArchivePath: "dir~nix~case~hack~1/a", Mode: 0o444},
+			{Path: "readme", ArchivePath: "readme~nix~case~hack~1", Mode: 0o444},
+		}
+
+		nr := NewReaderWithOptions(bytes.NewReader(data), &NewReaderOptions{CaseHackSuffix: true})
+		var got []*Header
+		for {
+			hdr, err := nr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, hdr)
+		}
+		if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(Header{}, "ContentOffset", "HeaderOffset")); diff != "" {
+			t.Errorf("headers (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		data := writeNAR(t, []*Header{
+			{Mode: fs.ModeDir},
+			{Path: "readme~nix~case~hack~1", Mode: 0o644},
+		})
+		nr := NewReader(bytes.NewReader(data))
+		if _, err := nr.Next(); err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := nr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "readme~nix~case~hack~1"; hdr.Path != want || hdr.ArchivePath != "" {
+			t.Errorf("hdr.Path, hdr.ArchivePath = %q, %q; want %q, \"\"", hdr.Path, hdr.ArchivePath, want)
+		}
+	})
+
+	t.Run("Collision", func(t *testing.T) {
+		data := writeNAR(t, []*Header{
+			{Mode: fs.ModeDir},
+			{Path: "readme~nix~case~hack~1", Mode: 0o644},
+			{Path: "readme~nix~case~hack~2", Mode: 0o644},
+		})
+		nr := NewReaderWithOptions(bytes.NewReader(data), &NewReaderOptions{CaseHackSuffix: true})
+		var err error
+		for err == nil {
+			_, err = nr.Next()
+		}
+		if err == io.EOF {
+			t.Error("Next() did not return an error for colliding names")
+		}
+	})
+}
+
+func TestReadError(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll := func(nr *Reader) error {
+		for {
+			if _, err := nr.Next(); err != nil {
+				return err
+			}
+			if _, err := io.Copy(io.Discard, nr); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		const n = 200
+		err := readAll(NewReader(bytes.NewReader(data[:n])))
+		var re *ReadError
+		if !errors.As(err, &re) {
+			t.Fatalf("error = %v; want *ReadError", err)
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("error = %v; want to wrap %v", err, io.ErrUnexpectedEOF)
+		}
+		if re.Offset != n {
+			t.Errorf("Offset = %d; want %d", re.Offset, n)
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		corrupt := append([]byte(nil), data...)
+		const badOffset = 8 + 16   // after magic
+		corrupt[badOffset+8] = 'X' // "(" -> "X"
+		err := readAll(NewReader(bytes.NewReader(corrupt)))
+		var re *ReadError
+		if !errors.As(err, &re) {
+			t.Fatalf("error = %v; want *ReadError", err)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("error = %v; should not wrap %v", err, io.ErrUnexpectedEOF)
+		}
+		if re.Op != "next" || re.Offset != badOffset+16 {
+			t.Errorf("Op, Offset = %q, %d; want %q, %d", re.Op, re.Offset, "next", badOffset+16)
+		}
+	})
+
+	t.Run("TrailingData", func(t *testing.T) {
+		err := readAll(NewReader(bytes.NewReader(append(data[:len(data):len(data)], 0))))
+		if !errors.As(err, new(*ReadError)) {
+			t.Errorf("error = %v; want *ReadError", err)
+		}
+		if !errors.Is(err, errTrailingData) {
+			t.Errorf("error = %v; want to wrap %v", err, errTrailingData)
+		}
+	})
+}
+
+func TestReaderSizeLimits(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var maxSize, totalSize int64
+	nr := NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := nr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.Mode.IsRegular() {
+			continue
+		}
+		if hdr.Size > maxSize {
+			maxSize = hdr.Size
+		}
+		totalSize += hdr.Size + int64(stringPaddingLength(int(hdr.Size%stringAlign)))
+	}
+
+	tests := []struct {
+		name      string
+		maxFile   int64
+		maxTotal  int64
+		wantLimit bool
+	}{
+		{name: "Unlimited"},
+		{name: "FileAtLimit", maxFile: maxSize},
+		{name: "FileOverLimit", maxFile: maxSize - 1, wantLimit: true},
+		{name: "TotalAtLimit", maxTotal: totalSize},
+		{name: "TotalOverLimit", maxTotal: totalSize - 1, wantLimit: true},
+		{name: "Negative", maxFile: -1, maxTotal: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nr := NewReader(bytes.NewReader(data))
+			nr.SetMaxFileSize(test.maxFile)
+			nr.SetMaxTotalSize(test.maxTotal)
+			var err error
+			for err == nil {
+				_, err = nr.Next()
+			}
+			if test.wantLimit {
+				if !errors.Is(err, ErrFileTooLarge) {
+					t.Errorf("Next() error = %v; want %v", err, ErrFileTooLarge)
+				}
+				return
+			}
+			if err != io.EOF {
+				t.Errorf("Next() error = %v; want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestReaderRequireZeroPadding(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "hello-world.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := NewReader(bytes.NewReader(data)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Size%stringAlign == 0 {
+		t.Fatalf("%q has no padding after contents", helloWorld)
+	}
+
+	readAll := func(nr *Reader) error {
+		for {
+			_, err := nr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		nr := NewReader(bytes.NewReader(data))
+		nr.RequireZeroPadding()
+		if err := readAll(nr); err != nil {
+			t.Error(err)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		offset int64
+	}{
+		{name: "Contents", offset: hdr.ContentOffset + hdr.Size},
+		{name: "Magic", offset: 8 + int64(len(magic))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			corrupt := append([]byte(nil), data...)
+			corrupt[test.offset] = 0x01
+
+			if err := readAll(NewReader(bytes.NewReader(corrupt))); err != nil {
+				t.Errorf("Default reader: %v", err)
+			}
+
+			nr := NewReader(bytes.NewReader(corrupt))
+			nr.RequireZeroPadding()
+			if err := readAll(nr); err == nil || err == io.EOF {
+				t.Error("Reader with RequireZeroPadding did not return an error")
+			} else {
+				t.Log(err)
+			}
+		})
+	}
+}
+
+func TestReaderReset(t *testing.T) {
+	miniDRV, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	helloWorldNAR, err := os.ReadFile(filepath.Join("testdata", "hello-world.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readPaths := func(nr *Reader) ([]string, error) {
+		var paths []string
+		for {
+			hdr, err := nr.Next()
+			if err == io.EOF {
+				return paths, nil
+			}
+			if err != nil {
+				return paths, err
+			}
+			paths = append(paths, hdr.Path)
+		}
+	}
+
+	nr := NewReader(bytes.NewReader(miniDRV))
+	// Stop partway through the archive.
+	for i := 0; i < 4; i++ {
+		if _, err := nr.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nr.Reset(bytes.NewReader(helloWorldNAR))
+	got, err := readPaths(nr)
+	if err != nil {
+		t.Fatal("after Reset mid-archive:", err)
+	}
+	if diff := cmp.Diff([]string{""}, got); diff != "" {
+		t.Errorf("paths after Reset mid-archive (-want +got):\n%s", diff)
+	}
+	if hdr, err := nr.Next(); err != io.EOF {
+		t.Errorf("nr.Next() at end = %+v, %v; want _, io.EOF", hdr, err)
+	}
+
+	nr.Reset(bytes.NewReader(miniDRV[:len(miniDRV)/2]))
+	if _, err := readPaths(nr); err == nil {
+		t.Fatal("reading truncated archive did not return an error")
+	}
+
+	nr.Reset(bytes.NewReader(miniDRV))
+	got, err = readPaths(nr)
+	if err != nil {
+		t.Fatal("after Reset from error:", err)
+	}
+	want := []string{"", "a.txt", "bin", "bin/hello.sh", "hello.txt"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("paths after Reset from error (-want +got):\n%s", diff)
+	}
+	if hdr, err := nr.Next(); hdr != nil || err != io.EOF {
+		t.Errorf("nr.Next() at end = %+v, %v; want <nil>, io.EOF", hdr, err)
+	}
+
+	t.Run("PreservesOptions", func(t *testing.T) {
+		nr := NewReader(nil)
+		nr.SetMaxFilename(3)
+		nr.Reset(bytes.NewReader(miniDRV))
+		if _, err := readPaths(nr); err == nil {
+			t.Error("SetMaxFilename(3) not preserved across Reset")
+		}
+	})
+}
+
+func TestReaderSkip(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		r      func() io.Reader
+		seeks  bool
+		strict bool
+	}{
+		{
+			name:  "Seeker",
+			r:     func() io.Reader { return &seekCounter{ReadSeeker: bytes.NewReader(data)} },
+			seeks: true,
+		},
+		{
+			name:   "SeekerStrict",
+			r:      func() io.Reader { return &seekCounter{ReadSeeker: bytes.NewReader(data)} },
+			seeks:  true,
+			strict: true,
+		},
+		{
+			name: "NonSeeker",
+			r:    func() io.Reader { return struct{ io.Reader }{bytes.NewReader(data)} },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := test.r()
+			nr := NewReader(r)
+			if test.strict {
+				nr.RequireZeroPadding()
+			}
+			var paths []string
+			for i := 0; ; i++ {
+				hdr, err := nr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				paths = append(paths, hdr.Path)
+				if i%2 == 0 && hdr.Size > 1 {
+					// Partially read the file before skipping.
+					if _, err := io.ReadFull(nr, make([]byte, 1)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := nr.Skip(); err != nil {
+					t.Fatalf("Skip() on %q: %v", hdr.Path, err)
+				}
+				if n, err := nr.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+					t.Errorf("Read(...) after Skip() on %q = %d, %v; want 0, io.EOF", hdr.Path, n, err)
+				}
+			}
+			want := []string{"", "a.txt", "bin", "bin/hello.sh", "hello.txt"}
+			if diff := cmp.Diff(want, paths); diff != "" {
+				t.Errorf("paths (-want +got):\n%s", diff)
+			}
+			if sc, ok := r.(*seekCounter); ok && test.seeks && sc.n == 0 {
+				t.Error("Skip did not seek")
+			}
+		})
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		ls, err := List(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := ls.Root.Entries["a.txt"].ContentOffset + 2
+		nr := NewReader(struct{ io.Reader }{bytes.NewReader(data[:end])})
+		for {
+			hdr, err := nr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Mode.IsRegular() {
+				break
+			}
+		}
+		if err := nr.Skip(); err == nil {
+			t.Error("Skip() on truncated file did not return an error")
+		}
+	})
+}
+
+// seekCounter counts the number of calls to Seek.
+type seekCounter struct {
+	io.ReadSeeker
+	n int
+}
+
+func (sc *seekCounter) Seek(offset int64, whence int) (int64, error) {
+	sc.n++
+	return sc.ReadSeeker.Seek(offset, whence)
+}
+
+func TestReaderWriteCurrentFileTo(t *testing.T) {
+	for _, test := range narTests {
+		if test.err || test.ignoreContents {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", test.dataFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			nr := NewReader(f)
+
+			for i, want := range test.want {
+				hdr, err := nr.Next()
+				if err != nil {
+					t.Fatalf("nr.Next() #%d: %v", i+1, err)
+				}
+				buf := new(bytes.Buffer)
+				n, err := nr.WriteCurrentFileTo(buf)
+				if !hdr.Mode.IsRegular() {
+					if n != 0 || err != ErrNotRegularFile {
+						t.Errorf("nr.WriteCurrentFileTo(...) for %q = %d, %v; want 0, %v", hdr.Path, n, err, ErrNotRegularFile)
+					}
+					continue
+				}
+				if n != hdr.Size || err != nil {
+					t.Errorf("nr.WriteCurrentFileTo(...) for %q = %d, %v; want %d, <nil>", hdr.Path, n, err, hdr.Size)
+				}
+				if got := buf.String(); got != want.data {
+					t.Errorf("contents of %q = %q; want %q", hdr.Path, got, want.data)
+				}
+			}
+			if _, err := nr.Next(); err != io.EOF {
+				t.Errorf("final nr.Next() = _, %v; want _, io.EOF", err)
+			}
+		})
+	}
+
+	t.Run("BeforeNext", func(t *testing.T) {
+		nr := NewReader(bytes.NewReader(nil))
+		if n, err := nr.WriteCurrentFileTo(io.Discard); n != 0 || err != ErrNotRegularFile {
+			t.Errorf("nr.WriteCurrentFileTo(...) = %d, %v; want 0, %v", n, err, ErrNotRegularFile)
+		}
+	})
+}
+
+func TestSeekingReader(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := List(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Place the NAR after some unrelated data to test the base offset.
+	const junk = "junkjunk"
+	rs := bytes.NewReader(append([]byte(junk), data...))
+	if _, err := rs.Seek(int64(len(junk)), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := NewSeekingReader(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start walking sequentially.
+	if _, err := sr.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []struct {
+		path string
+		data string
+	}{
+		{"hello.txt", helloWorld},
+		{"a.txt", "AAA\n"},
+		{"bin/hello.sh", miniDRVScriptData},
+	}
+	for _, file := range files {
+		node := ls.lookup(file.path)
+		if err := sr.SeekToContent(node.ContentOffset); err != nil {
+			t.Errorf("SeekToContent(%d) [%s]: %v", node.ContentOffset, file.path, err)
+			continue
+		}
+		got, err := io.ReadAll(sr)
+		if string(got) != file.data || err != nil {
+			t.Errorf("io.ReadAll(sr) after SeekToContent(%d) [%s] = %q, %v; want %q, <nil>", node.ContentOffset, file.path, got, err, file.data)
+		}
+	}
+
+	var readErr *ReadError
+	if hdr, err := sr.Next(); err == nil {
+		t.Errorf("sr.Next() after SeekToContent = %+v, <nil>; want _, <error>", hdr)
+	} else if !errors.As(err, &readErr) || readErr.Op != "next" {
+		t.Errorf("sr.Next() after SeekToContent = _, %v; want *ReadError with Op %q", err, "next")
+	}
+
+	for _, offset := range []int64{0, 24, 25, ls.Root.Entries["bin"].HeaderOffset} {
+		if err := sr.SeekToContent(offset); err == nil {
+			t.Errorf("SeekToContent(%d) = <nil>; want <error>", offset)
+		} else if !errors.As(err, &readErr) || readErr.Op != "seek" {
+			t.Errorf("SeekToContent(%d) = %v; want *ReadError with Op %q", offset, err, "seek")
+		}
+	}
+
+	if err := sr.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for {
+		hdr, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("after Reset:", err)
+		}
+		paths = append(paths, hdr.Path)
+	}
+	want := []string{"", "a.txt", "bin", "bin/hello.sh", "hello.txt"}
+	if diff := cmp.Diff(want, paths); diff != "" {
+		t.Errorf("paths after Reset (-want +got):\n%s", diff)
+	}
+}
+
+func TestReaderStats(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	nr := NewReader(f)
+	for {
+		if _, err := nr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := ReaderStats{
+		Directories:  2,
+		Files:        3,
+		Symlinks:     0,
+		ContentBytes: int64(len("AAA\n") + len(miniDRVScriptData) + len(helloWorld)),
+		Tokens:       53,
+	}
+	if diff := cmp.Diff(want, nr.Stats()); diff != "" {
+		t.Errorf("nr.Stats() (-want +got):\n%s", diff)
+	}
+}
+
+func TestReaderSymlinkTargetPassthrough(t *testing.T) {
+	targets := []string{
+		"with spaces/and more spaces ",
+		"caf\u00e9/\u65e5\u672c\u8a9e",
+		"\xff\xfe not UTF-8 \x80",
+		"../../..//./weird",
+		"\x00nul",
+	}
+	for _, target := range targets {
+		buf := new(bytes.Buffer)
+		nw := NewWriter(buf)
+		err := nw.WriteHeader(&Header{
+			Mode:       fs.ModeSymlink | 0o777,
+			LinkTarget: target,
+		})
+		if err != nil {
+			t.Errorf("WriteHeader(%q): %v", target, err)
+			continue
+		}
+		if err := nw.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+			continue
+		}
+
+		hdr, err := NewReader(buf).Next()
+		if err != nil {
+			t.Errorf("Next() for target %q: %v", target, err)
+			continue
+		}
+		if hdr.LinkTarget != target {
+			t.Errorf("LinkTarget = %q; want %q", hdr.LinkTarget, target)
+		}
+	}
+}
+
+func TestReaderOnSymlink(t *testing.T) {
+	for _, test := range narTests {
+		if test.name != "SmokeTest" {
+			continue
+		}
+		var want []string
+		for _, ent := range test.want {
+			if ent.header.Mode.Type() == fs.ModeSymlink {
+				want = append(want, ent.header.Path+" -> "+ent.header.LinkTarget)
+			}
+		}
+
+		f, err := os.Open(filepath.Join("testdata", test.dataFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var got []string
+		nr := NewReader(f)
+		nr.OnSymlink(func(path, target string) {
+			got = append(got, path+" -> "+target)
+		})
+		for {
+			if _, err := nr.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(want) == 0 {
+			t.Fatal("test archive has no symlinks")
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("symlinks (-want +got):\n%s", diff)
+		}
+	}
+}
+
+// ignoreHeaderOffset is a [cmp.Option] that ignores the Header.HeaderOffset field.
+// narTests does not record header offsets.
+var ignoreHeaderOffset = cmpopts.IgnoreFields(Header{}, "HeaderOffset")
+
+func TestReaderHeaderOffset(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	nr := NewReader(f)
+
+	want := map[string]int64{
+		"":             24,
+		"a.txt":        160,
+		"bin":          352,
+		"bin/hello.sh": 488,
+		"hello.txt":    792,
+	}
+	got := make(map[string]int64)
+	for {
+		hdr, err := nr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Path] = hdr.HeaderOffset
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("header offsets (-want +got):\n%s", diff)
+	}
+}
+
+func TestHeaderUnixMode(t *testing.T) {
+	tests := []struct {
+		mode fs.FileMode
+		want uint32
+	}{
+		{mode: 0o444, want: 0o444},
+		{mode: 0o644, want: 0o444},
+		{mode: 0, want: 0o444},
+		{mode: 0o555, want: 0o555},
+		{mode: 0o744, want: 0o555},
+		{mode: 0o701, want: 0o555},
+		{mode: fs.ModeDir | 0o755, want: 0o555},
+		{mode: fs.ModeDir, want: 0o555},
+		{mode: fs.ModeSymlink | 0o777, want: 0o777},
+		{mode: fs.ModeNamedPipe | 0o644, want: 0},
+	}
+	for _, test := range tests {
+		h := &Header{Mode: test.mode}
+		if got := h.UnixMode(); got != test.want {
+			t.Errorf("(&Header{Mode: %v}).UnixMode() = %#o; want %#o", test.mode, got, test.want)
+		}
+	}
+
+	// Headers from a Reader should have their modes preserved.
+	for _, test := range narTests {
+		for _, ent := range test.want {
+			if got, want := ent.header.UnixMode(), uint32(ent.header.Mode.Perm()); got != want {
+				t.Errorf("%s: %s: UnixMode() = %#o; want %#o", test.name, ent.header.Path, got, want)
+			}
+		}
+	}
+}
+
+func TestHeaderValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  Header
+		ok   bool
+	}{
+		{name: "Regular", hdr: Header{Path: "foo", Mode: 0o444, Size: 5}, ok: true},
+		{name: "Executable", hdr: Header{Path: "foo", Mode: 0o555}, ok: true},
+		{name: "Directory", hdr: Header{Mode: fs.ModeDir | 0o555}, ok: true},
+		{name: "Symlink", hdr: Header{Path: "a/b", Mode: fs.ModeSymlink | 0o777, LinkTarget: "c"}, ok: true},
+		{name: "BadPath", hdr: Header{Path: "a//b", Mode: 0o444}},
+		{name: "NegativeSize", hdr: Header{Path: "foo", Mode: 0o444, Size: -1}},
+		{name: "RegularWithTarget", hdr: Header{Path: "foo", Mode: 0o444, LinkTarget: "bar"}},
+		{name: "DirectoryWithSize", hdr: Header{Mode: fs.ModeDir | 0o555, Size: 1}},
+		{name: "DirectoryWithTarget", hdr: Header{Mode: fs.ModeDir | 0o555, LinkTarget: "bar"}},
+		{name: "SymlinkWithSize", hdr: Header{Mode: fs.ModeSymlink | 0o777, LinkTarget: "bar", Size: 3}},
+		{name: "SymlinkWithoutTarget", hdr: Header{Mode: fs.ModeSymlink | 0o777}},
+		{name: "SymlinkTargetTooLong", hdr: Header{Mode: fs.ModeSymlink | 0o777, LinkTarget: strings.Repeat("x", symlinkTargetMaxLen+1)}},
+		{name: "NamedPipe", hdr: Header{Mode: fs.ModeNamedPipe | 0o644}},
+	}
+	for _, test := range tests {
+		err := test.hdr.Validate()
+		if test.ok && err != nil {
+			t.Errorf("%s: Validate() = %v; want <nil>", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: Validate() = <nil>; want error", test.name)
+		}
+	}
+}
+
+func TestHeaderFileInfoModTime(t *testing.T) {
+	h := &Header{Path: "foo", Mode: 0o444}
+	if got, want := h.FileInfo().ModTime(), time.Unix(0, 0); !got.Equal(want) {
+		t.Errorf("FileInfo().ModTime() = %v; want %v", got, want)
+	}
+
+	h.ModTime = time.Date(2023, time.May, 1, 12, 0, 0, 0, time.UTC)
+	if got, want := h.FileInfo().ModTime(), h.ModTime; !got.Equal(want) {
+		t.Errorf("FileInfo().ModTime() = %v; want %v", got, want)
+	}
+
+	// ModTime does not affect the archive.
+	want := new(bytes.Buffer)
+	nw := NewWriter(want)
+	if err := nw.WriteHeader(&Header{Mode: 0o444}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := new(bytes.Buffer)
+	nw = NewWriter(got)
+	if err := nw.WriteHeader(&Header{Mode: 0o444, ModTime: h.ModTime}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Error("Writer output changed when ModTime was set")
+	}
+}
+
+func TestHeaderNormalizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{``, ``},
+		{`.`, ``},
+		{`foo`, `foo`},
+		{`foo\bar`, `foo/bar`},
+		{`foo\bar\`, `foo/bar`},
+		{`.\foo\.\bar`, `foo/bar`},
+		{`foo\..\bar`, `bar`},
+		{`\foo\bar`, `foo/bar`},
+		{`foo/bar\baz`, `foo/bar/baz`},
+	}
+	for _, test := range tests {
+		hdr := &Header{Path: test.path}
+		hdr.NormalizePath()
+		if hdr.Path != test.want {
+			t.Errorf("(&Header{Path: %q}).NormalizePath() set Path to %q; want %q", test.path, hdr.Path, test.want)
+		}
+	}
+}
+
+func TestHeaderAbsolutePath(t *testing.T) {
+	const storePath nix.StorePath = "/nix/store/00bgd045z0d4icpbc2yyz4gx48ak44la-net-tools-1.60_p20170221182432"
+	f, err := os.Open(filepath.Join("testdata", "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	nr := NewReader(f)
+	got := make(map[string]string)
+	for {
+		hdr, err := nr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Path] = hdr.AbsolutePath(storePath)
+	}
+
+	want := map[string]string{
+		"":        string(storePath),
+		"bin":     string(storePath) + "/bin",
+		"bin/arp": string(storePath) + "/bin/arp",
+		"sbin":    string(storePath) + "/sbin",
+	}
+	for path, wantAbs := range want {
+		if got[path] != wantAbs {
+			t.Errorf("(&Header{Path: %q}).AbsolutePath(%q) = %q; want %q", path, storePath, got[path], wantAbs)
+		}
+	}
+}
+
+func TestReaderHugeFile(t *testing.T) {
+	hugeFileNAR := func(size uint64) []byte {
+		buf := new(bytes.Buffer)
+		bw := &bufWriter{w: buf}
+		bw.string(magic)
+		bw.string("(")
+		bw.string(typeToken)
+		bw.string(typeRegular)
+		bw.string(contentsToken)
+		bw.uint64(size)
+		bw.flush()
+		if bw.err != nil {
+			t.Fatal(bw.err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("Overflow", func(t *testing.T) {
+		nr := NewReader(bytes.NewReader(hugeFileNAR(1 << 63)))
+		hdr, err := nr.Next()
+		if err == nil {
+			t.Fatalf("nr.Next() = %+v, <nil>; want _, <error>", hdr)
+		}
+		if !strings.Contains(err.Error(), "file too large") {
+			t.Errorf("nr.Next() error = %v; want to mention \"file too large\"", err)
+		}
+		if hdr, err := nr.Next(); err == nil || err == io.EOF {
+			t.Errorf("second nr.Next() = %+v, %v; want _, <non-EOF error>", hdr, err)
+		}
+		if n, err := nr.Read(make([]byte, 8)); n != 0 || err == nil {
+			t.Errorf("nr.Read(...) = %d, %v; want 0, <error>", n, err)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		const size = 1 << 62
+		nr := NewReader(bytes.NewReader(hugeFileNAR(size)))
+		hdr, err := nr.Next()
+		if err != nil {
+			t.Fatal("nr.Next():", err)
+		}
+		if hdr.Size != size {
+			t.Errorf("hdr.Size = %d; want %d", hdr.Size, int64(size))
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err = io.Copy(io.Discard, nr)
+		runtime.ReadMemStats(&after)
+		if err == nil || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("io.Copy(io.Discard, nr) = _, %v; want _, %v", err, io.ErrUnexpectedEOF)
+		}
+		const maxAlloc = 1 << 20
+		if n := after.TotalAlloc - before.TotalAlloc; n > maxAlloc {
+			t.Errorf("reading truncated file allocated %d bytes; want <= %d", n, maxAlloc)
+		}
+		if hdr, err := nr.Next(); err == nil || err == io.EOF {
+			t.Errorf("nr.Next() after truncated file = %+v, %v; want _, <non-EOF error>", hdr, err)
+		}
+	})
+}
+
+func TestPeekRootType(t *testing.T) {
+	tests := []struct {
+		dataFile string
+		want     fs.FileMode
+	}{
+		{dataFile: "hello-world.nar", want: 0},
+		{dataFile: "mini-drv.nar", want: fs.ModeDir},
+		{dataFile: "symlink.nar", want: fs.ModeSymlink},
+	}
+	for _, test := range tests {
+		t.Run(test.dataFile, func(t *testing.T) {
+			want, err := os.ReadFile(filepath.Join("testdata", test.dataFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, r, err := PeekRootType(bytes.NewReader(want))
+			if got != test.want || err != nil {
+				t.Errorf("PeekRootType(...) = %v, _, %v; want %v, _, <nil>", got, err, test.want)
+			}
+			gotData, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(gotData, want) {
+				t.Error("returned reader does not yield original data")
+			}
+		})
+	}
+
+	t.Run("OnlyMagic", func(t *testing.T) {
+		want, err := os.ReadFile(filepath.Join("testdata", "only-magic.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _, err := PeekRootType(bytes.NewReader(want)); err == nil {
+			t.Errorf("PeekRootType(...) = %v, _, <nil>; want _, _, <error>", got)
+		}
+	})
+}
+
+func TestWalkNARDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"mini-drv.nar", "hello-world.nar"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a NAR\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub.nar"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err := WalkNARDir(dir, func(name string, r *Reader) error {
+		got = append(got, name)
+		for {
+			_, err := r.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		t.Error("WalkNARDir:", err)
+	}
+	want := []string{"hello-world.nar", "mini-drv.nar"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("names (-want +got):\n%s", diff)
+	}
+
+	errStop := errors.New("stop")
+	got = nil
+	err = WalkNARDir(dir, func(name string, r *Reader) error {
+		got = append(got, name)
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("WalkNARDir(...) = %v; want %v", err, errStop)
+	}
+	if len(got) != 1 {
+		t.Errorf("fn called %d times after returning an error; want 1", len(got))
+	}
+}
+
+func TestMeasureNAR(t *testing.T) {
+	for _, test := range narTests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", test.dataFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := MeasureNAR(bytes.NewReader(data))
+			if test.err {
+				if err == nil {
+					t.Errorf("MeasureNAR(...) = %d, <nil>; want _, <error>", got)
+				}
+				return
+			}
+			if got != int64(len(data)) || err != nil {
+				t.Errorf("MeasureNAR(...) = %d, %v; want %d, <nil>", got, err, len(data))
+			}
+		})
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := len(data) - 8
+		got, err := MeasureNAR(bytes.NewReader(data[:n]))
+		if got != int64(n) || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("MeasureNAR(...) = %d, %v; want %d, %v", got, err, n, io.ErrUnexpectedEOF)
+		}
+	})
+}
+
+func TestSameStoreContent(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := bytes.Replace(data, []byte("AAA\n"), []byte("BBB\n"), 1)
+	if bytes.Equal(data, modified) {
+		t.Fatal("test archive does not contain \"AAA\\n\"")
+	}
+
+	if same, err := SameStoreContent(bytes.NewReader(data), bytes.NewReader(data)); !same || err != nil {
+		t.Errorf("SameStoreContent(data, data) = %t, %v; want true, <nil>", same, err)
+	}
+	if same, err := SameStoreContent(bytes.NewReader(data), bytes.NewReader(modified)); same || err != nil {
+		t.Errorf("SameStoreContent(data, modified) = %t, %v; want false, <nil>", same, err)
+	}
+	if same, err := SameStoreContent(bytes.NewReader(data), bytes.NewReader(data[:len(data)-8])); err == nil {
+		t.Errorf("SameStoreContent(data, truncated) = %t, <nil>; want _, <error>", same)
+	}
+}
+
+func TestScanReferences(t *testing.T) {
+	const (
+		glibc nix.StorePath = "/nix/store/3n58xw4373jp0ljirf06d8077j15pc4j-glibc-2.37-8"
+		hello nix.StorePath = "/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1"
+		drv   nix.StorePath = "/nix/store/ib3sh3pcz10wsmavxvkdbayhqivbghlq-hello-2.12.1.drv"
+		bash  nix.StorePath = "/nix/store/8fv91097mbh5049i9rglc73dx6kjg3qk-bash-5.2-p15"
+	)
+	candidates := []nix.StorePath{glibc, hello, drv, bash}
+
+	buf := new(bytes.Buffer)
+	nw := NewWriter(buf)
+	script := "#!" + string(bash) + "/bin/sh\nexec hello\n"
+	if err := nw.WriteHeader(&Header{Mode: fs.ModeDir | 0o555}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nw.WriteHeader(&Header{Path: "bin", Mode: fs.ModeDir | 0o555}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nw.WriteHeader(&Header{Path: "bin/hello", Mode: 0o555, Size: int64(len(script))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(nw, script); err != nil {
+		t.Fatal(err)
+	}
+	if err := nw.WriteHeader(&Header{Path: "lib", Mode: fs.ModeSymlink, LinkTarget: string(glibc) + "/lib"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ScanReferences(nix.DefaultStoreDirectory, candidates, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []nix.StorePath{glibc, bash}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ScanReferences(...) (-want +got):\n%s", diff)
+	}
+
+	if got, err := ScanReferences(nix.DefaultStoreDirectory, candidates, bytes.NewReader(buf.Bytes()[:buf.Len()-8])); err == nil {
+		t.Errorf("ScanReferences(..., truncated) = %q, <nil>; want _, <error>", got)
+	}
+}
+
+func TestIsNAR(t *testing.T) {
+	nar, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		prefix []byte
+		want   bool
+	}{
+		{name: "Empty", prefix: nil, want: false},
+		{name: "Archive", prefix: nar, want: true},
+		{name: "MagicOnly", prefix: nar[:21], want: true},
+		{name: "Truncated", prefix: nar[:20], want: false},
+		{name: "BadLength", prefix: append([]byte{14, 0, 0, 0, 0, 0, 0, 0}, "nix-archive-1"...), want: false},
+		{name: "Gzip", prefix: []byte{0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x2b, 0x49, 0x2d, 0x2e, 0x01, 0x00, 0x0c, 0x7e, 0x7f, 0xd8, 0x04}, want: false},
+	}
+	for _, test := range tests {
+		if got := IsNAR(test.prefix); got != test.want {
+			t.Errorf("IsNAR(%s) = %t; want %t", test.name, got, test.want)
+		}
+	}
 }
 
 func BenchmarkReader(b *testing.B) {
@@ -913,6 +2218,74 @@ func BenchmarkReader(b *testing.B) {
 	}
 }
 
+func BenchmarkReaderReset(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join("testdata", "nar_1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := bytes.NewReader(nil)
+	nr := NewReader(nil)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		nr.Reset(r)
+		for {
+			if _, err := nr.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, nr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkReaderSkip(b *testing.B) {
+	buf := new(bytes.Buffer)
+	nw := NewWriter(buf)
+	if err := nw.WriteHeader(&Header{Mode: fs.ModeDir}); err != nil {
+		b.Fatal(err)
+	}
+	const fileCount = 1000
+	for i := 0; i < fileCount; i++ {
+		err := nw.WriteHeader(&Header{
+			Path: fmt.Sprintf("%04d.txt", i),
+			Size: int64(len(helloWorld)),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.WriteString(nw, helloWorld); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := nw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	r := bytes.NewReader(nil)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		nr := NewReader(r)
+		for {
+			if _, err := nr.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
 func FuzzReader(f *testing.F) {
 	listing, err := os.ReadDir("testdata")
 	if err != nil {
@@ -0,0 +1,196 @@
+package nar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// RestoreFS is the interface implemented by a file system
+// that [Restore] can write a NAR archive's file system objects to.
+// Names are slash-separated paths
+// in the same form as accepted by [io/fs.ValidPath],
+// with "." naming the root of the archive.
+//
+// Restore calls methods in the order that the file system objects appear in the archive,
+// so a directory is always created before any of its entries,
+// and each name is passed to at most one method call.
+// Restore never creates a file system object inside a non-directory
+// and never passes names containing "." or ".." elements (other than the root).
+type RestoreFS interface {
+	// Mkdir creates a new directory with the given permission bits.
+	// Restore passes 0o555 as perm;
+	// implementations must still permit creating entries in the directory afterward.
+	Mkdir(name string, perm fs.FileMode) error
+	// WriteFile creates a new regular file with the given permission bits
+	// (0o444 or 0o555 for an executable file)
+	// whose content is read from r until EOF.
+	WriteFile(name string, r io.Reader, perm fs.FileMode) error
+	// Symlink creates newname as a symbolic link to oldname.
+	// oldname is the symlink target as stored in the archive
+	// and is not validated.
+	Symlink(oldname, newname string) error
+}
+
+// Restore reads a NAR archive from r
+// and recreates its file system objects in target.
+// It is the inverse of [Dumper.Dump].
+func Restore(target RestoreFS, r io.Reader) error {
+	if err := restore(target, r); err != nil {
+		return fmt.Errorf("restore nar: %w", err)
+	}
+	return nil
+}
+
+func restore(target RestoreFS, r io.Reader) error {
+	nr := NewReader(r)
+	for {
+		hdr, err := nr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := validatePath(hdr.Path); err != nil {
+			return err
+		}
+		name := hdr.Path
+		if name == "" {
+			name = "."
+		}
+		switch hdr.Mode.Type() {
+		case 0:
+			err = target.WriteFile(name, nr, fs.FileMode(hdr.UnixMode()))
+		case fs.ModeDir:
+			err = target.Mkdir(name, fs.FileMode(hdr.UnixMode()))
+		case fs.ModeSymlink:
+			err = target.Symlink(hdr.LinkTarget, name)
+		default:
+			err = fmt.Errorf("%s: unknown type %v", formatLastPath(hdr.Path), hdr.Mode.Type())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// RestorePath reads a NAR archive from r
+// and recreates its file system objects on the local file system at dst.
+// It is the inverse of [DumpPath].
+// The archive's root is created at dst itself,
+// so dst becomes a directory, a regular file, or a symlink
+// depending on the type of the archive's root.
+// Directories are created with mode 0o555,
+// regular files with mode 0o444 (or 0o555 if executable),
+// and symlinks with the target stored in the archive.
+//
+// RestorePath refuses to overwrite an existing file or symlink at dst,
+// or a directory at dst that has any entries.
+// If dst is an existing empty directory,
+// RestorePath replaces it with the archive's root, whatever its type.
+// If RestorePath returns an error, dst may be left partially written.
+func RestorePath(dst string, r io.Reader) error {
+	if err := checkRestoreDestination(dst); err != nil {
+		return fmt.Errorf("restore nar: %w", err)
+	}
+	target := &osRestoreFS{dir: dst}
+	if err := Restore(target, r); err != nil {
+		return err
+	}
+	if err := target.chmodDirs(); err != nil {
+		return fmt.Errorf("restore nar: %w", err)
+	}
+	return nil
+}
+
+// osRestoreFS is a [RestoreFS] that writes to the local file system.
+type osRestoreFS struct {
+	dir string
+	// dirs is the list of directories created,
+	// which have not had their permissions applied yet.
+	dirs []osRestoreDir
+}
+
+type osRestoreDir struct {
+	path string
+	perm fs.FileMode
+}
+
+func (ofs *osRestoreFS) path(name string) string {
+	return filepath.Join(ofs.dir, filepath.FromSlash(name))
+}
+
+// chmodDirs applies the permissions of all the directories created.
+// Directories are made read-only only after all of their entries are written,
+// so chmodDirs must be called after the last entry has been written.
+func (ofs *osRestoreFS) chmodDirs() error {
+	for i := len(ofs.dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(ofs.dirs[i].path, ofs.dirs[i].perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ofs *osRestoreFS) Mkdir(name string, perm fs.FileMode) error {
+	path := ofs.path(name)
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return err
+	}
+	ofs.dirs = append(ofs.dirs, osRestoreDir{path, perm})
+	return nil
+}
+
+func (ofs *osRestoreFS) WriteFile(name string, r io.Reader, perm fs.FileMode) (err error) {
+	f, err := os.OpenFile(ofs.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ofs *osRestoreFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, ofs.path(newname))
+}
+
+// checkRestoreDestination returns an error if dst exists
+// and is not an empty directory.
+// An empty directory at dst is removed
+// so that the archive's root can be created in its place.
+func checkRestoreDestination(dst string) error {
+	info, err := os.Lstat(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	f, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	_, err = f.Readdirnames(1)
+	f.Close()
+	if err == nil {
+		return fmt.Errorf("%s is not empty", dst)
+	}
+	if err != io.EOF {
+		return err
+	}
+	return os.Remove(dst)
+}
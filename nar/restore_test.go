@@ -0,0 +1,275 @@
+package nar
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRestorePath(t *testing.T) {
+	t.Run("MiniDRV", func(t *testing.T) {
+		want, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(restoreTempDir(t), "out")
+		if err := RestorePath(dst, bytes.NewReader(want)); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(dst, "hello.txt"))
+		if string(got) != helloWorld || err != nil {
+			t.Errorf("os.ReadFile(hello.txt) = %q, %v; want %q, <nil>", got, err, helloWorld)
+		}
+		info, err := os.Stat(filepath.Join(dst, "bin", "hello.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := info.Mode(), fs.FileMode(0o555); got != want {
+			t.Errorf("bin/hello.sh mode = %v; want %v", got, want)
+		}
+		info, err = os.Stat(filepath.Join(dst, "bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := info.Mode(), fs.ModeDir|0o555; got != want {
+			t.Errorf("bin mode = %v; want %v", got, want)
+		}
+
+		// Round-trip.
+		buf := new(bytes.Buffer)
+		if err := DumpPath(buf, dst); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+			t.Errorf("DumpPath after RestorePath (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Symlinks", func(t *testing.T) {
+		want, err := os.ReadFile(filepath.Join("testdata", "nested-dir-and-common-prefix.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(restoreTempDir(t), "out")
+		if err := RestorePath(dst, bytes.NewReader(want)); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := DumpPath(buf, dst); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+			t.Errorf("DumpPath after RestorePath (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("RootTypes", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			wantMode fs.FileMode
+		}{
+			{"hello-world.nar", 0o444},
+			{"empty-directory.nar", fs.ModeDir | 0o555},
+			{"symlink.nar", fs.ModeSymlink},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				want, err := os.ReadFile(filepath.Join("testdata", test.name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, existingDir := range []bool{false, true} {
+					dst := filepath.Join(restoreTempDir(t), "out")
+					if existingDir {
+						if err := os.Mkdir(dst, 0o755); err != nil {
+							t.Fatal(err)
+						}
+					}
+					if err := RestorePath(dst, bytes.NewReader(want)); err != nil {
+						t.Fatalf("RestorePath (existing directory = %t): %v", existingDir, err)
+					}
+					info, err := os.Lstat(dst)
+					if err != nil {
+						t.Fatal(err)
+					}
+					gotMode := info.Mode()
+					if gotMode.Type() == fs.ModeSymlink {
+						gotMode = fs.ModeSymlink
+					}
+					if gotMode != test.wantMode {
+						t.Errorf("mode of dst (existing directory = %t) = %v; want %v", existingDir, gotMode, test.wantMode)
+					}
+
+					buf := new(bytes.Buffer)
+					if err := DumpPath(buf, dst); err != nil {
+						t.Fatal(err)
+					}
+					if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+						t.Errorf("DumpPath after RestorePath (existing directory = %t) (-want +got):\n%s", existingDir, diff)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("ExistingSymlink", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("testdata", "symlink.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(restoreTempDir(t), "out")
+		if err := os.Symlink("foo", dst); err != nil {
+			t.Fatal(err)
+		}
+		if err := RestorePath(dst, bytes.NewReader(data)); err == nil {
+			t.Error("RestorePath did not return an error")
+		} else {
+			t.Log("RestorePath:", err)
+		}
+	})
+
+	t.Run("EmptyDestination", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := restoreTempDir(t)
+		if err := RestorePath(dst, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "hello.txt")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("NonEmptyDestination", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := restoreTempDir(t)
+		if err := os.WriteFile(filepath.Join(dst, "foo.txt"), []byte("foo\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := RestorePath(dst, bytes.NewReader(data)); err == nil {
+			t.Error("RestorePath did not return an error")
+		} else {
+			t.Log("RestorePath:", err)
+		}
+	})
+
+	t.Run("ExistingFile", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("testdata", "hello-world.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(restoreTempDir(t), "out")
+		if err := os.WriteFile(dst, []byte("foo\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := RestorePath(dst, bytes.NewReader(data)); err == nil {
+			t.Error("RestorePath did not return an error")
+		} else {
+			t.Log("RestorePath:", err)
+		}
+	})
+}
+
+func TestRestore(t *testing.T) {
+	for _, name := range []string{"mini-drv.nar", "nested-dir-and-common-prefix.nar", "hello-world.nar"} {
+		t.Run(name, func(t *testing.T) {
+			want, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := mapRestoreFS{}
+			if err := Restore(target, bytes.NewReader(want)); err != nil {
+				t.Fatal(err)
+			}
+
+			d := &Dumper{
+				ReadLink: func(path string) (string, error) {
+					return string(target[path].Data), nil
+				},
+			}
+			got := new(bytes.Buffer)
+			if err := d.Dump(got, fstest.MapFS(target), "."); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got.Bytes()); diff != "" {
+				t.Errorf("Dump after Restore (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// mapRestoreFS is a [RestoreFS] that stores files in a [fstest.MapFS].
+// Symlink targets are stored as the file's data.
+type mapRestoreFS fstest.MapFS
+
+func (m mapRestoreFS) checkParent(name string) error {
+	if name == "." {
+		return nil
+	}
+	if _, exists := m[name]; exists {
+		return fmt.Errorf("%s: %w", name, fs.ErrExist)
+	}
+	parent := slashpath.Dir(name)
+	if f := m[parent]; f == nil || !f.Mode.IsDir() {
+		return fmt.Errorf("%s: parent not created", name)
+	}
+	return nil
+}
+
+func (m mapRestoreFS) Mkdir(name string, perm fs.FileMode) error {
+	if err := m.checkParent(name); err != nil {
+		return err
+	}
+	m[name] = &fstest.MapFile{Mode: fs.ModeDir | perm}
+	return nil
+}
+
+func (m mapRestoreFS) WriteFile(name string, r io.Reader, perm fs.FileMode) error {
+	if err := m.checkParent(name); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m[name] = &fstest.MapFile{Mode: perm, Data: data}
+	return nil
+}
+
+func (m mapRestoreFS) Symlink(oldname, newname string) error {
+	if err := m.checkParent(newname); err != nil {
+		return err
+	}
+	m[newname] = &fstest.MapFile{Mode: fs.ModeSymlink | 0o777, Data: []byte(oldname)}
+	return nil
+}
+
+// restoreTempDir returns a new temporary directory
+// that is made writable again before it is removed at the end of the test,
+// since restored directories are read-only.
+func restoreTempDir(tb testing.TB) string {
+	dir := tb.TempDir()
+	tb.Cleanup(func() {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				os.Chmod(path, 0o755)
+			}
+			return nil
+		})
+	})
+	return dir
+}
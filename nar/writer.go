@@ -7,6 +7,8 @@ import (
 	"io"
 	"io/fs"
 	slashpath "path"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -35,11 +37,78 @@ type Writer struct {
 	remaining int64
 	// lastPath is the path of the last file system object written to the archive.
 	lastPath string
+
+	// caseHack is true if colliding names should be given case-hack suffixes.
+	caseHack bool
+	// caseHackStack is the chain of open directories (starting with the root)
+	// used to assign case-hack suffixes (only valid if caseHack is true).
+	caseHackStack []caseHackDir
+	// strictHeaders is true if headers should be checked with Header.Validate.
+	strictHeaders bool
+}
+
+// caseHackDir is the state of an open directory
+// used to assign case-hack suffixes.
+type caseHackDir struct {
+	// name is the directory's name as passed to WriteHeader.
+	name string
+	// archiveName is the directory's name as written to the archive.
+	archiveName string
+	// names is the set of names passed to WriteHeader for the directory's entries.
+	names map[string]struct{}
+	// counts is the number of entries in the directory for each lowercased name.
+	counts map[string]int
+}
+
+func newCaseHackDir(name, archiveName string) caseHackDir {
+	return caseHackDir{
+		name:        name,
+		archiveName: archiveName,
+		names:       make(map[string]struct{}),
+		counts:      make(map[string]int),
+	}
+}
+
+// WriterOptions is the set of optional parameters to [NewWriterWithOptions].
+type WriterOptions struct {
+	// CaseHack indicates whether the Writer should add case-hack suffixes
+	// (like "~nix~case~hack~1") to directory entry names
+	// that are equal to an earlier entry's name in the same directory
+	// after converting to lowercase,
+	// mirroring Nix's use-case-hack setting.
+	// Suffixes are numbered in the order the entries are written.
+	// The rewritten names must still be in lexicographic order:
+	// [Writer.WriteHeader] returns an error if adding a suffix
+	// would place an entry before a previously written entry.
+	CaseHack bool
 }
 
 // NewWriter returns a new [Writer] writing to w.
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{bw: bufWriter{w: w}}
+	return NewWriterWithOptions(w, nil)
+}
+
+// NewWriterWithOptions returns a new [Writer] writing to w
+// with the given options.
+// A nil opts is equivalent to a zero WriterOptions,
+// which behaves like NewWriter.
+func NewWriterWithOptions(w io.Writer, opts *WriterOptions) *Writer {
+	nw := &Writer{bw: bufWriter{w: w}}
+	if opts != nil && opts.CaseHack {
+		nw.caseHack = true
+		nw.caseHackStack = []caseHackDir{newCaseHackDir("", "")}
+	}
+	return nw
+}
+
+// StrictHeaders causes [Writer.WriteHeader] to check each header
+// with [Header.Validate] before writing it,
+// so that inconsistent headers (like a symlink without a target)
+// are reported instead of being silently written.
+// By default, the Writer only checks what is necessary
+// to produce a well-formed archive.
+func (nw *Writer) StrictHeaders() {
+	nw.strictHeaders = true
 }
 
 // WriteHeader writes hdr and prepares to accept the file's contents.
@@ -55,9 +124,34 @@ func (nw *Writer) WriteHeader(hdr *Header) (err error) {
 	if nw.bw.err != nil {
 		return nw.bw.err
 	}
+	if nw.strictHeaders {
+		if err := hdr.Validate(); err != nil {
+			return err
+		}
+	}
 	if err := validatePath(hdr.Path); err != nil {
 		return fmt.Errorf("nar: %w", err)
 	}
+	if nw.caseHack && hdr.Path != "" {
+		path, isDir := hdr.Path, hdr.Mode.IsDir()
+		archivePath, caseHackErr := nw.caseHackPath(path)
+		if caseHackErr != nil {
+			return fmt.Errorf("nar: %w", caseHackErr)
+		}
+		if err := validatePath(archivePath); err != nil {
+			return fmt.Errorf("nar: %w", err)
+		}
+		hdr2 := new(Header)
+		*hdr2 = *hdr
+		hdr2.Path = archivePath
+		hdr = hdr2
+		// Only claim the name once the header has been accepted.
+		defer func() {
+			if err == nil {
+				nw.recordCaseHackPath(path, archivePath, isDir)
+			}
+		}()
+	}
 
 	switch nw.state {
 	case writerStateInit:
@@ -107,6 +201,68 @@ func (nw *Writer) WriteHeader(hdr *Header) (err error) {
 	return nil
 }
 
+// caseHackPath returns the path to write to the archive for path,
+// adding case-hack suffixes as needed.
+// caseHackPath does not modify nw:
+// [Writer.recordCaseHackPath] must be called once the header has been written.
+func (nw *Writer) caseHackPath(path string) (string, error) {
+	elems := strings.Split(path, "/")
+	depth := nw.caseHackDepth(elems)
+	parent := &nw.caseHackStack[depth-1]
+	name := elems[depth-1]
+	if _, dup := parent.names[name]; dup {
+		return "", fmt.Errorf("%s written more than once", strings.Join(elems[:depth], "/"))
+	}
+
+	sb := new(strings.Builder)
+	for _, dir := range nw.caseHackStack[1:depth] {
+		sb.WriteString(dir.archiveName)
+		sb.WriteString("/")
+	}
+	sb.WriteString(name)
+	if n := parent.counts[strings.ToLower(name)]; n > 0 {
+		sb.WriteString(caseHackSuffix)
+		sb.WriteString(strconv.Itoa(n))
+	}
+	// Any remaining elements are in directories with no entries yet.
+	for _, name := range elems[depth:] {
+		sb.WriteString("/")
+		sb.WriteString(name)
+	}
+	return sb.String(), nil
+}
+
+// recordCaseHackPath records that path was written to the archive as archivePath,
+// so that later entries with colliding names are given case-hack suffixes.
+func (nw *Writer) recordCaseHackPath(path, archivePath string, isDir bool) {
+	elems := strings.Split(path, "/")
+	archiveElems := strings.Split(archivePath, "/")
+	depth := nw.caseHackDepth(elems)
+	for i := depth; i < len(nw.caseHackStack); i++ {
+		nw.caseHackStack[i] = caseHackDir{} // clear for GC
+	}
+	nw.caseHackStack = nw.caseHackStack[:depth]
+
+	for i := depth - 1; i < len(elems); i++ {
+		parent := &nw.caseHackStack[len(nw.caseHackStack)-1]
+		parent.names[elems[i]] = struct{}{}
+		parent.counts[strings.ToLower(elems[i])]++
+		if i+1 < len(elems) || isDir {
+			nw.caseHackStack = append(nw.caseHackStack, newCaseHackDir(elems[i], archiveElems[i]))
+		}
+	}
+}
+
+// caseHackDepth returns the number of directories in the case-hack stack
+// (including the root) that the path elements are inside of.
+func (nw *Writer) caseHackDepth(elems []string) int {
+	depth := 1
+	for depth < len(nw.caseHackStack) && depth < len(elems) && nw.caseHackStack[depth].name == elems[depth-1] {
+		depth++
+	}
+	return depth
+}
+
 func (nw *Writer) node(hdr *Header) error {
 	if hdr.Mode.IsRegular() && hdr.Size < 0 {
 		return fmt.Errorf("nar: %s: negative size", hdr.Path)
@@ -210,6 +366,97 @@ func (nw *Writer) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+// ReadFrom copies data from r to the current file in the NAR archive
+// until r returns EOF, implementing [io.ReaderFrom]
+// so that [io.Copy] passes data directly to the underlying writer.
+// Like [Writer.Write], ReadFrom writes at most Header.Size bytes
+// and returns [ErrWriteTooLong] if r has more data than that.
+// To detect extra data, ReadFrom may read one byte past Header.Size from r.
+// Like Write, ReadFrom returns [ErrWriteTooLong] without reading from r
+// if the last header written was not for a regular file.
+func (nw *Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	if nw.state != writerStateFile {
+		return 0, ErrWriteTooLong
+	}
+	if nw.remaining <= 0 {
+		return copyAtMost(io.Discard, r, 0)
+	}
+	nw.bw.flush()
+	if nw.bw.err != nil {
+		return 0, nw.bw.err
+	}
+	n, err = copyAtMost(nw.bw.w, r, nw.remaining)
+	nw.bw.off += n
+	nw.remaining -= n
+	return n, err
+}
+
+// copyAtMost copies from r to w until r returns EOF,
+// writing at most size bytes.
+// If r has more than size bytes, copyAtMost returns [ErrWriteTooLong].
+// To detect extra data, copyAtMost reads one byte past size from r;
+// errors other than [io.EOF] from that read are returned.
+// Callers that require exactly size bytes must check the returned count.
+func copyAtMost(w io.Writer, r io.Reader, size int64) (n int64, err error) {
+	n, err = io.Copy(w, io.LimitReader(r, size))
+	if err != nil || n < size {
+		return n, err
+	}
+	var probe [1]byte
+	switch _, err := io.ReadAtLeast(r, probe[:], 1); err {
+	case nil:
+		return n, ErrWriteTooLong
+	case io.EOF:
+		return n, nil
+	default:
+		return n, err
+	}
+}
+
+// skipFile advances the Writer past the current file's remaining contents
+// without writing them.
+// It is only valid if the underlying writer discards its output,
+// since the resulting archive would otherwise be malformed.
+func (nw *Writer) skipFile() {
+	if nw.state != writerStateFile {
+		return
+	}
+	nw.bw.flush()
+	nw.bw.off += nw.remaining
+	nw.remaining = 0
+}
+
+// WriteFile writes a regular file to the archive
+// with the given path, mode, and size,
+// copying its content from r.
+// It is equivalent to calling [Writer.WriteHeader]
+// followed by copying size bytes from r to the Writer,
+// but it verifies that r provides exactly size bytes:
+// if r reaches EOF early, WriteFile returns an error wrapping [io.ErrUnexpectedEOF],
+// and if r has more data, WriteFile returns [ErrWriteTooLong].
+// To check for extra data, WriteFile reads one byte past size from r.
+func (nw *Writer) WriteFile(path string, mode fs.FileMode, size int64, r io.Reader) error {
+	if mode.Type() != 0 {
+		return fmt.Errorf("nar: %s: WriteFile called with mode %v", formatLastPath(path), mode)
+	}
+	err := nw.WriteHeader(&Header{
+		Path: path,
+		Mode: mode,
+		Size: size,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := copyAtMost(nw, r, size)
+	if err != nil {
+		return err
+	}
+	if n < size {
+		return fmt.Errorf("nar: %s: read %d of %d bytes: %w", formatLastPath(path), n, size, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
 // Offset returns how many bytes have been written to the underlying writer.
 // This can be used to determine the "narOffset" of a regular file's contents
 // if called immediately after the [Writer.WriteHeader] call
@@ -262,6 +509,89 @@ func (nw *Writer) Close() error {
 	return prevErr
 }
 
+// WriteTree writes a complete NAR archive to w
+// containing the file system objects described by headers.
+// headers does not need to be sorted
+// and does not need to include parent directories:
+// WriteTree writes headers in archive order
+// and creates any missing directories automatically.
+// For each regular file, WriteTree calls content with the file's Header.Path
+// and copies exactly Header.Size bytes from the returned reader.
+// If the reader yields fewer or more bytes than Header.Size,
+// WriteTree returns an error.
+// If the returned reader implements [io.Closer],
+// WriteTree closes it after copying.
+func WriteTree(w io.Writer, headers []*Header, content func(path string) (io.Reader, error)) error {
+	sorted := append([]*Header(nil), headers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return comparePaths(sorted[i].Path, sorted[j].Path) < 0
+	})
+
+	nw := NewWriter(w)
+	for _, hdr := range sorted {
+		if err := nw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !hdr.Mode.IsRegular() {
+			continue
+		}
+		if err := writeTreeContent(nw, hdr, content); err != nil {
+			return fmt.Errorf("nar: %s: %w", formatLastPath(hdr.Path), err)
+		}
+	}
+	return nw.Close()
+}
+
+func writeTreeContent(nw *Writer, hdr *Header, content func(path string) (io.Reader, error)) (err error) {
+	r, err := content(hdr.Path)
+	if err != nil {
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer func() {
+			if closeErr := c.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+	}
+	n, err := copyAtMost(nw, r, hdr.Size)
+	if errors.Is(err, ErrWriteTooLong) {
+		return fmt.Errorf("content longer than %d bytes", hdr.Size)
+	}
+	if err != nil {
+		return err
+	}
+	if n < hdr.Size {
+		return fmt.Errorf("content has %d bytes (expected %d)", n, hdr.Size)
+	}
+	return nil
+}
+
+// comparePaths compares two slash-separated paths
+// in the order that their file system objects appear in a NAR archive.
+// It returns a negative number if path1 comes before path2,
+// a positive number if path1 comes after path2,
+// or zero if they are equal.
+func comparePaths(path1, path2 string) int {
+	for path1 != "" && path2 != "" {
+		name1 := firstPathComponent(path1)
+		name2 := firstPathComponent(path2)
+		if c := strings.Compare(name1, name2); c != 0 {
+			return c
+		}
+		path1 = strings.TrimPrefix(path1[len(name1):], "/")
+		path2 = strings.TrimPrefix(path2[len(name2):], "/")
+	}
+	switch {
+	case path1 == "" && path2 == "":
+		return 0
+	case path1 == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
 func (nw *Writer) finishFile() error {
 	nw.bw.pad()
 	nw.bw.string(")")
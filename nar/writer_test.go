@@ -3,12 +3,14 @@ package nar
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -204,6 +206,36 @@ func TestWriter(t *testing.T) {
 		}
 	})
 
+	t.Run("LongFilename", func(t *testing.T) {
+		nw := NewWriter(io.Discard)
+		err := nw.WriteHeader(&Header{
+			Mode: fs.ModeDir | 0o555,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Maximum length should succeed.
+		err = nw.WriteHeader(&Header{
+			Path:       strings.Repeat("a", entryNameMaxLen),
+			Mode:       fs.ModeSymlink | 0o777,
+			LinkTarget: "foo",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// One byte more should fail, even in a nested directory.
+		err = nw.WriteHeader(&Header{
+			Path:       "b/" + strings.Repeat("c", entryNameMaxLen+1),
+			Mode:       fs.ModeSymlink | 0o777,
+			LinkTarget: "foo",
+		})
+		if err == nil {
+			t.Error("WriteHeader did not return an error")
+		}
+	})
+
 	t.Run("DuplicateNames", func(t *testing.T) {
 		nw := NewWriter(io.Discard)
 		// write a directory node
@@ -236,6 +268,218 @@ func TestWriter(t *testing.T) {
 	})
 }
 
+func TestWriteTree(t *testing.T) {
+	files := map[string]string{
+		"a.txt":        "AAA\n",
+		"bin/hello.sh": miniDRVScriptData,
+		"hello.txt":    helloWorld,
+	}
+	content := func(path string) (io.Reader, error) {
+		data, ok := files[path]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		return strings.NewReader(data), nil
+	}
+
+	t.Run("MiniDRV", func(t *testing.T) {
+		headers := []*Header{
+			{Path: "hello.txt", Mode: 0o444, Size: int64(len(helloWorld))},
+			{Path: "bin/hello.sh", Mode: 0o555, Size: int64(len(miniDRVScriptData))},
+			{Path: "a.txt", Mode: 0o444, Size: 4},
+		}
+		got := new(bytes.Buffer)
+		if err := WriteTree(got, headers, content); err != nil {
+			t.Fatal(err)
+		}
+		want, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got.Bytes()); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("CommonPrefix", func(t *testing.T) {
+		headers := []*Header{
+			{Path: "foo-a", Mode: fs.ModeSymlink, LinkTarget: "foo"},
+			{Path: "foo/b", Mode: fs.ModeSymlink, LinkTarget: "foo"},
+		}
+		got := new(bytes.Buffer)
+		if err := WriteTree(got, headers, content); err != nil {
+			t.Fatal(err)
+		}
+		want, err := os.ReadFile(filepath.Join("testdata", "nested-dir-and-common-prefix.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got.Bytes()); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("ShortContent", func(t *testing.T) {
+		headers := []*Header{{Path: "a.txt", Mode: 0o444, Size: 5}}
+		if err := WriteTree(io.Discard, headers, content); err == nil {
+			t.Error("WriteTree did not return an error")
+		} else {
+			t.Log("WriteTree:", err)
+		}
+	})
+
+	t.Run("LongContent", func(t *testing.T) {
+		headers := []*Header{{Path: "a.txt", Mode: 0o444, Size: 3}}
+		if err := WriteTree(io.Discard, headers, content); err == nil {
+			t.Error("WriteTree did not return an error")
+		} else {
+			t.Log("WriteTree:", err)
+		}
+	})
+}
+
+func TestWriterCaseHack(t *testing.T) {
+	t.Run("Suffixes", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		nw := NewWriterWithOptions(buf, &WriterOptions{CaseHack: true})
+		headers := []*Header{
+			{Mode: fs.ModeDir},
+			{Path: "DIR/x", Mode: 0o444},
+			{Path: "README", Mode: 0o444},
+			{Path: "Readme", Mode: 0o444},
+			{Path: "dir/a", Mode: 0o444},
+			{Path: "dir/b", Mode: 0o444},
+			{Path: "readme", Mode: 0o444},
+		}
+		for _, hdr := range headers {
+			if err := nw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := nw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		nr := NewReader(bytes.NewReader(buf.Bytes()))
+		var got []string
+		for {
+			hdr, err := nr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, hdr.Path)
+		}
+		want := []string{
+			"",
+			"DIR",
+			"DIR/x",
+			"README",
+			"Readme~nix~case~hack~1",
+			"dir~nix~case~hack~1",
+			"dir~nix~case~hack~1/a",
+			"dir~nix~case~hack~1/b",
+			"readme~nix~case~hack~2",
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("archive paths (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("BadOrder", func(t *testing.T) {
+		nw := NewWriterWithOptions(io.Discard, &WriterOptions{CaseHack: true})
+		for _, hdr := range []*Header{{Mode: fs.ModeDir}, {Path: "A"}, {Path: "a"}} {
+			if err := nw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// "a0" sorts before "a~nix~case~hack~1".
+		if err := nw.WriteHeader(&Header{Path: "a0"}); err == nil {
+			t.Error("WriteHeader did not return an error")
+		} else {
+			t.Log("WriteHeader:", err)
+		}
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		nw := NewWriterWithOptions(io.Discard, &WriterOptions{CaseHack: true})
+		for _, hdr := range []*Header{{Mode: fs.ModeDir}, {Path: "a"}} {
+			if err := nw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := nw.WriteHeader(&Header{Path: "a"}); err == nil {
+			t.Error("WriteHeader did not return an error")
+		} else {
+			t.Log("WriteHeader:", err)
+		}
+	})
+
+	t.Run("RejectedHeader", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		nw := NewWriterWithOptions(buf, &WriterOptions{CaseHack: true})
+		if err := nw.WriteHeader(&Header{Mode: fs.ModeDir}); err != nil {
+			t.Fatal(err)
+		}
+		if err := nw.WriteHeader(&Header{Path: "a", Mode: 0o444, Size: -1}); err == nil {
+			t.Error("WriteHeader with negative size did not return an error")
+		}
+		// The rejected header must not claim the name.
+		if err := nw.WriteHeader(&Header{Path: "a", Mode: 0o444}); err != nil {
+			t.Fatal(err)
+		}
+		if err := nw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		nr := NewReader(bytes.NewReader(buf.Bytes()))
+		if _, err := nr.Next(); err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := nr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Path != "a" {
+			t.Errorf("path = %q; want %q", hdr.Path, "a")
+		}
+	})
+}
+
+func BenchmarkWriterLargeFile(b *testing.B) {
+	const size = 8 << 20
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	tests := []struct {
+		name string
+		wrap func(nw *Writer) io.Writer
+	}{
+		// Hide the ReadFrom method so that io.Copy uses Write.
+		{name: "Write", wrap: func(nw *Writer) io.Writer { return struct{ io.Writer }{nw} }},
+		{name: "ReadFrom", wrap: func(nw *Writer) io.Writer { return nw }},
+	}
+	for _, test := range tests {
+		b.Run(test.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				nw := NewWriter(io.Discard)
+				if err := nw.WriteHeader(&Header{Mode: 0o444, Size: size}); err != nil {
+					b.Fatal(err)
+				}
+				// Hide the WriteTo method so that io.Copy uses the writer's methods.
+				src := struct{ io.Reader }{bytes.NewReader(data)}
+				if _, err := io.Copy(test.wrap(nw), src); err != nil {
+					b.Fatal(err)
+				}
+				if err := nw.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkWriter(b *testing.B) {
 	buf := new(bytes.Buffer)
 
@@ -294,6 +538,189 @@ func BenchmarkWriter(b *testing.B) {
 
 const bufWriterSize = len(bufWriter{}.buf)
 
+func TestWriterStrictHeaders(t *testing.T) {
+	headers := []*Header{
+		{Mode: fs.ModeDir},
+		{Path: "link", Mode: fs.ModeSymlink},
+	}
+
+	// Lenient by default.
+	nw := NewWriter(io.Discard)
+	for _, hdr := range headers {
+		if err := nw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	nw = NewWriter(io.Discard)
+	nw.StrictHeaders()
+	if err := nw.WriteHeader(headers[0]); err != nil {
+		t.Fatal(err)
+	}
+	err := nw.WriteHeader(headers[1])
+	if err == nil {
+		t.Fatal("WriteHeader did not return an error")
+	}
+	if got, want := err.Error(), "LinkTarget is empty"; !strings.Contains(got, want) {
+		t.Errorf("WriteHeader(...) = %v; want error containing %q", err, want)
+	}
+}
+
+func TestWriterWriteFile(t *testing.T) {
+	t.Run("MiniDRV", func(t *testing.T) {
+		want, err := os.ReadFile(filepath.Join("testdata", "mini-drv.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		nw := NewWriter(buf)
+		if err := nw.WriteHeader(&Header{Mode: fs.ModeDir | 0o555}); err != nil {
+			t.Fatal(err)
+		}
+		files := []struct {
+			path string
+			mode fs.FileMode
+			data string
+		}{
+			{"a.txt", 0o444, "AAA\n"},
+			{"bin/hello.sh", 0o555, miniDRVScriptData},
+			{"hello.txt", 0o444, helloWorld},
+		}
+		for _, f := range files {
+			if err := nw.WriteFile(f.path, f.mode, int64(len(f.data)), strings.NewReader(f.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := nw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("Short", func(t *testing.T) {
+		nw := NewWriter(io.Discard)
+		err := nw.WriteFile("", 0o444, int64(len(helloWorld))+1, strings.NewReader(helloWorld))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("WriteFile(...) = %v; want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+
+	t.Run("Long", func(t *testing.T) {
+		nw := NewWriter(io.Discard)
+		err := nw.WriteFile("", 0o444, int64(len(helloWorld))-1, strings.NewReader(helloWorld))
+		if !errors.Is(err, ErrWriteTooLong) {
+			t.Errorf("WriteFile(...) = %v; want %v", err, ErrWriteTooLong)
+		}
+	})
+
+	t.Run("ErrorAtEOF", func(t *testing.T) {
+		// The content is complete, but the read past it fails.
+		errBoom := errors.New("boom")
+		r := io.MultiReader(strings.NewReader(helloWorld), iotest.ErrReader(errBoom))
+		nw := NewWriter(io.Discard)
+		err := nw.WriteFile("", 0o444, int64(len(helloWorld)), r)
+		if !errors.Is(err, errBoom) {
+			t.Errorf("WriteFile(...) = %v; want %v", err, errBoom)
+		}
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		nw := NewWriter(io.Discard)
+		if err := nw.WriteFile("", fs.ModeDir|0o555, 0, strings.NewReader("")); err == nil {
+			t.Error("WriteFile did not return an error")
+		}
+	})
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	const content = "Hello, World!\n"
+	tests := []struct {
+		name    string
+		size    int64
+		src     string
+		wantN   int64
+		wantErr error
+	}{
+		{name: "Exact", size: int64(len(content)), src: content, wantN: int64(len(content))},
+		{name: "Long", size: 5, src: content, wantN: 5, wantErr: ErrWriteTooLong},
+		{name: "Short", size: int64(len(content)) + 1, src: content, wantN: int64(len(content))},
+		{name: "Empty", size: 0, src: "", wantN: 0},
+		{name: "EmptyFileWithData", size: 0, src: content, wantN: 0, wantErr: ErrWriteTooLong},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			nw := NewWriter(buf)
+			if err := nw.WriteHeader(&Header{Mode: 0o444, Size: test.size}); err != nil {
+				t.Fatal(err)
+			}
+			n, err := nw.ReadFrom(strings.NewReader(test.src))
+			if n != test.wantN || !errors.Is(err, test.wantErr) {
+				t.Errorf("nw.ReadFrom(...) = %d, %v; want %d, %v", n, err, test.wantN, test.wantErr)
+			}
+			if test.wantErr != nil || n < test.size {
+				return
+			}
+			if err := nw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			hdr, err := NewReader(buf).Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Size != test.size {
+				t.Errorf("archive file size = %d; want %d", hdr.Size, test.size)
+			}
+		})
+	}
+
+	t.Run("NotFile", func(t *testing.T) {
+		for _, src := range []string{"", content} {
+			nw := NewWriter(io.Discard)
+			if err := nw.WriteHeader(&Header{Mode: fs.ModeDir | 0o555}); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := nw.Write([]byte(src)); n != 0 || err != ErrWriteTooLong {
+				t.Errorf("nw.Write(%q) after directory = %d, %v; want 0, %v", src, n, err, ErrWriteTooLong)
+			}
+			r := strings.NewReader(src)
+			if n, err := nw.ReadFrom(r); n != 0 || err != ErrWriteTooLong {
+				t.Errorf("nw.ReadFrom(%q) after directory = %d, %v; want 0, %v", src, n, err, ErrWriteTooLong)
+			}
+			if r.Len() != len(src) {
+				t.Errorf("nw.ReadFrom(%q) after directory read %d bytes; want 0", src, len(src)-r.Len())
+			}
+		}
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		want, err := os.ReadFile(filepath.Join("testdata", "hello-world.nar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		nw := NewWriter(buf)
+		if err := nw.WriteHeader(&Header{Mode: 0o444, Size: int64(len(helloWorld))}); err != nil {
+			t.Fatal(err)
+		}
+		// Hide the WriteTo method so that io.Copy uses ReadFrom.
+		if _, err := io.Copy(nw, struct{ io.Reader }{strings.NewReader(helloWorld)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := nw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, buf.Bytes()); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+}
+
 func TestBufWriterString(t *testing.T) {
 	const overflowSize = bufWriterSize + 1
 
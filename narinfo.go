@@ -2,10 +2,17 @@ package nix
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
+	slashpath "path"
 	"sort"
 	"strconv"
+	"strings"
+
+	"zombiezen.com/go/nix/nixbase32"
 )
 
 // NARInfoExtension is the file extension for a file containing NAR information.
@@ -75,6 +82,14 @@ func (info *NARInfo) IsValid() bool {
 	return info.validate() == nil
 }
 
+// HasDeprecatedFields reports whether info sets any deprecated fields
+// (currently only System).
+// Such fields are still parsed and marshaled,
+// but their presence usually indicates an .narinfo file written by an old version of Nix.
+func (info *NARInfo) HasDeprecatedFields() bool {
+	return info.System != ""
+}
+
 // AddSignatures adds signatures that are not already present in info.
 func (info *NARInfo) AddSignatures(sigs ...*Signature) {
 addLoop:
@@ -88,6 +103,40 @@ addLoop:
 	}
 }
 
+// Canonicalize normalizes info in place
+// so that its marshaled form is deterministic regardless of how it was constructed.
+// Leading and trailing whitespace is removed from string fields,
+// Compression is lowercased,
+// and References is sorted with duplicates removed.
+// [NARInfo.WriteFingerprint] already sorts references,
+// but calling Canonicalize before signing makes the stored form match.
+func (info *NARInfo) Canonicalize() {
+	info.StorePath = StorePath(strings.TrimSpace(string(info.StorePath)))
+	info.URL = strings.TrimSpace(info.URL)
+	info.Compression = CompressionType(strings.ToLower(strings.TrimSpace(string(info.Compression))))
+	info.Deriver = StorePath(strings.TrimSpace(string(info.Deriver)))
+	info.System = strings.TrimSpace(info.System)
+	if len(info.References) == 0 {
+		return
+	}
+	refs := make([]StorePath, 0, len(info.References))
+	for _, ref := range info.References {
+		refs = append(refs, StorePath(strings.TrimSpace(string(ref))))
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i] < refs[j]
+	})
+	n := 0
+	for i, ref := range refs {
+		if i > 0 && ref == refs[n-1] {
+			continue
+		}
+		refs[n] = ref
+		n++
+	}
+	info.References = refs[:n]
+}
+
 // validateFingerprint validates the subset of fields needed for [NARInfo.WriteFingerprint].
 func (info *NARInfo) validateForFingerprint() error {
 	if info.StorePath == "" {
@@ -145,6 +194,99 @@ func (info *NARInfo) validate() error {
 	return nil
 }
 
+// A NARInfoBuilder constructs a [NARInfo] field-by-field.
+// The zero value is an empty builder.
+// Setter methods return the builder so that calls can be chained,
+// and [NARInfoBuilder.Build] validates the result.
+type NARInfoBuilder struct {
+	info NARInfo
+}
+
+// StorePath sets the store path of the store object.
+func (b *NARInfoBuilder) StorePath(path StorePath) *NARInfoBuilder {
+	b.info.StorePath = path
+	return b
+}
+
+// URL sets the path to download the .nar file from,
+// relative to the .narinfo file's directory.
+func (b *NARInfoBuilder) URL(u string) *NARInfoBuilder {
+	b.info.URL = u
+	return b
+}
+
+// SetCompression sets the algorithm used for the file referenced by the URL.
+func (b *NARInfoBuilder) SetCompression(ct CompressionType) *NARInfoBuilder {
+	b.info.Compression = ct
+	return b
+}
+
+// FileHash sets the hash of the file referenced by the URL.
+func (b *NARInfoBuilder) FileHash(h Hash) *NARInfoBuilder {
+	b.info.FileHash = h
+	return b
+}
+
+// FileSize sets the size in bytes of the file referenced by the URL.
+func (b *NARInfoBuilder) FileSize(n int64) *NARInfoBuilder {
+	b.info.FileSize = n
+	return b
+}
+
+// NARHash sets the hash of the decompressed .nar file.
+func (b *NARInfoBuilder) NARHash(h Hash) *NARInfoBuilder {
+	b.info.NARHash = h
+	return b
+}
+
+// NARSize sets the size in bytes of the decompressed .nar file.
+func (b *NARInfoBuilder) NARSize(n int64) *NARInfoBuilder {
+	b.info.NARSize = n
+	return b
+}
+
+// AddReference adds store objects to the set of references.
+func (b *NARInfoBuilder) AddReference(refs ...StorePath) *NARInfoBuilder {
+	b.info.References = append(b.info.References, refs...)
+	return b
+}
+
+// Deriver sets the store derivation of the store object.
+func (b *NARInfoBuilder) Deriver(drv StorePath) *NARInfoBuilder {
+	b.info.Deriver = drv
+	return b
+}
+
+// AddSignature adds signatures that are not already present.
+func (b *NARInfoBuilder) AddSignature(sigs ...*Signature) *NARInfoBuilder {
+	b.info.AddSignatures(sigs...)
+	return b
+}
+
+// CA sets the content-addressability assertion of the store object.
+func (b *NARInfoBuilder) CA(ca ContentAddress) *NARInfoBuilder {
+	b.info.CA = ca
+	return b
+}
+
+// Build returns a new [NARInfo] with the fields set so far
+// or an error if the fields do not form a valid [NARInfo].
+// The builder may continue to be used after calling Build
+// without affecting the returned value.
+func (b *NARInfoBuilder) Build() (*NARInfo, error) {
+	info := new(NARInfo)
+	*info = b.info
+	if info.Compression == "" {
+		info.Compression = Bzip2
+	}
+	info.References = append([]StorePath(nil), b.info.References...)
+	info.Sig = append([]*Signature(nil), b.info.Sig...)
+	if err := info.validate(); err != nil {
+		return nil, fmt.Errorf("build narinfo: %v", err)
+	}
+	return info, nil
+}
+
 // WriteFingerprint writes the store object's "fingerprint" to the given writer.
 // The fingerprint is the string used for signing.
 func (info *NARInfo) WriteFingerprint(w io.Writer) error {
@@ -314,6 +456,8 @@ func (info *NARInfo) UnmarshalText(src []byte) (err error) {
 			}
 			info.System = string(value)
 		case "Sig":
+			// Tolerate whitespace from reflowed or hand-edited files.
+			value = bytes.TrimSpace(value)
 			sig := new(Signature)
 			if err := sig.UnmarshalText(value); err != nil {
 				return fmt.Errorf("line %d: Sig: %v", lineno, err)
@@ -365,6 +509,67 @@ func (info *NARInfo) UnmarshalText(src []byte) (err error) {
 	return info.validate()
 }
 
+// UnmarshalTextStrict decodes a .narinfo file like [NARInfo.UnmarshalText],
+// but additionally requires that the URL field is a relative path
+// that does not escape the .narinfo file's directory
+// (for example, by starting with "/" or containing ".." elements).
+// Binary caches written by Nix always satisfy this,
+// so UnmarshalTextStrict is useful for rejecting malicious .narinfo files early.
+func (info *NARInfo) UnmarshalTextStrict(src []byte) error {
+	if err := info.UnmarshalText(src); err != nil {
+		return err
+	}
+	if err := validateNARInfoURL(info.URL); err != nil {
+		return fmt.Errorf("unmarshal narinfo: %v", err)
+	}
+	return nil
+}
+
+// validateNARInfoURL returns an error if u is not a relative URL
+// that stays within the .narinfo file's directory.
+func validateNARInfoURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("url: %v", err)
+	}
+	if parsed.Scheme != "" || parsed.Host != "" || parsed.User != nil {
+		return fmt.Errorf("url %q is not relative", u)
+	}
+	if strings.HasPrefix(parsed.Path, "/") {
+		return fmt.Errorf("url %q has an absolute path", u)
+	}
+	if p := slashpath.Clean(parsed.Path); p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("url %q is outside the cache", u)
+	}
+	return nil
+}
+
+// ParseNARInfos parses a sequence of .narinfo documents separated by blank lines.
+// Each document is parsed and validated independently
+// as if by [NARInfo.UnmarshalText].
+// If a document fails to parse,
+// the error includes the document's zero-based index in data.
+func ParseNARInfos(data []byte) ([]*NARInfo, error) {
+	var infos []*NARInfo
+	for {
+		data = bytes.TrimLeft(data, "\n")
+		if len(data) == 0 {
+			return infos, nil
+		}
+		var block []byte
+		if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+			block, data = data[:i+1], data[i+2:]
+		} else {
+			block, data = data, nil
+		}
+		info := new(NARInfo)
+		if err := info.UnmarshalText(block); err != nil {
+			return infos, fmt.Errorf("parse narinfos: document %d: %w", len(infos), err)
+		}
+		infos = append(infos, info)
+	}
+}
+
 // MarshalText encodes the information as a .narinfo file.
 func (info *NARInfo) MarshalText() ([]byte, error) {
 	if err := info.validate(); err != nil {
@@ -429,6 +634,197 @@ func (info *NARInfo) MarshalText() ([]byte, error) {
 	return buf, nil
 }
 
+// narInfoJSON is the JSON representation of a [NARInfo].
+// Field names follow the output of "nix path-info --json".
+type narInfoJSON struct {
+	StorePath    StorePath       `json:"path"`
+	URL          string          `json:"url"`
+	Compression  CompressionType `json:"compression,omitempty"`
+	DownloadHash string          `json:"downloadHash,omitempty"`
+	DownloadSize int64           `json:"downloadSize,omitempty"`
+	NARHash      string          `json:"narHash"`
+	NARSize      int64           `json:"narSize"`
+	References   []StorePath     `json:"references"`
+	Deriver      StorePath       `json:"deriver,omitempty"`
+	System       string          `json:"system,omitempty"`
+	Signatures   []string        `json:"signatures,omitempty"`
+	CA           string          `json:"ca,omitempty"`
+}
+
+// ContentHash returns the SHA-256 hash of the .narinfo file
+// that [NARInfo.MarshalText] produces for info.
+// It identifies the .narinfo file itself (like an HTTP ETag),
+// so it changes whenever any field changes,
+// unlike NARHash, which only depends on the store object's contents.
+// ContentHash returns the zero Hash if info cannot be marshaled.
+func (info *NARInfo) ContentHash() Hash {
+	text, err := info.MarshalText()
+	if err != nil {
+		return Hash{}
+	}
+	h := NewHasher(SHA256)
+	h.Write(text)
+	return h.SumHash()
+}
+
+// MarshalJSON encodes the information as a JSON object
+// using the same field names as "nix path-info --json".
+// Hashes are formatted as [Subresource Integrity hash expressions].
+//
+// [Subresource Integrity hash expressions]: https://www.w3.org/TR/SRI/#the-integrity-attribute
+func (info *NARInfo) MarshalJSON() ([]byte, error) {
+	if err := info.validate(); err != nil {
+		return nil, fmt.Errorf("marshal narinfo json: %v", err)
+	}
+	obj := &narInfoJSON{
+		StorePath:    info.StorePath,
+		URL:          info.URL,
+		Compression:  info.Compression,
+		DownloadSize: info.FileSize,
+		NARHash:      info.NARHash.SRI(),
+		NARSize:      info.NARSize,
+		References:   info.References,
+		Deriver:      info.Deriver,
+		System:       info.System,
+		CA:           info.CA.String(),
+	}
+	if obj.Compression == "" {
+		obj.Compression = Bzip2
+	}
+	if !info.FileHash.IsZero() {
+		obj.DownloadHash = info.FileHash.SRI()
+	}
+	if obj.References == nil {
+		obj.References = []StorePath{}
+	}
+	for _, sig := range info.Sig {
+		obj.Signatures = append(obj.Signatures, sig.String())
+	}
+	return json.Marshal(obj)
+}
+
+// UnmarshalJSON decodes a JSON object produced by [NARInfo.MarshalJSON].
+// It applies the same defaults and validation as [NARInfo.UnmarshalText].
+func (info *NARInfo) UnmarshalJSON(data []byte) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("unmarshal narinfo json: %v", err)
+		}
+	}()
+
+	var obj narInfoJSON
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*info = NARInfo{
+		StorePath:   obj.StorePath,
+		URL:         obj.URL,
+		Compression: obj.Compression,
+		FileSize:    obj.DownloadSize,
+		NARSize:     obj.NARSize,
+		Deriver:     obj.Deriver,
+		System:      obj.System,
+	}
+	if len(obj.References) > 0 {
+		info.References = obj.References
+	}
+	if obj.DownloadHash != "" {
+		if err := info.FileHash.UnmarshalText([]byte(obj.DownloadHash)); err != nil {
+			return fmt.Errorf("downloadHash: %v", err)
+		}
+	}
+	if obj.NARHash != "" {
+		if err := info.NARHash.UnmarshalText([]byte(obj.NARHash)); err != nil {
+			return fmt.Errorf("narHash: %v", err)
+		}
+	}
+	for _, s := range obj.Signatures {
+		sig, err := ParseSignature(s)
+		if err != nil {
+			return fmt.Errorf("signatures: %v", err)
+		}
+		info.Sig = append(info.Sig, sig)
+	}
+	if obj.CA != "" {
+		if err := info.CA.UnmarshalText([]byte(obj.CA)); err != nil {
+			return fmt.Errorf("ca: %v", err)
+		}
+	}
+
+	if info.Compression == "" {
+		info.Compression = Bzip2
+	}
+	if info.Compression == NoCompression {
+		if info.FileHash.IsZero() {
+			info.FileHash = info.NARHash
+		}
+		if info.FileSize == 0 {
+			info.FileSize = info.NARSize
+		}
+	}
+	return info.validate()
+}
+
+// MarshaledSize returns the number of bytes that [NARInfo.MarshalText] would return.
+// It returns an error in the same circumstances as MarshalText.
+// MarshaledSize computes the size without allocating the marshaled form.
+func (info *NARInfo) MarshaledSize() (int, error) {
+	if err := info.validate(); err != nil {
+		return 0, fmt.Errorf("marshal narinfo: %v", err)
+	}
+
+	n := len("StorePath: ") + len(info.StorePath) +
+		len("\nURL: ") + len(info.URL) +
+		len("\nCompression: ")
+	if info.Compression == "" {
+		n += len(Bzip2)
+	} else {
+		n += len(info.Compression)
+	}
+	if !info.FileHash.IsZero() {
+		n += len("\nFileHash: ") + base32HashLen(info.FileHash)
+	}
+	if info.FileSize != 0 {
+		n += len("\nFileSize: ") + decimalLen(info.FileSize)
+	}
+	n += len("\nNarHash: ") + base32HashLen(info.NARHash)
+	n += len("\nNarSize: ") + decimalLen(info.NARSize)
+	if len(info.References) > 0 {
+		n += len("\nReferences:")
+		for _, ref := range info.References {
+			n += len(" ") + len(ref.Base())
+		}
+	}
+	if info.Deriver != "" {
+		n += len("\nDeriver: ") + len(info.Deriver.Base())
+	}
+	if info.System != "" {
+		n += len("\nSystem: ") + len(info.System)
+	}
+	for _, sig := range info.Sig {
+		if sig == nil {
+			return 0, fmt.Errorf("marshal narinfo: marshal nix signature: cannot marshal nil")
+		}
+		n += len("\nSig: ") + len(sig.name) + len(":") + base64.StdEncoding.EncodedLen(len(sig.data))
+	}
+	if !info.CA.IsZero() {
+		n += len("\nCA: ") + len(info.CA.String())
+	}
+	n += len("\n")
+	return n, nil
+}
+
+// base32HashLen returns the length of h.Base32().
+func base32HashLen(h Hash) int {
+	return len(h.Type().String()) + len(":") + nixbase32.EncodedLen(h.Type().Size())
+}
+
+// decimalLen returns the number of bytes needed to format i in base 10.
+func decimalLen(i int64) int {
+	var buf [20]byte
+	return len(strconv.AppendInt(buf[:0], i, 10))
+}
+
 // CompressionType is an enumeration of compression algorithms used in [NARInfo].
 type CompressionType string
 
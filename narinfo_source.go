@@ -0,0 +1,45 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned by a [NARInfoSource]
+// when it does not have information for the requested store object.
+// Implementations may wrap ErrNotFound,
+// so callers should use [errors.Is] to test for it.
+var ErrNotFound = errors.New("nix: not found")
+
+// A NARInfoSource looks up [NARInfo] for store objects,
+// like a binary cache.
+type NARInfoSource interface {
+	// NARInfo returns the information for the store object
+	// whose store path has the given digest
+	// (e.g. "s66mzxpvicwk07gjbjfw9izjfa797vsw").
+	// If the source does not have the store object,
+	// NARInfo returns an error that wraps [ErrNotFound].
+	NARInfo(ctx context.Context, digest string) (*NARInfo, error)
+}
+
+// MapNARInfoSource is an in-memory [NARInfoSource]
+// keyed by store path digest.
+// It is primarily intended for tests.
+type MapNARInfoSource map[string]*NARInfo
+
+// Add adds info to the map, keyed by the digest of info.StorePath.
+// It replaces any existing information for the same digest.
+func (m MapNARInfoSource) Add(info *NARInfo) {
+	m[info.StorePath.Digest()] = info
+}
+
+// NARInfo returns the information stored in the map for the given digest.
+// The returned NARInfo is the same pointer stored in the map.
+func (m MapNARInfoSource) NARInfo(ctx context.Context, digest string) (*NARInfo, error) {
+	info := m[digest]
+	if info == nil {
+		return nil, fmt.Errorf("look up %s: %w", digest, ErrNotFound)
+	}
+	return info, nil
+}
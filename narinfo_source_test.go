@@ -0,0 +1,28 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMapNARInfoSource(t *testing.T) {
+	info := &NARInfo{
+		StorePath: "/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1",
+		URL:       "nar/1nhgq6wcggx0plpy4991h3ginj6hipsdslv4fd4zml1n707j26yq.nar.xz",
+		NARHash:   mustParseHash(t, "sha256:0yzhigwjl6bws649vcs2asa4lbs8hg93hyix187gc7s7a74w5h80"),
+		NARSize:   226488,
+	}
+	src := make(MapNARInfoSource)
+	src.Add(info)
+	var _ NARInfoSource = src
+
+	ctx := context.Background()
+	if got, err := src.NARInfo(ctx, "s66mzxpvicwk07gjbjfw9izjfa797vsw"); got != info || err != nil {
+		t.Errorf("src.NARInfo(ctx, %q) = %p, %v; want %p, <nil>", "s66mzxpvicwk07gjbjfw9izjfa797vsw", got, err, info)
+	}
+	const missing = "3n58xw4373jp0ljirf06d8077j15pc4j"
+	if got, err := src.NARInfo(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("src.NARInfo(ctx, %q) = %p, %v; want <nil>, %v", missing, got, err, ErrNotFound)
+	}
+}
@@ -1,6 +1,7 @@
 package nix
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -84,6 +85,34 @@ func TestNARInfoMarshalText(t *testing.T) {
 	}
 }
 
+func TestNARInfoMarshaledSize(t *testing.T) {
+	for _, test := range makeNARInfoUnmarshalTests(t) {
+		if test.err {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			info := new(NARInfo)
+			*info = *test.want
+			info.System = "x86_64-linux"
+			info.CA = RecursiveFileContentAddress(info.NARHash)
+			for _, info := range []*NARInfo{test.want, info} {
+				data, err := info.MarshalText()
+				if err != nil {
+					t.Fatal("MarshalText():", err)
+				}
+				got, err := info.MarshaledSize()
+				if got != len(data) || err != nil {
+					t.Errorf("MarshaledSize() = %d, %v; want %d, <nil>", got, err, len(data))
+				}
+			}
+		})
+	}
+
+	if n, err := new(NARInfo).MarshaledSize(); err == nil {
+		t.Errorf("new(NARInfo).MarshaledSize() = %d, <nil>; want _, <error>", n)
+	}
+}
+
 type narInfoUnmarshalTest struct {
 	name string
 	data string
@@ -126,6 +155,27 @@ func makeNARInfoUnmarshalTests(tb testing.TB) []narInfoUnmarshalTest {
 				Sig:     []*Signature{mustParseSignature(tb, "cache.nixos.org-1:8ijECciSFzWHwwGVOIVYdp2fOIOJAfmzGHPQVwpktfTQJF6kMPPDre7UtFw3o+VqenC5P8RikKOAAfN7CvPEAg==")},
 			},
 		},
+		{
+			name: "SigWhitespace",
+			data: "StorePath: /nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1\n" +
+				"URL: nar/1nhgq6wcggx0plpy4991h3ginj6hipsdslv4fd4zml1n707j26yq.nar.xz\n" +
+				"Compression: xz\n" +
+				"FileHash: sha256:1nhgq6wcggx0plpy4991h3ginj6hipsdslv4fd4zml1n707j26yq\n" +
+				"FileSize: 50088\n" +
+				"NarHash: sha256:0yzhigwjl6bws649vcs2asa4lbs8hg93hyix187gc7s7a74w5h80\n" +
+				"NarSize: 226488\n" +
+				"Sig:  cache.nixos.org-1:8ijECciSFzWHwwGVOIVYdp2fOIOJAfmzGHPQVwpktfTQJF6kMPPDre7UtFw3o+VqenC5P8RikKOAAfN7CvPEAg==  \n",
+			want: &NARInfo{
+				StorePath:   "/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1",
+				URL:         "nar/1nhgq6wcggx0plpy4991h3ginj6hipsdslv4fd4zml1n707j26yq.nar.xz",
+				Compression: XZ,
+				FileHash:    mustParseHash(tb, "sha256:1nhgq6wcggx0plpy4991h3ginj6hipsdslv4fd4zml1n707j26yq"),
+				FileSize:    50088,
+				NARHash:     mustParseHash(tb, "sha256:0yzhigwjl6bws649vcs2asa4lbs8hg93hyix187gc7s7a74w5h80"),
+				NARSize:     226488,
+				Sig:         []*Signature{mustParseSignature(tb, "cache.nixos.org-1:8ijECciSFzWHwwGVOIVYdp2fOIOJAfmzGHPQVwpktfTQJF6kMPPDre7UtFw3o+VqenC5P8RikKOAAfN7CvPEAg==")},
+			},
+		},
 		{
 			name: "MinimalCompression",
 			data: "StorePath: /nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1\n" +
@@ -197,6 +247,147 @@ func makeNARInfoUnmarshalTests(tb testing.TB) []narInfoUnmarshalTest {
 	}
 }
 
+// findNARInfoUnmarshalTest returns the test case from [makeNARInfoUnmarshalTests]
+// with the given name.
+func findNARInfoUnmarshalTest(tb testing.TB, name string) narInfoUnmarshalTest {
+	tb.Helper()
+	for _, test := range makeNARInfoUnmarshalTests(tb) {
+		if test.name == name {
+			return test
+		}
+	}
+	tb.Fatalf("no narinfo unmarshal test named %q", name)
+	return narInfoUnmarshalTest{}
+}
+
+// makeCurlNARInfo returns the narinfo for curl-7.82.0-bin from cache.nixos.org.
+// Only the fields covered by the signature are from the cache;
+// the URL is that of an uncompressed NAR.
+func makeCurlNARInfo(tb testing.TB) *NARInfo {
+	return &NARInfo{
+		StorePath:   "/nix/store/syd87l2rxw8cbsxmxl853h0r6pdwhwjr-curl-7.82.0-bin",
+		URL:         "nar/1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0.nar",
+		Compression: NoCompression,
+		NARHash:     mustParseHash(tb, "sha256:1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0"),
+		NARSize:     196040,
+		References: []StorePath{
+			"/nix/store/0jqd0rlxzra1rs38rdxl43yh6rxchgc6-curl-7.82.0",
+			"/nix/store/6w8g7njm4mck5dmjxws0z1xnrxvl81xa-glibc-2.34-115",
+			"/nix/store/j5jxw3iy7bbz4a57fh9g2xm2gxmyal8h-zlib-1.2.12",
+			"/nix/store/yxvjs9drzsphm9pcf42a4byzj1kb9m7k-openssl-1.1.1n",
+		},
+		Sig: []*Signature{
+			mustParseSignature(tb, "cache.nixos.org-1:TsTTb3WGTZKphvYdBHXwo6weVILmTytUjLB+vcX89fOjjRicCHmKA4RCPMVLkj6TMJ4GMX3HPVWRdD1hkeKZBQ=="),
+		},
+	}
+}
+
+func TestNARInfoBuilder(t *testing.T) {
+	want := makeCurlNARInfo(t)
+	b := new(NARInfoBuilder).
+		StorePath("/nix/store/syd87l2rxw8cbsxmxl853h0r6pdwhwjr-curl-7.82.0-bin").
+		URL("nar/1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0.nar").
+		SetCompression(NoCompression).
+		NARHash(mustParseHash(t, "sha256:1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0")).
+		NARSize(196040).
+		AddReference(
+			"/nix/store/0jqd0rlxzra1rs38rdxl43yh6rxchgc6-curl-7.82.0",
+			"/nix/store/6w8g7njm4mck5dmjxws0z1xnrxvl81xa-glibc-2.34-115",
+		).
+		AddReference("/nix/store/j5jxw3iy7bbz4a57fh9g2xm2gxmyal8h-zlib-1.2.12").
+		AddReference("/nix/store/yxvjs9drzsphm9pcf42a4byzj1kb9m7k-openssl-1.1.1n").
+		AddSignature(mustParseSignature(t, "cache.nixos.org-1:TsTTb3WGTZKphvYdBHXwo6weVILmTytUjLB+vcX89fOjjRicCHmKA4RCPMVLkj6TMJ4GMX3HPVWRdD1hkeKZBQ=="))
+	got, err := b.Build()
+	if err != nil {
+		t.Fatal("Build():", err)
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(compareSignatures)); diff != "" {
+		t.Errorf("Build() (-want +got):\n%s", diff)
+	}
+	// The cache's signature covers the built fields.
+	pub, err := ParsePublicKey(nixosPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyNARInfo([]*PublicKey{pub}, got, got.Sig[0]); err != nil {
+		t.Errorf("VerifyNARInfo(...) on built narinfo: %v", err)
+	}
+
+	// Modifying the builder should not affect previously built values.
+	b.AddReference("/nix/store/ib3sh3pcz10wsmavxvkdbayhqivbghlq-hello-2.12.1.drv")
+	if got, want := len(got.References), len(want.References); got != want {
+		t.Errorf("after AddReference, len(got.References) = %d; want %d", got, want)
+	}
+
+	if info, err := new(NARInfoBuilder).StorePath("/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1").Build(); err == nil {
+		t.Errorf("Build() with missing fields = %+v, <nil>; want _, <error>", info)
+	}
+}
+
+func TestNARInfoCanonicalize(t *testing.T) {
+	want := findNARInfoUnmarshalTest(t, "Hello").want
+	info := &NARInfo{
+		StorePath:   " /nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1\t",
+		URL:         "nar/1nhgq6wcggx0plpy4991h3ginj6hipsdslv4fd4zml1n707j26yq.nar.xz ",
+		Compression: " XZ",
+		FileHash:    want.FileHash,
+		FileSize:    want.FileSize,
+		NARHash:     want.NARHash,
+		NARSize:     want.NARSize,
+		References: []StorePath{
+			"/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1",
+			" /nix/store/3n58xw4373jp0ljirf06d8077j15pc4j-glibc-2.37-8",
+			"/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1 ",
+		},
+		Deriver: "/nix/store/ib3sh3pcz10wsmavxvkdbayhqivbghlq-hello-2.12.1.drv\n",
+		Sig:     want.Sig,
+	}
+	info.Canonicalize()
+	if diff := cmp.Diff(want, info, cmp.Comparer(compareSignatures)); diff != "" {
+		t.Errorf("after Canonicalize (-want +got):\n%s", diff)
+	}
+
+	// Canonicalize should be idempotent.
+	info.Canonicalize()
+	if diff := cmp.Diff(want, info, cmp.Comparer(compareSignatures)); diff != "" {
+		t.Errorf("after second Canonicalize (-want +got):\n%s", diff)
+	}
+}
+
+func TestNARInfoHasDeprecatedFields(t *testing.T) {
+	const base = "StorePath: /nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1\n" +
+		"URL: nar/1nhgq6wcggx0plpy4991h3ginj6hipsdslv4fd4zml1n707j26yq.nar.xz\n" +
+		"Compression: xz\n" +
+		"NarHash: sha256:1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0\n" +
+		"NarSize: 196040\n"
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{name: "Modern", text: base, want: false},
+		{name: "System", text: base + "System: x86_64-linux\n", want: true},
+	}
+	for _, test := range tests {
+		info := new(NARInfo)
+		if err := info.UnmarshalText([]byte(test.text)); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := info.HasDeprecatedFields(); got != test.want {
+			t.Errorf("%s: HasDeprecatedFields() = %t; want %t", test.name, got, test.want)
+		}
+		text, err := info.MarshalText()
+		if err != nil {
+			t.Errorf("%s: MarshalText: %v", test.name, err)
+			continue
+		}
+		if got, want := strings.Contains(string(text), "\nSystem:"), test.want; got != want {
+			t.Errorf("%s: MarshalText() = %q; contains System = %t, want %t", test.name, text, got, want)
+		}
+	}
+}
+
 func TestNARInfoUnmarshalText(t *testing.T) {
 	for _, test := range makeNARInfoUnmarshalTests(t) {
 		t.Run(test.name, func(t *testing.T) {
@@ -218,6 +409,134 @@ func TestNARInfoUnmarshalText(t *testing.T) {
 	}
 }
 
+func TestNARInfoUnmarshalTextStrict(t *testing.T) {
+	const base = "StorePath: /nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1\n" +
+		"Compression: xz\n" +
+		"NarHash: sha256:1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0\n" +
+		"NarSize: 196040\n"
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{url: "nar/1nhgq6wcggx0plpy4991h3ginj6hipsdslv4fd4zml1n707j26yq.nar.xz", ok: true},
+		{url: "1nhgq6wcggx0plpy4991h3ginj6hipsdslv4fd4zml1n707j26yq.nar.xz", ok: true},
+		{url: "nar/../nar/foo.nar.xz", ok: true},
+		{url: "../secret.nar.xz"},
+		{url: "nar/../../secret.nar.xz"},
+		{url: "/etc/passwd"},
+		{url: "https://example.com/nar/foo.nar.xz"},
+		{url: "//example.com/nar/foo.nar.xz"},
+		{url: "file:///etc/passwd"},
+	}
+	for _, test := range tests {
+		data := []byte(base + "URL: " + test.url + "\n")
+
+		// Lenient parsing accepts all of these.
+		if err := new(NARInfo).UnmarshalText(data); err != nil {
+			t.Errorf("UnmarshalText with URL %q: %v", test.url, err)
+		}
+
+		err := new(NARInfo).UnmarshalTextStrict(data)
+		if test.ok && err != nil {
+			t.Errorf("UnmarshalTextStrict with URL %q: %v", test.url, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("UnmarshalTextStrict with URL %q = <nil>; want error", test.url)
+		}
+	}
+}
+
+func TestNARInfoContentHash(t *testing.T) {
+	info := findNARInfoUnmarshalTest(t, "Hello").want
+	text, err := info.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHasher(SHA256)
+	h.Write(text)
+	want := h.SumHash()
+	if got := info.ContentHash(); !got.Equal(want) {
+		t.Errorf("ContentHash() = %v; want %v", got, want)
+	}
+
+	info.AddSignatures(mustParseSignature(t, "cache.example.com-1:8ijECciSFzWHwwGVOIVYdp2fOIOJAfmzGHPQVwpktfTQJF6kMPPDre7UtFw3o+VqenC5P8RikKOAAfN7CvPEAg=="))
+	if got := info.ContentHash(); got.Equal(want) {
+		t.Errorf("ContentHash() after adding signature = %v; want different hash", got)
+	}
+
+	if got := new(NARInfo).ContentHash(); !got.IsZero() {
+		t.Errorf("new(NARInfo).ContentHash() = %v; want zero hash", got)
+	}
+}
+
+func TestNARInfoJSON(t *testing.T) {
+	for _, test := range makeNARInfoUnmarshalTests(t) {
+		if test.err {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			data, err := test.want.MarshalJSON()
+			if err != nil {
+				t.Fatal("MarshalJSON():", err)
+			}
+			got := new(NARInfo)
+			if err := got.UnmarshalJSON(data); err != nil {
+				t.Logf("JSON:\n%s", data)
+				t.Fatal("UnmarshalJSON(...):", err)
+			}
+			if diff := cmp.Diff(test.want, got, cmp.Comparer(compareSignatures)); diff != "" {
+				t.Errorf("after round-trip (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		const data = `{"path":"/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1","url":"nar/foo.nar","narSize":1}`
+		if err := new(NARInfo).UnmarshalJSON([]byte(data)); err == nil {
+			t.Error("UnmarshalJSON(...) = <nil>; want error")
+		}
+	})
+}
+
+func TestParseNARInfos(t *testing.T) {
+	var valid []narInfoUnmarshalTest
+	for _, test := range makeNARInfoUnmarshalTests(t) {
+		if !test.err {
+			valid = append(valid, test)
+		}
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		var data string
+		var want []*NARInfo
+		for i, test := range valid {
+			if i > 0 {
+				data += "\n"
+			}
+			data += test.data
+			want = append(want, test.want)
+		}
+		got, err := ParseNARInfos([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got, cmp.Comparer(compareSignatures)); diff != "" {
+			t.Errorf("-want +got:\n%s", diff)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		data := valid[0].data + "\n" +
+			"StorePath: /nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1\n"
+		_, err := ParseNARInfos([]byte(data))
+		if err == nil {
+			t.Fatal("ParseNARInfos(...) did not return an error")
+		}
+		if got, want := err.Error(), "document 1"; !strings.Contains(got, want) {
+			t.Errorf("ParseNARInfos(...) error = %q; want to contain %q", got, want)
+		}
+	})
+}
+
 func FuzzNARInfo(f *testing.F) {
 	for _, test := range makeNARInfoUnmarshalTests(f) {
 		f.Add([]byte(test.data))
@@ -9,6 +9,7 @@ doesn't use any padding), which makes adopting encoding/base32 hard.
 package nixbase32
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 )
@@ -39,6 +40,13 @@ func Decode(dst, src []byte) (n int, err error) {
 		if digit == -1 {
 			return i, fmt.Errorf("decode base32: character %q not in Nix alphabet", c)
 		}
+		if i >= maxDstSize {
+			// Character is entirely padding.
+			if digit != 0 {
+				return maxDstSize, fmt.Errorf("decode base32: non-zero padding")
+			}
+			continue
+		}
 
 		// OR the main pattern
 		dst[i] |= byte(digit) << j
@@ -68,7 +76,12 @@ func ValidateString(src string) error {
 			return fmt.Errorf("decode base32: character %q not in Nix alphabet", c)
 		}
 
-		if i+1 >= maxDstSize {
+		if i >= maxDstSize {
+			// Character is entirely padding.
+			if digit != 0 {
+				return fmt.Errorf("decode base32: non-zero padding")
+			}
+		} else if i+1 >= maxDstSize {
 			if carry := byte(digit) >> (8 - j); carry != 0 {
 				// but have a nonzero carry, the encoding is invalid.
 				return fmt.Errorf("decode base32: non-zero padding")
@@ -127,6 +140,24 @@ func EncodeToString(src []byte) string {
 	return dst.String()
 }
 
+// Equal reports whether a and b are both valid nixbase32 strings
+// that decode to the same bytes.
+// It returns false if either string is invalid.
+// Strings of different lengths can be equal
+// when the longer one only adds leading zero characters
+// that lie entirely in the padding bits: Equal("0z", "00z") is true.
+func Equal(a, b string) bool {
+	decA, err := DecodeString(a)
+	if err != nil {
+		return false
+	}
+	decB, err := DecodeString(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(decA, decB)
+}
+
 // Is reports whether the given byte is part of the nixbase32 alphabet.
 func Is(c byte) bool {
 	return '0' <= c && c <= '9' ||
@@ -35,6 +35,8 @@ var invalidEncodings = []string{
 	"zz",
 	// this is an even more specific example - it'd decode as 00000000 11
 	"c0",
+	// the leading character is entirely padding, so it must be zero
+	"z0z",
 }
 
 func TestEncode(t *testing.T) {
@@ -86,6 +88,22 @@ func TestDecodeString(t *testing.T) {
 	}
 }
 
+func TestDecodePaddingOnly(t *testing.T) {
+	// In a 3 character string, the leading character lies entirely
+	// past the single decoded byte. Decoding such strings used to panic.
+	got, err := DecodeString("00z")
+	if want := []byte{0x1f}; err != nil || !bytes.Equal(got, want) {
+		t.Errorf("DecodeString(%q) = %02x, %v; want %02x, <nil>", "00z", got, err, want)
+	}
+	dst := make([]byte, DecodedLen(3))
+	if n, err := Decode(dst, []byte("z0z")); err == nil {
+		t.Errorf("Decode(dst, %q) = %d, <nil>; want _, <error>", "z0z", n)
+	}
+	if err := ValidateString("z0z"); err == nil {
+		t.Errorf("ValidateString(%q) = <nil>; want <error>", "z0z")
+	}
+}
+
 func TestEncodedLen(t *testing.T) {
 	for _, test := range tests {
 		n := len(test.dec)
@@ -117,6 +135,49 @@ func TestValidateString(t *testing.T) {
 	}
 }
 
+func TestEqual(t *testing.T) {
+	for _, test := range tests {
+		if !Equal(test.enc, test.enc) {
+			t.Errorf("Equal(%q, %q) = false; want true", test.enc, test.enc)
+		}
+	}
+	// Leading zero characters can be entirely padding,
+	// so strings of different lengths can be equal.
+	equal := []struct {
+		a, b string
+	}{
+		{"0z", "00z"},
+		{"00z", "0z"},
+		{"", "0"},
+	}
+	for _, test := range equal {
+		if !Equal(test.a, test.b) {
+			t.Errorf("Equal(%q, %q) = false; want true", test.a, test.b)
+		}
+	}
+	unequal := []struct {
+		a, b string
+	}{
+		{"0z", "0y"},
+		{"0z", ""},
+		{"0z", "000z"},
+		{tests[2].enc, tests[1].enc},
+	}
+	for _, test := range unequal {
+		if Equal(test.a, test.b) {
+			t.Errorf("Equal(%q, %q) = true; want false", test.a, test.b)
+		}
+	}
+	for _, enc := range invalidEncodings {
+		if Equal(enc, enc) {
+			t.Errorf("Equal(%q, %q) = true; want false", enc, enc)
+		}
+		if Equal(enc, "0z") || Equal("0z", enc) {
+			t.Errorf("Equal(%q, %q) = true; want false", enc, "0z")
+		}
+	}
+}
+
 func TestIs(t *testing.T) {
 	for c := int16(0); c <= 0xff; c++ {
 		got := Is(byte(c))
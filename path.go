@@ -1,6 +1,7 @@
 package nix
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"os"
 	slashpath "path"
@@ -52,6 +53,95 @@ func (dir StoreDirectory) Object(name string) (StorePath, error) {
 	return storePath, nil
 }
 
+// FixedOutputPath computes the store path of a fixed-output store object
+// (e.g. the output of a fixed-output derivation or a path added with "nix-store --add")
+// with the given name, content address, and references.
+// It follows makeFixedOutputPath in the Nix source.
+// Only store objects with a recursive (NAR) SHA-256 content address may have references.
+func (dir StoreDirectory) FixedOutputPath(name string, ca ContentAddress, refs References) (StorePath, error) {
+	if !ca.IsFixed() {
+		return "", fmt.Errorf("compute fixed output path for %s: %v is not a fixed-output content address", name, ca)
+	}
+	h := ca.Hash()
+	if ca.IsRecursiveFile() && h.Type() == SHA256 {
+		return dir.makeStorePath(makeStorePathType("source", refs), h, name)
+	}
+	if refs.Self || len(refs.Others) > 0 {
+		return "", fmt.Errorf("compute fixed output path for %s: references not allowed for %v", name, ca)
+	}
+	inner := NewHasher(SHA256)
+	inner.WriteString("fixed:out:")
+	if ca.IsRecursiveFile() {
+		inner.WriteString(caFixedRecursiveFlag)
+	}
+	inner.WriteString(h.Base16())
+	inner.WriteString(":")
+	return dir.makeStorePath("output:out", inner.SumHash(), name)
+}
+
+// StorePath computes the store path of a content-addressed store object
+// with the given name, content address, and references.
+// self indicates whether the store object references itself.
+// It follows makeFixedOutputPathFromCA in the Nix source:
+// text content addresses are handled like [StoreDirectory.TextPath]
+// and all others like [StoreDirectory.FixedOutputPath].
+func (dir StoreDirectory) StorePath(name string, ca ContentAddress, refs []StorePath, self bool) (StorePath, error) {
+	references := References{Self: self, Others: refs}
+	if !ca.IsText() {
+		return dir.FixedOutputPath(name, ca, references)
+	}
+	h := ca.Hash()
+	if h.Type() != SHA256 {
+		return "", fmt.Errorf("compute store path for %s: text content address must use %v (got %v)", name, SHA256, h.Type())
+	}
+	if self {
+		return "", fmt.Errorf("compute store path for %s: text store objects cannot reference themselves", name)
+	}
+	return dir.makeStorePath(makeStorePathType("text", references), h, name)
+}
+
+// TextPath computes the store path of a text store object
+// (e.g. a derivation file or the result of builtins.toFile)
+// with the given name, content, and references.
+// It is equivalent to calling [StoreDirectory.StorePath]
+// with a [TextContentAddress] of data's SHA-256 hash.
+// Text store objects cannot reference themselves.
+func (dir StoreDirectory) TextPath(name string, data []byte, refs []StorePath) (StorePath, error) {
+	h := NewHasher(SHA256)
+	h.Write(data)
+	return dir.StorePath(name, TextContentAddress(h.SumHash()), refs, false)
+}
+
+// makeStorePath computes a store path from its type, inner hash, and name.
+// It follows makeStorePath in the Nix source.
+func (dir StoreDirectory) makeStorePath(typ string, h Hash, name string) (StorePath, error) {
+	fingerprint := typ + ":" + h.Base16() + ":" + string(dir) + ":" + name
+	sum := sha256.Sum256([]byte(fingerprint))
+	var digest [storeDigestSize]byte
+	CompressHash(digest[:], sum[:])
+	storePath, err := dir.Object(EncodeStoreDigest(digest) + "-" + name)
+	if err != nil {
+		return "", fmt.Errorf("compute store path for %s: %v", name, err)
+	}
+	return storePath, nil
+}
+
+// makeStorePathType returns the type string for [StoreDirectory.makeStorePath]
+// that includes the given references.
+// It follows makeType in the Nix source.
+func makeStorePathType(typ string, refs References) string {
+	sb := new(strings.Builder)
+	sb.WriteString(typ)
+	for _, ref := range refs.sortedOthers() {
+		sb.WriteString(":")
+		sb.WriteString(string(ref))
+	}
+	if refs.Self {
+		sb.WriteString(":self")
+	}
+	return sb.String()
+}
+
 // Join joins any number of path elements to the store directory
 // separated by slashes.
 func (dir StoreDirectory) Join(elem ...string) string {
@@ -93,8 +183,9 @@ func (dir StoreDirectory) ParsePath(path string) (storePath StorePath, sub strin
 type StorePath string
 
 const (
-	objectNameDigestLength = 32
-	maxObjectNameLength    = objectNameDigestLength + 1 + 211
+	objectNameDigestLength  = 32
+	storeDigestSize         = 20
+	maxObjectNamePartLength = 211
 )
 
 // ParseStorePath parses an absolute slash-separated path as a [store path]
@@ -102,15 +193,27 @@ const (
 //
 // [store path]: https://nixos.org/manual/nix/stable/glossary.html#gloss-store-path
 func ParseStorePath(path string) (StorePath, error) {
+	return ParseStorePathWithDigestLength(path, objectNameDigestLength)
+}
+
+// ParseStorePathWithDigestLength parses an absolute slash-separated path
+// in the same way as [ParseStorePath],
+// but expects the digest part of the store object name
+// to be digestLength nixbase32 characters instead of the usual 32.
+// This is intended for experimental stores that use a different digest size.
+func ParseStorePathWithDigestLength(path string, digestLength int) (StorePath, error) {
+	if digestLength <= 0 {
+		return "", fmt.Errorf("parse nix store path %s: invalid digest length %d", path, digestLength)
+	}
 	if !slashpath.IsAbs(path) {
 		return "", fmt.Errorf("parse nix store path %s: not absolute", path)
 	}
 	cleaned := slashpath.Clean(path)
 	_, base := slashpath.Split(cleaned)
-	if len(base) < objectNameDigestLength+len("-")+1 {
+	if len(base) < digestLength+len("-")+1 {
 		return "", fmt.Errorf("parse nix store path %s: %q is too short", path, base)
 	}
-	if len(base) > maxObjectNameLength {
+	if len(base) > digestLength+len("-")+maxObjectNamePartLength {
 		return "", fmt.Errorf("parse nix store path %s: %q is too long", path, base)
 	}
 	for i := 0; i < len(base); i++ {
@@ -118,10 +221,10 @@ func ParseStorePath(path string) (StorePath, error) {
 			return "", fmt.Errorf("parse nix store path %s: %q contains illegal character %q", path, base, base[i])
 		}
 	}
-	if err := nixbase32.ValidateString(base[:objectNameDigestLength]); err != nil {
+	if err := nixbase32.ValidateString(base[:digestLength]); err != nil {
 		return "", fmt.Errorf("parse nix store path %s: %v", path, err)
 	}
-	if base[objectNameDigestLength] != '-' {
+	if base[digestLength] != '-' {
 		return "", fmt.Errorf("parse nix store path %s: digest not separated by dash", path)
 	}
 	return StorePath(cleaned), nil
@@ -149,21 +252,87 @@ func (path StorePath) IsDerivation() bool {
 }
 
 // Digest returns the digest part of the name.
+// It assumes the digest is the usual 32 characters;
+// use [StorePath.SplitDigest] for paths parsed
+// with [ParseStorePathWithDigestLength].
 func (path StorePath) Digest() string {
-	base := path.Base()
-	if len(base) < objectNameDigestLength {
+	digest, _ := path.SplitDigest(objectNameDigestLength)
+	return digest
+}
+
+// NARInfoName returns the name of the .narinfo resource
+// for the store object in a binary cache
+// (i.e. the digest followed by [NARInfoExtension]).
+// It returns the empty string if path is empty.
+func (path StorePath) NARInfoName() string {
+	digest := path.Digest()
+	if digest == "" {
 		return ""
 	}
-	return string(base[:objectNameDigestLength])
+	return digest + NARInfoExtension
+}
+
+// StorePathFromNARInfoName returns the store path digest
+// from the name of a .narinfo resource in a binary cache
+// (e.g. "s66mzxpvicwk07gjbjfw9izjfa797vsw.narinfo").
+// It is the inverse of [StorePath.NARInfoName].
+// ok is false if name does not end in [NARInfoExtension]
+// or does not start with a valid store path digest.
+func StorePathFromNARInfoName(name string) (digest string, ok bool) {
+	digest, ok = cutSuffix(name, NARInfoExtension)
+	if !ok || len(digest) != objectNameDigestLength {
+		return "", false
+	}
+	if err := nixbase32.ValidateString(digest); err != nil {
+		return "", false
+	}
+	return digest, true
+}
+
+// DecodeStoreDigest decodes the nixbase32-encoded digest part
+// of a store object name (as returned by [StorePath.Digest])
+// into its raw 20 bytes.
+func DecodeStoreDigest(s string) ([storeDigestSize]byte, error) {
+	var digest [storeDigestSize]byte
+	if len(s) != objectNameDigestLength {
+		return digest, fmt.Errorf("decode store digest %q: wrong length (expected %d characters)", s, objectNameDigestLength)
+	}
+	if _, err := nixbase32.Decode(digest[:], []byte(s)); err != nil {
+		return [storeDigestSize]byte{}, fmt.Errorf("decode store digest %q: %v", s, err)
+	}
+	return digest, nil
+}
+
+// EncodeStoreDigest encodes the raw bytes of a store object digest
+// to the nixbase32 form used in store object names.
+// It is the inverse of [DecodeStoreDigest].
+func EncodeStoreDigest(b [storeDigestSize]byte) string {
+	return nixbase32.EncodeToString(b[:])
 }
 
 // Name returns the part of the name after the digest.
+// It assumes the digest is the usual 32 characters;
+// use [StorePath.SplitDigest] for paths parsed
+// with [ParseStorePathWithDigestLength].
 func (path StorePath) Name() string {
+	_, name := path.SplitDigest(objectNameDigestLength)
+	return name
+}
+
+// SplitDigest splits the path's name into its digest part,
+// which is assumed to be digestLength characters long,
+// and the part of the name after the digest.
+// Each part is empty if the name is too short to contain it.
+func (path StorePath) SplitDigest(digestLength int) (digest, name string) {
 	base := path.Base()
-	if len(base) <= objectNameDigestLength+len("-") {
-		return ""
+	if digestLength <= 0 || len(base) < digestLength {
+		return "", ""
 	}
-	return string(base[objectNameDigestLength+len("-"):])
+	digest = base[:digestLength]
+	if len(base) > digestLength+len("-") {
+		name = base[digestLength+len("-"):]
+	}
+	return digest, name
 }
 
 // MarshalText returns a byte slice of the path
@@ -193,6 +362,13 @@ func cutPrefix(s, prefix string) (after string, found bool) {
 	return s[len(prefix):], true
 }
 
+func cutSuffix(s, suffix string) (before string, found bool) {
+	if !strings.HasSuffix(s, suffix) {
+		return s, false
+	}
+	return s[:len(s)-len(suffix)], true
+}
+
 func isNameChar(c byte) bool {
 	return 'a' <= c && c <= 'z' ||
 		'A' <= c && c <= 'Z' ||
@@ -1,9 +1,13 @@
 package nix
 
 import (
+	"os"
 	slashpath "path"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"zombiezen.com/go/nix/nixbase32"
 )
 
 var storePathTests = []struct {
@@ -142,6 +146,66 @@ func TestParseStorePath(t *testing.T) {
 	}
 }
 
+func TestParseStorePathWithDigestLength(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		for _, test := range storePathTests {
+			got, err := ParseStorePathWithDigestLength(test.path, 32)
+			want, wantErr := ParseStorePath(test.path)
+			if got != want || (err == nil) != (wantErr == nil) {
+				t.Errorf("ParseStorePathWithDigestLength(%q, 32) = %q, %v; want %q, %v", test.path, got, err, want, wantErr)
+			}
+		}
+	})
+
+	t.Run("Longer", func(t *testing.T) {
+		const (
+			digest = "1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0"
+			path   = "/nix/store/" + digest + "-hello-2.12.1"
+		)
+		got, err := ParseStorePathWithDigestLength(path, len(digest))
+		if got != path || err != nil {
+			t.Fatalf("ParseStorePathWithDigestLength(%q, %d) = %q, %v; want %q, <nil>", path, len(digest), got, err, path)
+		}
+		if gotDigest, gotName := got.SplitDigest(len(digest)); gotDigest != digest || gotName != "hello-2.12.1" {
+			t.Errorf("SplitDigest(%d) = %q, %q; want %q, %q", len(digest), gotDigest, gotName, digest, "hello-2.12.1")
+		}
+		// Digest and Name always assume the default length.
+		if got, want := got.Digest(), digest[:32]; got != want {
+			t.Errorf("Digest() = %q; want %q", got, want)
+		}
+		if got, err := ParseStorePath(path); err == nil {
+			t.Errorf("ParseStorePath(%q) = %q, <nil>; want _, <error>", path, got)
+		}
+	})
+}
+
+func TestStorePathDigestUnvalidated(t *testing.T) {
+	// Digest and Name use the fixed digest length
+	// even for paths that were never validated.
+	tests := []struct {
+		path       StorePath
+		digestPart string
+		namePart   string
+	}{
+		{path: "/nix/store/foo-bar"},
+		{path: ""},
+		{
+			// A dash inside the first 32 characters does not end the digest.
+			path:       "/nix/store/foo-bar-aaaaaaaaaaaaaaaaaaaaaaaaaa-baz",
+			digestPart: "foo-bar-aaaaaaaaaaaaaaaaaaaaaaaa",
+			namePart:   "a-baz",
+		},
+	}
+	for _, test := range tests {
+		if got := test.path.Digest(); got != test.digestPart {
+			t.Errorf("StorePath(%q).Digest() = %q; want %q", test.path, got, test.digestPart)
+		}
+		if got := test.path.Name(); got != test.namePart {
+			t.Errorf("StorePath(%q).Name() = %q; want %q", test.path, got, test.namePart)
+		}
+	}
+}
+
 func TestStoreDirectoryObject(t *testing.T) {
 	for _, test := range storePathTests {
 		if test.err {
@@ -252,3 +316,312 @@ func TestStoreDirectoryParsePath(t *testing.T) {
 		}
 	}
 }
+
+func TestNARInfoName(t *testing.T) {
+	const (
+		path   StorePath = "/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1"
+		digest           = "s66mzxpvicwk07gjbjfw9izjfa797vsw"
+		name             = digest + ".narinfo"
+	)
+	if got := path.NARInfoName(); got != name {
+		t.Errorf("StorePath(%q).NARInfoName() = %q; want %q", path, got, name)
+	}
+	if got := StorePath("").NARInfoName(); got != "" {
+		t.Errorf("StorePath(\"\").NARInfoName() = %q; want \"\"", got)
+	}
+
+	tests := []struct {
+		name   string
+		digest string
+		ok     bool
+	}{
+		{name: name, digest: digest, ok: true},
+		{name: digest},
+		{name: digest + ".nar"},
+		{name: ".narinfo"},
+		{name: "s66mzxpvicwk07gjbjfw9izjfa797vs.narinfo"},
+		{name: "eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee.narinfo"},
+		{name: "nix-cache-info"},
+	}
+	for _, test := range tests {
+		digest, ok := StorePathFromNARInfoName(test.name)
+		if digest != test.digest || ok != test.ok {
+			t.Errorf("StorePathFromNARInfoName(%q) = %q, %t; want %q, %t", test.name, digest, ok, test.digest, test.ok)
+		}
+	}
+}
+
+func TestStoreDigest(t *testing.T) {
+	const digest = "s66mzxpvicwk07gjbjfw9izjfa797vsw"
+	raw, err := DecodeStoreDigest(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := EncodeStoreDigest(raw); got != digest {
+		t.Errorf("EncodeStoreDigest(DecodeStoreDigest(%q)) = %q; want %q", digest, got, digest)
+	}
+	if got, want := nixbase32.EncodeToString(raw[:]), digest; got != want {
+		t.Errorf("nixbase32.EncodeToString(DecodeStoreDigest(%q)) = %q; want %q", digest, got, want)
+	}
+
+	var zero [20]byte
+	if got, want := EncodeStoreDigest(zero), "00000000000000000000000000000000"; got != want {
+		t.Errorf("EncodeStoreDigest(zero) = %q; want %q", got, want)
+	}
+
+	badDigests := []string{
+		"",
+		"s66mzxpvicwk07gjbjfw9izjfa797vs",
+		"s66mzxpvicwk07gjbjfw9izjfa797vswx",
+		"e66mzxpvicwk07gjbjfw9izjfa797vsw",
+		"s66mzxpvicwk07gjbjfw9izjfa797vsw-hello",
+	}
+	for _, s := range badDigests {
+		if got, err := DecodeStoreDigest(s); err == nil {
+			t.Errorf("DecodeStoreDigest(%q) = %x, <nil>; want _, <error>", s, got)
+		}
+	}
+}
+
+func TestFixedOutputPath(t *testing.T) {
+	tests := []struct {
+		name string
+		ca   ContentAddress
+		refs References
+		want StorePath
+		err  bool
+	}{
+		{
+			name: "mini-drv",
+			ca:   RecursiveFileContentAddress(mustParseHash(t, "sha256-wylwH83f/6yIiGEkfm8NjZ0LQZhUrMdu5z1r9SGf8mg=")),
+			want: "/nix/store/nhy91l6b2hmv52pzz7ckmwp8z8v531np-mini-drv",
+		},
+		{
+			name: "bar",
+			ca:   RecursiveFileContentAddress(mustParseHash(t, "sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9")),
+			refs: References{
+				Self: true,
+				Others: []StorePath{
+					"/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1",
+					"/nix/store/3n58xw4373jp0ljirf06d8077j15pc4j-glibc-2.37-8",
+				},
+			},
+			want: "/nix/store/2r4xwqyskn2657n1xm63rla13hs8x7rw-bar",
+		},
+		{
+			name: "hello.txt",
+			ca:   FlatFileContentAddress(mustParseHash(t, "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")),
+			want: "/nix/store/gy454w1cxaq731grqwylhzf4pp9r5izh-hello.txt",
+		},
+		{
+			name: "foo",
+			ca:   RecursiveFileContentAddress(mustParseHash(t, "sha1:0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33")),
+			want: "/nix/store/kmry9qv00y9i8k22p3wkdlpw765m6gxk-foo",
+		},
+		{
+			name: "hello.txt",
+			ca:   FlatFileContentAddress(mustParseHash(t, "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")),
+			refs: References{Self: true},
+			err:  true,
+		},
+		{
+			name: "hello.txt",
+			ca:   TextContentAddress(mustParseHash(t, "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")),
+			err:  true,
+		},
+		{
+			name: "foo/bar",
+			ca:   FlatFileContentAddress(mustParseHash(t, "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")),
+			err:  true,
+		},
+		{
+			name: "foo bar",
+			ca:   FlatFileContentAddress(mustParseHash(t, "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")),
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		got, err := DefaultStoreDirectory.FixedOutputPath(test.name, test.ca, test.refs)
+		if test.err {
+			if err == nil {
+				t.Errorf("DefaultStoreDirectory.FixedOutputPath(%q, %v, %+v) = %q, <nil>; want _, <error>", test.name, test.ca, test.refs, got)
+			}
+			continue
+		}
+		if got != test.want || err != nil {
+			t.Errorf("DefaultStoreDirectory.FixedOutputPath(%q, %v, %+v) = %q, %v; want %q, <nil>", test.name, test.ca, test.refs, got, err, test.want)
+		}
+	}
+}
+
+func TestTextPath(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		refs []StorePath
+		want StorePath
+		err  bool
+	}{
+		{
+			name: "hello.txt",
+			data: "Hello, World!\n",
+			want: "/nix/store/q4dz47g15qmlsm01aijr737w8avkaac6-hello.txt",
+		},
+		{
+			name: "foo.drv",
+			data: "Derive([])",
+			refs: []StorePath{
+				"/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1",
+				"/nix/store/3n58xw4373jp0ljirf06d8077j15pc4j-glibc-2.37-8",
+				"/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1",
+			},
+			want: "/nix/store/17s00gzc5jy68k1gs0a8kjgv2x385f5h-foo.drv",
+		},
+		{
+			// nix-repl> builtins.toFile "foo" "bar"
+			// "/nix/store/vxjiwkjkn7x4079qvh1jkl5pn05j2aw0-foo"
+			name: "foo",
+			data: "bar",
+			want: "/nix/store/vxjiwkjkn7x4079qvh1jkl5pn05j2aw0-foo",
+		},
+		{
+			// nix-repl> builtins.toFile "baz" "${builtins.toFile "foo" "bar"}"
+			// "/nix/store/5xd714cbfnkz02h2vbsj4fm03x3f15nf-baz"
+			name: "baz",
+			data: "/nix/store/vxjiwkjkn7x4079qvh1jkl5pn05j2aw0-foo",
+			refs: []StorePath{"/nix/store/vxjiwkjkn7x4079qvh1jkl5pn05j2aw0-foo"},
+			want: "/nix/store/5xd714cbfnkz02h2vbsj4fm03x3f15nf-baz",
+		},
+		{
+			name: "foo/bar",
+			data: "Hello, World!\n",
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		got, err := DefaultStoreDirectory.TextPath(test.name, []byte(test.data), test.refs)
+		if test.err {
+			if err == nil {
+				t.Errorf("DefaultStoreDirectory.TextPath(%q, %q, %q) = %q, <nil>; want _, <error>", test.name, test.data, test.refs, got)
+			}
+			continue
+		}
+		if got != test.want || err != nil {
+			t.Errorf("DefaultStoreDirectory.TextPath(%q, %q, %q) = %q, %v; want %q, <nil>", test.name, test.data, test.refs, got, err, test.want)
+		}
+	}
+
+	t.Run("Derivation", func(t *testing.T) {
+		// Derivations written by Nix and named after their store paths.
+		// See testdata/README.md for the expressions that produced them.
+		drvTests := []struct {
+			want StorePath
+			refs []StorePath
+		}{
+			{want: "/nix/store/0hm2f1psjpcwg8fijsmr4wwxrx59s092-bar.drv"},
+			{
+				want: "/nix/store/4wvvbi4jwn0prsdxb7vs673qa5h9gr7x-foo.drv",
+				refs: []StorePath{"/nix/store/0hm2f1psjpcwg8fijsmr4wwxrx59s092-bar.drv"},
+			},
+		}
+		for _, test := range drvTests {
+			data, err := os.ReadFile(filepath.Join("testdata", test.want.Base()))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			got, err := DefaultStoreDirectory.TextPath(test.want.Name(), data, test.refs)
+			if got != test.want || err != nil {
+				t.Errorf("DefaultStoreDirectory.TextPath(%q, <testdata>, %q) = %q, %v; want %q, <nil>", test.want.Name(), test.refs, got, err, test.want)
+			}
+		}
+	})
+}
+
+func TestStoreDirectoryStorePath(t *testing.T) {
+	tests := []struct {
+		dir  StoreDirectory
+		name string
+		ca   ContentAddress
+		refs []StorePath
+		self bool
+		want StorePath
+		err  bool
+	}{
+		{
+			// The output path Nix gave to testdata/0hm2f1psjpcwg8fijsmr4wwxrx59s092-bar.drv.
+			name: "bar",
+			ca:   RecursiveFileContentAddress(mustParseHash(t, "sha256:08813cbee9903c62be4c5027726a418a300da4500b2d369d3af9286f4815ceba")),
+			want: "/nix/store/4q0pg5zpfmznxscq3avycvf9xdvx50n3-bar",
+		},
+		{
+			// TODO(someday): This value was computed by StorePath, not by Nix.
+			// Replace it with the output of
+			// nix-store --store 'local?store=/foo' --add-fixed --recursive sha256
+			// on a directory with the same NAR hash.
+			dir:  "/foo",
+			name: "bar",
+			ca:   RecursiveFileContentAddress(mustParseHash(t, "sha256:08813cbee9903c62be4c5027726a418a300da4500b2d369d3af9286f4815ceba")),
+			want: "/foo/f4mfws5hrf4il65ihimak7lhqhr1x5br-bar",
+		},
+		{
+			name: "hello.txt",
+			// sha256 of "Hello, World!\n"
+			ca:   TextContentAddress(mustParseHash(t, "sha256:c98c24b677eff44860afea6f493bbaec5bb1c4cbb209c6fc2bbb47f66ff2ad31")),
+			want: "/nix/store/q4dz47g15qmlsm01aijr737w8avkaac6-hello.txt",
+		},
+		{
+			name: "hello.txt",
+			ca:   TextContentAddress(mustParseHash(t, "sha256:c98c24b677eff44860afea6f493bbaec5bb1c4cbb209c6fc2bbb47f66ff2ad31")),
+			self: true,
+			err:  true,
+		},
+		{
+			name: "hello.txt",
+			ca:   TextContentAddress(mustParseHash(t, "sha1:0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33")),
+			err:  true,
+		},
+		{
+			name: "mini-drv",
+			ca:   RecursiveFileContentAddress(mustParseHash(t, "sha256-wylwH83f/6yIiGEkfm8NjZ0LQZhUrMdu5z1r9SGf8mg=")),
+			want: "/nix/store/nhy91l6b2hmv52pzz7ckmwp8z8v531np-mini-drv",
+		},
+		{
+			name: "bar",
+			ca:   RecursiveFileContentAddress(mustParseHash(t, "sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9")),
+			refs: []StorePath{
+				"/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1",
+				"/nix/store/3n58xw4373jp0ljirf06d8077j15pc4j-glibc-2.37-8",
+			},
+			self: true,
+			want: "/nix/store/2r4xwqyskn2657n1xm63rla13hs8x7rw-bar",
+		},
+		{
+			name: "hello.txt",
+			ca:   FlatFileContentAddress(mustParseHash(t, "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")),
+			want: "/nix/store/gy454w1cxaq731grqwylhzf4pp9r5izh-hello.txt",
+		},
+		{
+			name: "hello.txt",
+			ca:   FlatFileContentAddress(mustParseHash(t, "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03")),
+			self: true,
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		dir := test.dir
+		if dir == "" {
+			dir = DefaultStoreDirectory
+		}
+		got, err := dir.StorePath(test.name, test.ca, test.refs, test.self)
+		if test.err {
+			if err == nil {
+				t.Errorf("StoreDirectory(%q).StorePath(%q, %v, %q, %t) = %q, <nil>; want _, <error>", dir, test.name, test.ca, test.refs, test.self, got)
+			}
+			continue
+		}
+		if got != test.want || err != nil {
+			t.Errorf("StoreDirectory(%q).StorePath(%q, %v, %q, %t) = %q, %v; want %q, <nil>", dir, test.name, test.ca, test.refs, test.self, got, err, test.want)
+		}
+	}
+}
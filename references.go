@@ -0,0 +1,233 @@
+package nix
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"zombiezen.com/go/nix/nixbase32"
+)
+
+// References represents the set of store objects
+// that a store object refers to,
+// for the purpose of computing its store path.
+// A store object's reference to itself is tracked separately from other references,
+// since it cannot be known until the store path has been computed.
+type References struct {
+	// Self is true if the store object refers to itself.
+	Self bool
+	// Others is the set of other store objects that the store object refers to.
+	Others []StorePath
+}
+
+// selfReferencePlaceholder is used in place of a store object's own path
+// in [References.String].
+const selfReferencePlaceholder = "<self>"
+
+// MakeReferences returns the [References] for the store object at self
+// given the full set of store paths that it refers to
+// (e.g. the References field of a [NARInfo]).
+// If paths contains self, then the returned References' Self field is true.
+// The Others field is sorted and does not contain duplicates.
+func MakeReferences(self StorePath, paths []StorePath) References {
+	var refs References
+	for _, p := range paths {
+		if p == self {
+			refs.Self = true
+		} else {
+			refs.Add(p)
+		}
+	}
+	return refs
+}
+
+// IsEmpty reports whether refs does not contain any references.
+func (refs References) IsEmpty() bool {
+	return !refs.Self && len(refs.Others) == 0
+}
+
+// Add adds store paths to refs.Others,
+// keeping refs.Others sorted and free of duplicates.
+func (refs *References) Add(paths ...StorePath) {
+	for _, p := range paths {
+		i := sort.Search(len(refs.Others), func(i int) bool {
+			return refs.Others[i] >= p
+		})
+		if i < len(refs.Others) && refs.Others[i] == p {
+			continue
+		}
+		refs.Others = append(refs.Others, "")
+		copy(refs.Others[i+1:], refs.Others[i:])
+		refs.Others[i] = p
+	}
+}
+
+// ToSet returns the full set of store paths in refs as a sorted slice
+// without duplicates, using self as the store object's own path.
+// It is the inverse of [MakeReferences].
+func (refs References) ToSet(self StorePath) []StorePath {
+	paths := refs.sortedOthers()
+	if refs.Self {
+		i := sort.Search(len(paths), func(i int) bool {
+			return paths[i] >= self
+		})
+		if i >= len(paths) || paths[i] != self {
+			paths = append(paths, "")
+			copy(paths[i+1:], paths[i:])
+			paths[i] = self
+		}
+	}
+	return paths
+}
+
+// String returns the sorted references separated by commas.
+// A self-reference is represented by "<self>" at the end of the list.
+func (refs References) String() string {
+	sb := new(strings.Builder)
+	for i, ref := range refs.sortedOthers() {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(string(ref))
+	}
+	if refs.Self {
+		if sb.Len() > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(selfReferencePlaceholder)
+	}
+	return sb.String()
+}
+
+// sortedOthers returns a sorted copy of refs.Others without duplicates.
+func (refs References) sortedOthers() []StorePath {
+	others := append([]StorePath(nil), refs.Others...)
+	sort.Slice(others, func(i, j int) bool {
+		return others[i] < others[j]
+	})
+	// Remove duplicates in-place.
+	n := 0
+	for i, ref := range others {
+		if i > 0 && ref == others[n-1] {
+			continue
+		}
+		others[n] = ref
+		n++
+	}
+	return others[:n]
+}
+
+// ScanReferences reads r until EOF
+// and returns the subset of candidates whose digests appear in the data,
+// sorted and without duplicates.
+// It is used to compute the runtime references of a store object
+// (typically by scanning its NAR serialization).
+// Every candidate must be a store path in dir.
+func ScanReferences(dir StoreDirectory, candidates []StorePath, r io.Reader) ([]StorePath, error) {
+	s, err := NewReferenceScanner(dir, candidates)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(s, r); err != nil {
+		return nil, fmt.Errorf("scan references: %w", err)
+	}
+	return s.Found(), nil
+}
+
+// A ReferenceScanner is an [io.Writer] that searches the data written to it
+// for the digests of a set of candidate store paths,
+// using the same algorithm as Nix's reference scanner.
+// Digests split across calls to Write are detected.
+type ReferenceScanner struct {
+	// candidates is a map of digests to store paths.
+	candidates map[string]StorePath
+	found      map[StorePath]struct{}
+	// tail holds the last bytes written,
+	// up to one byte less than a digest.
+	tail []byte
+	// window is a buffer used by Write to search across write boundaries.
+	// It is stored in the ReferenceScanner to avoid an allocation per call.
+	window [2 * (objectNameDigestLength - 1)]byte
+}
+
+// NewReferenceScanner returns a new [ReferenceScanner]
+// that searches for the given candidates.
+// Every candidate must be a store path in dir.
+func NewReferenceScanner(dir StoreDirectory, candidates []StorePath) (*ReferenceScanner, error) {
+	s := &ReferenceScanner{
+		candidates: make(map[string]StorePath, len(candidates)),
+		found:      make(map[StorePath]struct{}),
+		tail:       make([]byte, 0, objectNameDigestLength-1),
+	}
+	for _, c := range candidates {
+		if c.Dir() != dir {
+			return nil, fmt.Errorf("scan references: %s is not in %s", c, dir)
+		}
+		digest := c.Digest()
+		if len(digest) != objectNameDigestLength {
+			return nil, fmt.Errorf("scan references: %s: digest is not %d characters", c, objectNameDigestLength)
+		}
+		s.candidates[digest] = c
+	}
+	return s, nil
+}
+
+// Write searches p for candidate digests.
+// It always returns len(p), nil.
+func (s *ReferenceScanner) Write(p []byte) (n int, err error) {
+	// Search for digests that start in the previous write
+	// and end in this one.
+	overlap := len(p)
+	if overlap > objectNameDigestLength-1 {
+		overlap = objectNameDigestLength - 1
+	}
+	if len(s.tail) > 0 {
+		window := append(s.window[:0], s.tail...)
+		window = append(window, p[:overlap]...)
+		s.search(window)
+	}
+	s.search(p)
+
+	// Keep the last bytes written for the next call.
+	if keep := cap(s.tail) - overlap; len(s.tail) > keep {
+		s.tail = s.tail[:copy(s.tail, s.tail[len(s.tail)-keep:])]
+	}
+	s.tail = append(s.tail, p[len(p)-overlap:]...)
+	return len(p), nil
+}
+
+// search records every candidate digest that appears in data.
+func (s *ReferenceScanner) search(data []byte) {
+	for i := 0; i+objectNameDigestLength <= len(data); {
+		// Check characters from the end of the window
+		// so that an invalid character lets us skip ahead past it.
+		j := objectNameDigestLength - 1
+		for ; j >= 0; j-- {
+			if !nixbase32.Is(data[i+j]) {
+				break
+			}
+		}
+		if j >= 0 {
+			i += j + 1
+			continue
+		}
+		if path, ok := s.candidates[string(data[i:i+objectNameDigestLength])]; ok {
+			s.found[path] = struct{}{}
+		}
+		i++
+	}
+}
+
+// Found returns the candidates that have been found so far,
+// sorted and without duplicates.
+func (s *ReferenceScanner) Found() []StorePath {
+	paths := make([]StorePath, 0, len(s.found))
+	for path := range s.found {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return paths[i] < paths[j]
+	})
+	return paths
+}
@@ -0,0 +1,207 @@
+package nix
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestReferences(t *testing.T) {
+	const (
+		self  StorePath = "/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1"
+		glibc StorePath = "/nix/store/3n58xw4373jp0ljirf06d8077j15pc4j-glibc-2.37-8"
+		drv   StorePath = "/nix/store/ib3sh3pcz10wsmavxvkdbayhqivbghlq-hello-2.12.1.drv"
+	)
+	tests := []struct {
+		name       string
+		paths      []StorePath
+		want       References
+		wantString string
+		wantSet    []StorePath
+	}{
+		{
+			name: "Empty",
+		},
+		{
+			name:       "SelfOnly",
+			paths:      []StorePath{self},
+			want:       References{Self: true},
+			wantString: "<self>",
+			wantSet:    []StorePath{self},
+		},
+		{
+			name:       "Others",
+			paths:      []StorePath{drv, glibc, drv},
+			want:       References{Others: []StorePath{glibc, drv}},
+			wantString: string(glibc) + "," + string(drv),
+			wantSet:    []StorePath{glibc, drv},
+		},
+		{
+			name:       "SelfAndOthers",
+			paths:      []StorePath{self, glibc},
+			want:       References{Self: true, Others: []StorePath{glibc}},
+			wantString: string(glibc) + ",<self>",
+			wantSet:    []StorePath{glibc, self},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := MakeReferences(self, test.paths)
+			if diff := cmp.Diff(test.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("MakeReferences(...) (-want +got):\n%s", diff)
+			}
+			if got, want := got.IsEmpty(), len(test.paths) == 0; got != want {
+				t.Errorf("IsEmpty() = %t; want %t", got, want)
+			}
+			if s := got.String(); s != test.wantString {
+				t.Errorf("String() = %q; want %q", s, test.wantString)
+			}
+			if diff := cmp.Diff(test.wantSet, got.ToSet(self), cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("ToSet(...) (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestScanReferences(t *testing.T) {
+	const (
+		glibc StorePath = "/nix/store/3n58xw4373jp0ljirf06d8077j15pc4j-glibc-2.37-8"
+		hello StorePath = "/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1"
+		drv   StorePath = "/nix/store/ib3sh3pcz10wsmavxvkdbayhqivbghlq-hello-2.12.1.drv"
+	)
+	candidates := []StorePath{glibc, hello, drv}
+	tests := []struct {
+		name string
+		data string
+		want []StorePath
+	}{
+		{
+			name: "Empty",
+			data: "",
+		},
+		{
+			name: "FullPath",
+			data: "#!" + string(hello) + "/bin/sh\n",
+			want: []StorePath{hello},
+		},
+		{
+			name: "DigestOnly",
+			data: "\x00\x003n58xw4373jp0ljirf06d8077j15pc4j\x00",
+			want: []StorePath{glibc},
+		},
+		{
+			name: "Multiple",
+			data: string(glibc) + "/lib:" + string(hello) + ":" + string(glibc) + "/lib64",
+			want: []StorePath{glibc, hello},
+		},
+		{
+			name: "Truncated",
+			data: "3n58xw4373jp0ljirf06d8077j15pc4",
+		},
+		{
+			name: "InsideLongerRun",
+			// Nix matches any 32-character window of base-32 characters.
+			data: "aaaa3n58xw4373jp0ljirf06d8077j15pc4jaaaa",
+			want: []StorePath{glibc},
+		},
+		{
+			name: "NotCandidate",
+			data: "/nix/store/ffffffffffffffffffffffffffffffff-foo",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ScanReferences(DefaultStoreDirectory, candidates, strings.NewReader(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("ScanReferences(...) (-want +got):\n%s", diff)
+			}
+
+			// Split the data at every possible boundary.
+			for size := 1; size < len(test.data); size++ {
+				s, err := NewReferenceScanner(DefaultStoreDirectory, candidates)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < len(test.data); i += size {
+					end := i + size
+					if end > len(test.data) {
+						end = len(test.data)
+					}
+					s.Write([]byte(test.data[i:end]))
+				}
+				if diff := cmp.Diff(test.want, s.Found(), cmpopts.EquateEmpty()); diff != "" {
+					t.Errorf("Found() after writes of %d bytes (-want +got):\n%s", size, diff)
+				}
+			}
+		})
+	}
+
+	t.Run("WrongDirectory", func(t *testing.T) {
+		_, err := ScanReferences("/foo", candidates, strings.NewReader(""))
+		if err == nil {
+			t.Error("ScanReferences did not return an error")
+		}
+	})
+}
+
+func BenchmarkScanReferences(b *testing.B) {
+	const glibc StorePath = "/nix/store/3n58xw4373jp0ljirf06d8077j15pc4j-glibc-2.37-8"
+	candidates := []StorePath{
+		glibc,
+		"/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1",
+		"/nix/store/ib3sh3pcz10wsmavxvkdbayhqivbghlq-hello-2.12.1.drv",
+	}
+
+	// Simulate a large binary: mostly arbitrary bytes
+	// with a reference every so often.
+	data := make([]byte, 64<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	for i := 0; i+len(glibc) <= len(data); i += 1 << 20 {
+		copy(data[i:], glibc)
+	}
+
+	b.Run("Large", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			got, err := ScanReferences(DefaultStoreDirectory, candidates, bytes.NewReader(data))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(got) != 1 {
+				b.Fatalf("ScanReferences(...) = %q; want [%q]", got, glibc)
+			}
+		}
+	})
+
+	// Small writes search across every write boundary.
+	b.Run("SmallWrites", func(b *testing.B) {
+		const chunkSize = 512
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			s, err := NewReferenceScanner(DefaultStoreDirectory, candidates)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for p := data; len(p) > 0; {
+				n := chunkSize
+				if n > len(p) {
+					n = len(p)
+				}
+				s.Write(p[:n])
+				p = p[n:]
+			}
+			if got := s.Found(); len(got) != 1 {
+				b.Fatalf("Found() = %q; want [%q]", got, glibc)
+			}
+		}
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"strings"
 	"unicode"
 )
 
@@ -23,11 +24,8 @@ func unmarshalKey(s []byte, wantDataSize int) (name string, data []byte, err err
 	if !ok {
 		return "", nil, fmt.Errorf("missing ':'")
 	}
-	if len(nameBytes) == 0 {
-		return "", nil, fmt.Errorf("name is empty")
-	}
-	if bytes.IndexFunc(nameBytes, unicode.IsSpace) != -1 {
-		return "", nil, fmt.Errorf("name %q contains spaces", nameBytes)
+	if err := validateKeyName(string(nameBytes)); err != nil {
+		return "", nil, err
 	}
 
 	data = make([]byte, base64.StdEncoding.DecodedLen(len(base64Data)))
@@ -43,12 +41,39 @@ func unmarshalKey(s []byte, wantDataSize int) (name string, data []byte, err err
 	return string(nameBytes), data, nil
 }
 
+func validateKeyName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("name is empty")
+	}
+	if strings.IndexFunc(name, unicode.IsSpace) != -1 {
+		return fmt.Errorf("name %q contains spaces", name)
+	}
+	return nil
+}
+
 // A PublicKey is a Nix public signing key.
 type PublicKey struct {
 	name string
 	data ed25519.PublicKey
 }
 
+// NewPublicKey returns a new public key with the given name
+// and raw ed25519 key bytes.
+// NewPublicKey returns an error if the name is empty or contains spaces
+// or if the key is not [ed25519.PublicKeySize] bytes long.
+func NewPublicKey(name string, key ed25519.PublicKey) (*PublicKey, error) {
+	if err := validateKeyName(name); err != nil {
+		return nil, fmt.Errorf("new nix public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("new nix public key %s: key is %d bytes (expected %d)", name, len(key), ed25519.PublicKeySize)
+	}
+	return &PublicKey{
+		name: name,
+		data: append(ed25519.PublicKey(nil), key...),
+	}, nil
+}
+
 // ParsePublicKey parses the string encoding of a public key.
 // It is a wrapper around [PublicKey.UnmarshalText].
 func ParsePublicKey(s string) (*PublicKey, error) {
@@ -64,6 +89,11 @@ func (pub *PublicKey) Name() string {
 	return pub.name
 }
 
+// Bytes returns a copy of the raw ed25519 public key.
+func (pub *PublicKey) Bytes() []byte {
+	return append([]byte(nil), pub.data...)
+}
+
 // String formats the public key as "<name>:<base64 data>".
 func (pub *PublicKey) String() string {
 	return string(marshalKey(pub.name, pub.data))
@@ -88,6 +118,13 @@ func (pub *PublicKey) UnmarshalText(data []byte) error {
 	return nil
 }
 
+// Verify reports whether sig is a valid signature of fingerprint by pub.
+// The signature's name must match the public key's name.
+// For store objects, the fingerprint is the output of [NARInfo.WriteFingerprint].
+func (pub *PublicKey) Verify(fingerprint []byte, sig *Signature) bool {
+	return sig.name == pub.name && ed25519.Verify(pub.data, fingerprint, sig.data)
+}
+
 // A PrivateKey is a Nix private signing key.
 // It is used to produce a [Signature]
 // for a Nix store object (represented by [NARInfo]).
@@ -222,13 +259,7 @@ func VerifyNARInfo(trusted []*PublicKey, info *NARInfo, sig *Signature) error {
 	if info.StorePath == "" {
 		return fmt.Errorf("verify nar info: empty store path")
 	}
-	var foundPub *PublicKey
-	for _, pub := range trusted {
-		if pub.Name() == sig.Name() {
-			foundPub = pub
-			break
-		}
-	}
+	foundPub := findPublicKey(trusted, sig.Name())
 	if foundPub == nil {
 		return fmt.Errorf("verify %s: key %s unknown", info.StorePath, sig.Name())
 	}
@@ -237,8 +268,51 @@ func VerifyNARInfo(trusted []*PublicKey, info *NARInfo, sig *Signature) error {
 	if err := info.WriteFingerprint(buf); err != nil {
 		return fmt.Errorf("verify %s: %v", info.StorePath, err)
 	}
-	if !ed25519.Verify(foundPub.data, buf.Bytes(), sig.data) {
+	if !foundPub.Verify(buf.Bytes(), sig) {
 		return fmt.Errorf("verify %s: signature for key %s is invalid", info.StorePath, sig.Name())
 	}
 	return nil
 }
+
+// SignatureStatus is the result of verifying a single signature
+// with [NARInfo.VerifyAll].
+type SignatureStatus struct {
+	// Name is the name of the key that produced the signature.
+	Name string
+	// Trusted is true if a key with the signature's name was in the trusted list.
+	Trusted bool
+	// Valid is true if the signature matches the trusted key of the same name.
+	// It is always false if Trusted is false.
+	Valid bool
+}
+
+// VerifyAll verifies each signature in info.Sig
+// against a list of trusted keys
+// and returns a status for each signature in the same order as info.Sig.
+// The trusted key list should not contain more than one key with the same name.
+func (info *NARInfo) VerifyAll(trusted []*PublicKey) []SignatureStatus {
+	if len(info.Sig) == 0 {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	fingerprintErr := info.WriteFingerprint(buf)
+	result := make([]SignatureStatus, 0, len(info.Sig))
+	for _, sig := range info.Sig {
+		pub := findPublicKey(trusted, sig.Name())
+		result = append(result, SignatureStatus{
+			Name:    sig.Name(),
+			Trusted: pub != nil,
+			Valid:   pub != nil && fingerprintErr == nil && pub.Verify(buf.Bytes(), sig),
+		})
+	}
+	return result
+}
+
+func findPublicKey(keys []*PublicKey, name string) *PublicKey {
+	for _, pub := range keys {
+		if pub.Name() == name {
+			return pub
+		}
+	}
+	return nil
+}
@@ -1,6 +1,12 @@
 package nix
 
-import "testing"
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
 
 const (
 	nixosPublicKey = "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="
@@ -32,6 +38,45 @@ func TestPublicKey(t *testing.T) {
 	}
 }
 
+func TestNewPublicKey(t *testing.T) {
+	pub, _, err := GenerateKey("test2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := pub.Bytes()
+	if len(raw) != ed25519.PublicKeySize {
+		t.Fatalf("len(pub.Bytes()) = %d; want %d", len(raw), ed25519.PublicKeySize)
+	}
+	got, err := NewPublicKey(pub.Name(), raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != pub.String() {
+		t.Errorf("NewPublicKey(%q, pub.Bytes()) = %v; want %v", pub.Name(), got, pub)
+	}
+
+	// Modifying the returned bytes must not change the key.
+	raw[0] ^= 0xff
+	if got.String() != pub.String() || !bytes.Equal(pub.Bytes(), got.Bytes()) {
+		t.Error("modifying Bytes() result changed the key")
+	}
+
+	badTests := []struct {
+		name string
+		key  ed25519.PublicKey
+	}{
+		{name: "", key: pub.Bytes()},
+		{name: "foo bar", key: pub.Bytes()},
+		{name: "test2", key: pub.Bytes()[:31]},
+		{name: "test2", key: nil},
+	}
+	for _, test := range badTests {
+		if got, err := NewPublicKey(test.name, test.key); err == nil {
+			t.Errorf("NewPublicKey(%q, %x) = %v, <nil>; want _, <error>", test.name, test.key, got)
+		}
+	}
+}
+
 func TestPrivateKey(t *testing.T) {
 	pk, err := ParsePrivateKey(test1SecretKey)
 	if err != nil {
@@ -100,6 +145,83 @@ func TestVerifyNARInfo(t *testing.T) {
 	}
 }
 
+func TestPublicKeyVerify(t *testing.T) {
+	const fingerprint = "1;/nix/store/syd87l2rxw8cbsxmxl853h0r6pdwhwjr-curl-7.82.0-bin;" +
+		"sha256:1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0;196040;" +
+		"/nix/store/0jqd0rlxzra1rs38rdxl43yh6rxchgc6-curl-7.82.0," +
+		"/nix/store/6w8g7njm4mck5dmjxws0z1xnrxvl81xa-glibc-2.34-115," +
+		"/nix/store/j5jxw3iy7bbz4a57fh9g2xm2gxmyal8h-zlib-1.2.12," +
+		"/nix/store/yxvjs9drzsphm9pcf42a4byzj1kb9m7k-openssl-1.1.1n"
+	pub, err := ParsePublicKey(nixosPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fingerprint string
+		sig         string
+		want        bool
+	}{
+		{
+			fingerprint: fingerprint,
+			sig:         "cache.nixos.org-1:TsTTb3WGTZKphvYdBHXwo6weVILmTytUjLB+vcX89fOjjRicCHmKA4RCPMVLkj6TMJ4GMX3HPVWRdD1hkeKZBQ==",
+			want:        true,
+		},
+		{
+			fingerprint: fingerprint + "x",
+			sig:         "cache.nixos.org-1:TsTTb3WGTZKphvYdBHXwo6weVILmTytUjLB+vcX89fOjjRicCHmKA4RCPMVLkj6TMJ4GMX3HPVWRdD1hkeKZBQ==",
+			want:        false,
+		},
+		{
+			fingerprint: fingerprint,
+			sig:         "cache.nixos.org-2:TsTTb3WGTZKphvYdBHXwo6weVILmTytUjLB+vcX89fOjjRicCHmKA4RCPMVLkj6TMJ4GMX3HPVWRdD1hkeKZBQ==",
+			want:        false,
+		},
+		{
+			fingerprint: fingerprint,
+			sig:         "cache.nixos.org-1:519iiVLx/c4Rdt5DNt6Y2Jm6hcWE9+XY69ygiWSZCNGVcmOcyL64uVAJ3cV8vaTusIZdbTnYo9Y7vDNeTmmMBQ==",
+			want:        false,
+		},
+	}
+	for _, test := range tests {
+		sig := mustParseSignature(t, test.sig)
+		if got := pub.Verify([]byte(test.fingerprint), sig); got != test.want {
+			t.Errorf("pub.Verify(%q, %v) = %t; want %t", test.fingerprint, sig, got, test.want)
+		}
+	}
+}
+
+func TestNARInfoVerifyAll(t *testing.T) {
+	info := &NARInfo{
+		StorePath: "/nix/store/syd87l2rxw8cbsxmxl853h0r6pdwhwjr-curl-7.82.0-bin",
+		NARSize:   196040,
+		References: []StorePath{
+			"/nix/store/0jqd0rlxzra1rs38rdxl43yh6rxchgc6-curl-7.82.0",
+			"/nix/store/6w8g7njm4mck5dmjxws0z1xnrxvl81xa-glibc-2.34-115",
+			"/nix/store/j5jxw3iy7bbz4a57fh9g2xm2gxmyal8h-zlib-1.2.12",
+			"/nix/store/yxvjs9drzsphm9pcf42a4byzj1kb9m7k-openssl-1.1.1n",
+		},
+		NARHash: mustParseHash(t, "sha256:1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0"),
+		Sig: []*Signature{
+			mustParseSignature(t, "cache.nixos.org-1:TsTTb3WGTZKphvYdBHXwo6weVILmTytUjLB+vcX89fOjjRicCHmKA4RCPMVLkj6TMJ4GMX3HPVWRdD1hkeKZBQ=="),
+			mustParseSignature(t, "test2:519iiVLx/c4Rdt5DNt6Y2Jm6hcWE9+XY69ygiWSZCNGVcmOcyL64uVAJ3cV8vaTusIZdbTnYo9Y7vDNeTmmMBQ=="),
+		},
+	}
+	pub, err := ParsePublicKey(nixosPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := info.VerifyAll([]*PublicKey{pub})
+	want := []SignatureStatus{
+		{Name: "cache.nixos.org-1", Trusted: true, Valid: true},
+		{Name: "test2", Trusted: false, Valid: false},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("VerifyAll(...) (-want +got):\n%s", diff)
+	}
+}
+
 func TestSignNARInfo(t *testing.T) {
 	pk, err := ParsePrivateKey(test1SecretKey)
 	if err != nil {